@@ -10,11 +10,17 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"os/signal"
+	"strconv"
+	"sync"
 	"syscall"
 	"tcptunnel/tunnelcomm"
 	"time"
@@ -23,73 +29,457 @@ import (
 )
 
 func main() {
-	// 获取需要加载的配置名字
-	serveraddr := flag.String("tunnel", "127.0.0.1:8101", "Tunnel server address")
-	proxyaddr := flag.String("proxy", "127.0.0.1:80", "Proxy server address")
-	isdebug := flag.Bool("debug", false, "Show debugger console logs")
-	maxTCPConn := flag.Int64("maxconn", 25, "Maximum number of free pipes")
+	// 获取需要加载的配置名字, 命令行中设置的参数覆盖配置文件
+	configfile := flag.String("config", "", "JSON configuration file listing servers and services, flags set on the command line override it")
+	flag.String("tunnel", "127.0.0.1:8101", "Tunnel server address")
+	flag.String("proxy", "127.0.0.1:80", "Proxy server address, use 'name=addr,name2=addr2' for multiple services, supports 'udp://' and 'unix://' prefixes")
+	flag.String("remote", "", "Remote ports the server listens on for services, as 'name=port,name2=port2', port '0' lets the server choose")
+	flag.String("proxyprotocol", "", "Send a PROXY protocol header with the user address to service targets, as 'name=v1,name2=v2'")
+	flag.String("hosts", "", "Host names routed to services by the server HTTP port, as 'host=name,*.example.com=name2'")
+	flag.String("id", "", "Client id, clients are distinguished by id on the server, default '' uses a random id")
+	flag.Bool("debug", false, "Show debugger console logs")
+	flag.Int64("minconn", 5, "Number of idle tunnel connections kept for each service")
+	flag.Int64("maxconn", 25, "Maximum number of tunnel connections for each service, '0' without limit")
+	flag.Int("shutdowntimeout", 30, "Seconds to wait for active sessions to finish when exiting")
+	flag.Int("udpidle", 60, "Seconds before the UDP connection of an idle user source address is closed")
+	flag.Int("idletimeout", 60, "Seconds before idle tunnel connections beyond 'minconn' are closed, '0' never closed")
+	flag.Int("mux", 0, "Number of multiplexed tunnel connections, default '0' uses one tunnel connection per session")
+	flag.String("token", "", "Pre-shared token for tunnel server authentication")
+	flag.String("user", "", "User name for tunnel server authentication, required by credential file")
+	flag.Bool("tls", false, "Connect to the tunnel server with TLS, enabled automatically by 'tlsca' or 'tlscert'")
+	flag.String("tlsca", "", "CA file to verify the tunnel server certificate, default '' uses system roots")
+	flag.String("tlscert", "", "Client certificate file for mutual TLS")
+	flag.String("tlskey", "", "Client private key file for mutual TLS")
 	flag.Parse()
+	cfg, err := loadClientConfig(*configfile, flag.CommandLine)
+	if nil != err {
+		logs.Errorln("TunnelClient.Config", err)
+		os.Exit(1)
+	}
+	configureLog(cfg, nil)
+	printOptions(cfg.options)
+
+	// 收到退出信号后关闭客户端, 每个服务端一个客户端
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	defer stop()
+	// 重新加载信号: 重新读取配置文件, 只重启配置变化的客户端
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	clients := newRunners(ctx)
+	clients.apply(cfg.options)
+	for running := true; running; {
+		select {
+		case <-ctx.Done():
+			running = false
+		case <-reload:
+			cfg = reloadConfig(*configfile, cfg, clients)
+		}
+	}
+	clients.wait()
+}
+
+// printOptions 打印服务地址
+func printOptions(options []clientOptions) {
+	for i := 0; i < len(options); i++ {
+		opts := options[i]
+		fmt.Println("隧道服务地址:", opts.serveraddr)
+		for j := 0; j < len(opts.proxies); j++ {
+			fmt.Println("本地代理地址:", opts.proxies[j].Name, "->", opts.proxies[j].Addr)
+		}
+		if nil != opts.tlsConfig {
+			fmt.Println("隧道启用TLS, 客户端证书:", len(opts.tlsConfig.Certificates) > 0)
+		}
+	}
+}
+
+// configureLog 设置日志级别和输出, 关闭上一次配置打开的日志文件
+func configureLog(cfg, prev *clientConfig) {
+	logs.SetLoggerLevel(cfg.logLevel)
+	if nil != cfg.logOutput {
+		logs.SetOutput(cfg.logOutput)
+	} else if nil != prev && nil != prev.logOutput {
+		logs.SetOutput(os.Stdout)
+	}
+	if nil != prev && nil != prev.logOutput {
+		prev.logOutput.(io.Closer).Close()
+	}
+}
+
+// reloadConfig 重新加载配置文件, 配置有误时继续使用原配置
+func reloadConfig(path string, cfg *clientConfig, clients *runners) *clientConfig {
+	logs.Infoln("TunnelClient.Reload")
+	next, err := loadClientConfig(path, flag.CommandLine)
+	if nil != err {
+		logs.Errorln("TunnelClient.Reload", err)
+		return cfg
+	}
+	configureLog(next, cfg)
+	clients.apply(next.options)
+	return next
+}
+
+// runner 运行中的客户端, ctx结束后关闭; 只有服务和连接池参数变化时通过updates在运行中更新
+type runner struct {
+	signature string
+	services  string
+	updates   chan clientOptions
+	cancel    context.CancelFunc
+	done      chan struct{}
+}
+
+// update 发送新的服务和连接池参数, 丢弃尚未应用的旧参数
+func (run *runner) update(opts clientOptions) {
+	select {
+	case <-run.updates:
+	default:
+	}
+	run.updates <- opts
+	run.services = opts.services
+}
+
+// runners 按服务端地址和客户端ID管理客户端, 重新加载配置时启动、关闭或重启
+type runners struct {
+	ctx     context.Context
+	wg      sync.WaitGroup
+	running map[string]*runner
+}
 
-	// 服务地址
-	fmt.Println("隧道服务地址:", *serveraddr)
-	fmt.Println("本地代理地址:", *proxyaddr)
-	// start
-	go start(*serveraddr, *proxyaddr, *maxTCPConn, *isdebug)
-
-	// 监听退出
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
-	logs.Infoln("os singal: ", <-sigs)
-}
-
-// start 启动本地代理服务
-func start(serveraddr, proxyaddr string, maxTCPConn int64, isdebug bool) {
-	if serviceAddr, err := net.ResolveTCPAddr("tcp", serveraddr); nil == err {
-		var dstsvr *net.TCPAddr
-		if dstsvr, err = net.ResolveTCPAddr("tcp", proxyaddr); nil != err {
-			logs.Errorln(err)
-			time.Sleep(time.Second * 10)
-			go start(serveraddr, proxyaddr, maxTCPConn, isdebug)
+// newRunners 创建客户端集合, ctx结束时关闭全部客户端
+func newRunners(ctx context.Context) *runners {
+	return &runners{ctx: ctx, running: make(map[string]*runner)}
+}
+
+// apply 关闭删除的客户端, 启动新增的客户端, 连接参数变化的客户端在原客户端关闭后重新启动
+// 只有服务和连接池参数变化的客户端在运行中更新, 不断开连接
+func (r *runners) apply(options []clientOptions) {
+	keep := make(map[string]string, len(options))
+	for i := 0; i < len(options); i++ {
+		keep[options[i].key] = options[i].signature
+	}
+	stopped := make(map[string]*runner)
+	for key, run := range r.running {
+		if signature, ok := keep[key]; !ok || signature != run.signature {
+			logs.Infoln("TunnelClient.Stop", key)
+			run.cancel()
+			stopped[key] = run
+			delete(r.running, key)
+		}
+	}
+	for i := 0; i < len(options); i++ {
+		if run, ok := r.running[options[i].key]; ok {
+			if run.services != options[i].services {
+				logs.Infoln("TunnelClient.Update", options[i].key)
+				run.update(options[i])
+			}
+			continue
+		}
+		ctx, cancel := context.WithCancel(r.ctx)
+		run := &runner{
+			signature: options[i].signature,
+			services:  options[i].services,
+			updates:   make(chan clientOptions, 1),
+			cancel:    cancel,
+			done:      make(chan struct{}),
+		}
+		r.running[options[i].key] = run
+		r.wg.Add(1)
+		go func(opts clientOptions, prev *runner) {
+			defer r.wg.Done()
+			defer close(run.done)
+			// 同一客户端ID不能同时连接, 等待原客户端关闭
+			if nil != prev {
+				<-prev.done
+			}
+			start(ctx, opts, run.updates)
+		}(options[i], stopped[options[i].key])
+	}
+}
+
+// wait 等待全部客户端关闭
+func (r *runners) wait() {
+	r.wg.Wait()
+}
+
+// clientOptions 客户端启动参数
+type clientOptions struct {
+	key           string // 服务端地址和客户端ID, 标识同一个客户端
+	signature     string // 连接参数摘要, 变化时重启客户端
+	services      string // 服务和连接池参数摘要, 变化时在运行中更新
+	serveraddr    string
+	clientid      string
+	proxies       []tunnelcomm.ServiceAddr
+	remote        map[string]int
+	hosts         map[string]string
+	proxyProtocol map[string]int
+	user          string
+	token         string
+	minTCPConn    int64
+	maxTCPConn    int64
+	idleTimeout   time.Duration
+	shutdown      time.Duration
+	udpIdle       time.Duration
+	muxConn       int
+	isdebug       bool
+	tlsConfig     *tls.Config
+}
+
+// start 启动本地代理服务, ctx结束后等待正在传输的连接结束并返回; 从updates收到的服务和连接池参数在运行中应用
+func start(ctx context.Context, opts clientOptions, updates chan clientOptions) {
+	// 解析失败时等待后重试, 期间收到的新参数替换原参数, ctx结束时放弃
+	serviceAddr, services, dstsvrs, err := resolveOptions(opts)
+	for nil != err {
+		logs.Errorln(err)
+		select {
+		case <-ctx.Done():
 			return
+		case opts = <-updates:
+		case <-time.After(time.Second * 10):
+		}
+		serviceAddr, services, dstsvrs, err = resolveOptions(opts)
+	}
+	targets := &serviceTargets{dstsvrs: dstsvrs, proxyProtocol: opts.proxyProtocol, shutdown: opts.shutdown, udpIdle: opts.udpIdle}
+	// 初始化客户端
+	TCPTunnelClient := tunnelcomm.NewTCPTunnelClient(serviceAddr, opts.minTCPConn, opts.isdebug)
+	TCPTunnelClient.SetPoolSize(opts.minTCPConn, opts.maxTCPConn, opts.idleTimeout)
+	TCPTunnelClient.SetID(opts.clientid)
+	TCPTunnelClient.SetUser(opts.user)
+	TCPTunnelClient.SetToken(opts.token)
+	TCPTunnelClient.SetTLSConfig(opts.tlsConfig)
+	TCPTunnelClient.SetMuxConns(opts.muxConn)
+	TCPTunnelClient.SetServices(services...)
+	TCPTunnelClient.SetRemotePorts(opts.remote)
+	TCPTunnelClient.SetHosts(opts.hosts)
+	// 当收到链接后执行, 连接代理目标失败时关闭隧道连接, 不再复用
+	TCPTunnelClient.SetTransportCallback(func(info tunnelcomm.TransportInfo, conn4src net.Conn, relase func() error) error {
+		// 连接服务对应的代理目标服务器
+		dstsvr, version, ok := targets.get(info.Service)
+		if !ok {
+			conn4src.Close()
+			return errors.New("unknown service: " + info.Service)
 		}
-		// 初始化客户端
-		TCPTunnelClient := tunnelcomm.NewTCPTunnelClient(serviceAddr, maxTCPConn, isdebug)
-		// 当收到链接后执行
-		TCPTunnelClient.SetTransportCallback(func(conn4src net.Conn, relase func() error) (err error) {
-			// 连接代理目标服务器
-			if conn4dst, err := net.DialTCP("tcp", nil, dstsvr); nil == err && nil != conn4dst {
-				defer conn4dst.Close()
-				defer conn4src.Close()
-				// 交换数据
-				exchange := func(w net.Conn, r net.Conn) chan struct{} {
-					lock := make(chan struct{})
-					go func() {
-						if _, err := tunnelcomm.ExchangeBuffer(w, r, 2048, 0); nil != err {
-							logs.Errorln(err)
-						}
-						close(lock)
-					}()
-					return lock
-				}
-				logs.Debugf("Exchange-Start[src -> dst] %s -> %s\r\n", conn4src.LocalAddr().String(), conn4dst.RemoteAddr().String())
-				select {
-				case <-exchange(conn4dst, conn4src):
-				case <-exchange(conn4src, conn4dst):
-				}
-				logs.Debugf("Exchange-End[src -> dst] %s -> %s\r\n", conn4src.LocalAddr().String(), conn4dst.RemoteAddr().String())
+		if dstsvr.Network() == "udp" {
+			// 转发UDP数据包, 每个用户来源地址使用单独的UDP连接, 服务端结束通道后返回
+			if err := tunnelcomm.PipeDatagram(conn4src, targets.datagramIdle(), func() (net.Conn, error) {
+				return net.Dial(dstsvr.Network(), dstsvr.String())
+			}); nil != err {
+				logs.Errorln(err)
+			}
+		} else {
+			conn4dst, err := net.Dial(dstsvr.Network(), dstsvr.String())
+			if nil != err {
+				logs.Errorln(err)
+				conn4src.Close()
+				return err
+			}
+			defer conn4dst.Close()
+			if err = writeProxyHeader(conn4dst, version, info); nil != err {
+				logs.Errorln(err)
+				conn4src.Close()
+				return err
 			}
-			return relase()
-		})
-		// 连接服务端, 失败重连
+			// 交换数据
+			logs.Debugf("Exchange-Start[src -> dst] %s -> %s\r\n", conn4src.LocalAddr().String(), conn4dst.RemoteAddr().String())
+			if err = tunnelcomm.PipeConn(conn4dst, conn4src, 2048, 0); nil != err {
+				logs.Errorln(err)
+			}
+			logs.Debugf("Exchange-End[src -> dst] %s -> %s\r\n", conn4src.LocalAddr().String(), conn4dst.RemoteAddr().String())
+		}
+		// 释放隧道连接, 失败时关闭
+		err := relase()
+		if nil != err {
+			conn4src.Close()
+		}
+		return err
+	})
+	// 退出时先等待正在传输的连接结束, 再断开控制连接; 控制连接使用的runCtx在关闭完成后结束
+	runCtx, cancelRun := context.WithCancel(context.Background())
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		defer cancelRun()
 		for {
-			if err := TCPTunnelClient.Start(); nil != err {
-				logs.Infof("隧道连接异常,正在重连 %s\r\n", err.Error())
+			select {
+			case <-ctx.Done():
+			case next := <-updates:
+				updateServices(TCPTunnelClient, targets, next)
+				continue
 			}
-			time.Sleep(time.Second)
+			break
+		}
+		logs.Infoln("TunnelClient.Shutdown")
+		sctx, cancel := context.WithTimeout(context.Background(), targets.shutdownTimeout())
+		defer cancel()
+		if err := TCPTunnelClient.Shutdown(sctx); nil != err {
+			logs.Errorln("TunnelClient.Shutdown", err)
+		}
+	}()
+	// 连接服务端, 失败重连
+	for {
+		if err := TCPTunnelClient.Start(runCtx); errors.Is(err, tunnelcomm.ErrClientClosed) || nil != runCtx.Err() {
+			break
+		} else if nil != err {
+			logs.Infof("隧道连接异常,正在重连 %s\r\n", err.Error())
+		}
+		if !sleep(runCtx, time.Second) {
+			break
+		}
+	}
+	<-finished
+}
+
+// updateServices 在运行中的客户端上注册新的服务、注销删除的服务并调整连接池大小
+// 更新期间新旧服务的代理目标都可用; 解析失败或服务端拒绝时保留原服务
+func updateServices(TCPTunnelClient *tunnelcomm.TCPTunnelClient, targets *serviceTargets, opts clientOptions) {
+	_, services, dstsvrs, err := resolveOptions(opts)
+	if nil != err {
+		logs.Errorln("TunnelClient.Update", err)
+		return
+	}
+	prev, prevProtocol := targets.set(dstsvrs, opts.proxyProtocol, true)
+	TCPTunnelClient.SetPoolSize(opts.minTCPConn, opts.maxTCPConn, opts.idleTimeout)
+	if err = TCPTunnelClient.UpdateServices(services, opts.remote, opts.hosts); nil != err {
+		logs.Errorln("TunnelClient.Update", err)
+		targets.set(prev, prevProtocol, false)
+		return
+	}
+	targets.set(dstsvrs, opts.proxyProtocol, false)
+	targets.setTimeouts(opts.shutdown, opts.udpIdle)
+}
+
+// serviceTargets 各服务的代理目标和PROXY协议版本, 更新服务时在运行中替换
+type serviceTargets struct {
+	dstsvrs       map[string]net.Addr
+	proxyProtocol map[string]int
+	shutdown      time.Duration
+	udpIdle       time.Duration
+	lock          sync.RWMutex
+}
+
+// get 获取服务的代理目标和PROXY协议版本
+func (t *serviceTargets) get(service string) (net.Addr, int, bool) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	dstsvr, ok := t.dstsvrs[service]
+	return dstsvr, t.proxyProtocol[service], ok
+}
+
+// set 替换代理目标和PROXY协议版本, merge为true时保留原有服务的代理目标, 返回原来的设置
+func (t *serviceTargets) set(dstsvrs map[string]net.Addr, proxyProtocol map[string]int, merge bool) (map[string]net.Addr, map[string]int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	prev, prevProtocol := t.dstsvrs, t.proxyProtocol
+	if merge {
+		merged := make(map[string]net.Addr, len(prev)+len(dstsvrs))
+		mergedProtocol := make(map[string]int, len(prevProtocol)+len(proxyProtocol))
+		for name, addr := range prev {
+			merged[name], mergedProtocol[name] = addr, prevProtocol[name]
+		}
+		for name, addr := range dstsvrs {
+			merged[name], mergedProtocol[name] = addr, proxyProtocol[name]
+		}
+		dstsvrs, proxyProtocol = merged, mergedProtocol
+	}
+	t.dstsvrs, t.proxyProtocol = dstsvrs, proxyProtocol
+	return prev, prevProtocol
+}
+
+// shutdownTimeout 退出时等待正在传输的连接结束的时间
+func (t *serviceTargets) shutdownTimeout() time.Duration {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return t.shutdown
+}
+
+// datagramIdle UDP来源地址的连接空闲超时时间
+func (t *serviceTargets) datagramIdle() time.Duration {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return t.udpIdle
+}
+
+// setTimeouts 设置退出时等待正在传输的连接结束的时间和UDP来源地址的连接空闲超时时间
+func (t *serviceTargets) setTimeouts(shutdown, udpIdle time.Duration) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.shutdown, t.udpIdle = shutdown, udpIdle
+}
+
+// resolveOptions 解析隧道服务端地址和各服务的代理目标
+func resolveOptions(opts clientOptions) (*net.TCPAddr, []string, map[string]net.Addr, error) {
+	serviceAddr, err := net.ResolveTCPAddr("tcp", opts.serveraddr)
+	if nil != err {
+		return nil, nil, nil, err
+	}
+	services := make([]string, len(opts.proxies))
+	dstsvrs := make(map[string]net.Addr, len(opts.proxies))
+	for i := 0; i < len(opts.proxies); i++ {
+		if dstsvrs[opts.proxies[i].Name], err = resolveTarget(opts.proxies[i].Addr); nil != err {
+			return nil, nil, nil, err
+		}
+		services[i] = opts.proxies[i].Name
+	}
+	return serviceAddr, services, dstsvrs, nil
+}
+
+// sleep 等待一段时间, ctx结束时提前返回false
+func sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// resolveTarget 解析代理目标地址, 支持'udp://'和'unix://'前缀
+func resolveTarget(addr string) (net.Addr, error) {
+	network, address := tunnelcomm.SplitNetworkAddr(addr)
+	if network == "udp" {
+		return net.ResolveUDPAddr(network, address)
+	} else if network == "unix" {
+		return net.ResolveUnixAddr(network, address)
+	}
+	return net.ResolveTCPAddr(network, address)
+}
+
+// writeProxyHeader 向代理目标发送携带用户地址的PROXY协议头, version为0时不发送
+func writeProxyHeader(conn net.Conn, version int, info tunnelcomm.TransportInfo) (err error) {
+	if version == 0 {
+		return nil
+	}
+	var header []byte
+	if header, err = tunnelcomm.BuildProxyHeader(version, info.SrcAddr, info.DstAddr); nil == err {
+		_, err = conn.Write(header)
+	}
+	return err
+}
+
+// parseProxyProtocol 解析'name=v1'格式的PROXY协议版本列表
+func parseProxyProtocol(spec string) (map[string]int, error) {
+	items, err := tunnelcomm.ParseServiceAddrs(spec)
+	if nil != err {
+		return nil, err
+	}
+	versions := make(map[string]int, len(items))
+	for i := 0; i < len(items); i++ {
+		if versions[items[i].Name], err = tunnelcomm.ParseProxyVersion(items[i].Addr); nil != err {
+			return nil, err
+		}
+	}
+	return versions, nil
+}
+
+// parseRemotePorts 解析'name=port'格式的远程端口列表
+func parseRemotePorts(spec string) (map[string]int, error) {
+	items, err := tunnelcomm.ParseServiceAddrs(spec)
+	if nil != err {
+		return nil, err
+	}
+	ports := make(map[string]int, len(items))
+	for i := 0; i < len(items); i++ {
+		if ports[items[i].Name], err = strconv.Atoi(items[i].Addr); nil != err {
+			return nil, errors.New("invalid remote port: " + items[i].Addr)
 		}
-	} else {
-		logs.Errorln(err)
-		time.Sleep(time.Second * 10)
-		go start(serveraddr, proxyaddr, maxTCPConn, isdebug)
 	}
+	return ports, nil
 }
@@ -0,0 +1,463 @@
+// Copyright (C) 2020 WuPeng <wup364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"tcptunnel/tunnelcomm"
+	"time"
+
+	"github.com/wup364/pakku/utils/logs"
+)
+
+// clientConfig 客户端配置, 来自配置文件和命令行参数, 命令行参数优先
+type clientConfig struct {
+	Servers         []serverConfig  `json:"servers"`
+	Services        []serviceConfig `json:"services"`
+	Pool            poolConfig      `json:"pool"`
+	Log             logConfig       `json:"log"`
+	ShutdownTimeout int             `json:"shutdowntimeout"`
+	UDPIdle         int             `json:"udpidle"`
+
+	// 以下为校验后的配置
+	file      *tunnelcomm.ConfigFile
+	options   []clientOptions // 每个服务端一个客户端
+	logLevel  logs.LoggerLeve
+	logOutput io.Writer
+}
+
+// serverConfig 隧道服务端配置
+type serverConfig struct {
+	Tunnel   string    `json:"tunnel"`
+	ID       string    `json:"id"`
+	User     string    `json:"user"`
+	Token    string    `json:"token"`
+	TLS      tlsConfig `json:"tls"`
+	Services []string  `json:"services"` // 注册到该服务端的服务, 为空时注册全部服务
+}
+
+// tlsConfig 隧道TLS配置
+type tlsConfig struct {
+	Enabled bool   `json:"enabled"`
+	CA      string `json:"ca"`
+	Cert    string `json:"cert"`
+	Key     string `json:"key"`
+}
+
+// serviceConfig 服务配置
+type serviceConfig struct {
+	Name          string   `json:"name"`
+	Target        string   `json:"target"`
+	Remote        *int     `json:"remote"`        // 请求服务端监听的端口, 为0时由服务端选择
+	ProxyProtocol string   `json:"proxyprotocol"` // 连接目标后发送的PROXY协议版本
+	Hosts         []string `json:"hosts"`         // 注册到服务端HTTP和SNI端口的域名
+}
+
+// poolConfig 隧道连接池配置
+type poolConfig struct {
+	Min         int64 `json:"min"`
+	Max         int64 `json:"max"`
+	IdleTimeout int   `json:"idletimeout"`
+	Mux         int   `json:"mux"`
+}
+
+// logConfig 日志配置
+type logConfig struct {
+	Level string `json:"level"`
+	File  string `json:"file"`
+}
+
+// serverFlags 只能在配置一个服务端时使用的命令行参数
+var serverFlags = map[string]string{
+	"tunnel":  "tunnel",
+	"id":      "id",
+	"user":    "user",
+	"token":   "token",
+	"tls":     "tls.enabled",
+	"tlsca":   "tls.ca",
+	"tlscert": "tls.cert",
+	"tlskey":  "tls.key",
+}
+
+// flagOrder 命令行参数的设置顺序, 服务的属性在服务列表之后设置
+var flagOrder = []string{
+	"tunnel", "id", "user", "token", "tls", "tlsca", "tlscert", "tlskey",
+	"proxy", "remote", "proxyprotocol", "hosts",
+	"minconn", "maxconn", "idletimeout", "mux", "debug", "shutdowntimeout", "udpidle",
+}
+
+// loadClientConfig 加载配置: 命令行参数的默认值, 配置文件, 命令行中设置的参数依次覆盖, 然后校验
+func loadClientConfig(path string, flags *flag.FlagSet) (cfg *clientConfig, err error) {
+	cfg = &clientConfig{}
+	all, set := make(map[string]string), make(map[string]string)
+	flags.VisitAll(func(f *flag.Flag) { all[f.Name] = f.Value.String() })
+	flags.Visit(func(f *flag.Flag) { set[f.Name] = f.Value.String() })
+	if err = cfg.setFlags(all); nil != err {
+		return nil, err
+	}
+	if len(path) > 0 {
+		if cfg.file, err = tunnelcomm.ReadConfigFile(path); nil != err {
+			return nil, err
+		}
+		// 列表中的元素不继承命令行参数的默认值, 文件中没有时才使用
+		servers, services := cfg.Servers, cfg.Services
+		cfg.Servers, cfg.Services = nil, nil
+		if err = cfg.file.Decode(cfg); nil != err {
+			return nil, err
+		}
+		if !cfg.file.Has("servers") {
+			cfg.Servers = servers
+		}
+		if !cfg.file.Has("services") {
+			cfg.Services = services
+		}
+	}
+	if err = cfg.setFlags(set); nil != err {
+		return nil, err
+	}
+	return cfg, cfg.validate()
+}
+
+// setFlags 按flagOrder使用命令行参数设置配置项
+func (cfg *clientConfig) setFlags(values map[string]string) (err error) {
+	for _, name := range flagOrder {
+		val, ok := values[name]
+		if !ok {
+			continue
+		}
+		if path, ok := serverFlags[name]; ok {
+			if len(cfg.Servers) > 1 {
+				return errors.New("flag -" + name + " can not be used with multiple servers in the config file")
+			}
+			if len(cfg.Servers) == 0 {
+				cfg.Servers = append(cfg.Servers, serverConfig{})
+			}
+			cfg.file.Override("servers[0]." + path)
+		}
+		if err = cfg.setFlag(name, val); nil != err {
+			return errors.New(name + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+// setFlag 使用命令行参数设置配置项
+func (cfg *clientConfig) setFlag(name, val string) (err error) {
+	var server *serverConfig
+	if len(cfg.Servers) > 0 {
+		server = &cfg.Servers[0]
+	}
+	switch name {
+	case "tunnel":
+		server.Tunnel = val
+	case "id":
+		server.ID = val
+	case "user":
+		server.User = val
+	case "token":
+		server.Token = val
+	case "tls":
+		server.TLS.Enabled = val == "true"
+	case "tlsca":
+		server.TLS.CA = val
+	case "tlscert":
+		server.TLS.Cert = val
+	case "tlskey":
+		server.TLS.Key = val
+	case "proxy":
+		var proxies []tunnelcomm.ServiceAddr
+		if proxies, err = tunnelcomm.ParseServiceAddrs(val); nil != err {
+			return err
+		}
+		cfg.file.Override("services")
+		cfg.Services = nil
+		for i := 0; i < len(proxies); i++ {
+			cfg.Services = append(cfg.Services, serviceConfig{Name: proxies[i].Name, Target: proxies[i].Addr})
+		}
+	case "remote":
+		if len(val) > 0 {
+			var ports map[string]int
+			if ports, err = parseRemotePorts(val); nil == err {
+				for svc, port := range ports {
+					port := port
+					if err = cfg.setService(svc, "remote", func(item *serviceConfig) { item.Remote = &port }); nil != err {
+						return err
+					}
+				}
+			}
+		}
+	case "proxyprotocol":
+		if len(val) > 0 {
+			var items []tunnelcomm.ServiceAddr
+			if items, err = tunnelcomm.ParseServiceAddrs(val); nil == err {
+				for i := 0; i < len(items) && nil == err; i++ {
+					version := items[i].Addr
+					err = cfg.setService(items[i].Name, "proxyprotocol", func(item *serviceConfig) { item.ProxyProtocol = version })
+				}
+			}
+		}
+	case "hosts":
+		if len(val) > 0 {
+			var routes map[string]string
+			if routes, err = tunnelcomm.ParseHostRoutes(val); nil == err {
+				for i := 0; i < len(cfg.Services); i++ {
+					cfg.Services[i].Hosts = nil
+				}
+				for host, svc := range routes {
+					host := host
+					if err = cfg.setService(svc, "hosts", func(item *serviceConfig) { item.Hosts = append(item.Hosts, host) }); nil != err {
+						return err
+					}
+				}
+			}
+		}
+	case "minconn":
+		cfg.Pool.Min, err = strconv.ParseInt(val, 10, 64)
+		cfg.file.Override("pool.min")
+	case "maxconn":
+		cfg.Pool.Max, err = strconv.ParseInt(val, 10, 64)
+		cfg.file.Override("pool.max")
+	case "idletimeout":
+		cfg.Pool.IdleTimeout, err = strconv.Atoi(val)
+		cfg.file.Override("pool.idletimeout")
+	case "mux":
+		cfg.Pool.Mux, err = strconv.Atoi(val)
+		cfg.file.Override("pool.mux")
+	case "debug":
+		if cfg.Log.Level = "info"; val == "true" {
+			cfg.Log.Level = "debug"
+		}
+		cfg.file.Override("log.level")
+	case "shutdowntimeout":
+		cfg.ShutdownTimeout, err = strconv.Atoi(val)
+		cfg.file.Override("shutdowntimeout")
+	case "udpidle":
+		cfg.UDPIdle, err = strconv.Atoi(val)
+		cfg.file.Override("udpidle")
+	}
+	return err
+}
+
+// setService 修改服务name的属性key
+func (cfg *clientConfig) setService(name, key string, set func(item *serviceConfig)) error {
+	for i := 0; i < len(cfg.Services); i++ {
+		if cfg.Services[i].Name == name {
+			cfg.file.Override("services[" + strconv.Itoa(i) + "]." + key)
+			set(&cfg.Services[i])
+			return nil
+		}
+	}
+	return errors.New("unknown service: " + name)
+}
+
+// validate 校验配置并生成每个服务端的客户端参数, 错误指向配置文件中的行
+func (cfg *clientConfig) validate() (err error) {
+	f := cfg.file
+	if cfg.Pool.Min < 0 {
+		return f.Errorf("pool.min", "must not be negative")
+	}
+	if cfg.Pool.Max < 0 || (cfg.Pool.Max > 0 && cfg.Pool.Max < cfg.Pool.Min) {
+		return f.Errorf("pool.max", "must be 0 or not less than pool.min")
+	}
+	if cfg.Pool.IdleTimeout < 0 {
+		return f.Errorf("pool.idletimeout", "must not be negative")
+	}
+	if cfg.Pool.Mux < 0 {
+		return f.Errorf("pool.mux", "must not be negative")
+	}
+	if cfg.ShutdownTimeout < 0 {
+		return f.Errorf("shutdowntimeout", "must not be negative")
+	}
+	if cfg.UDPIdle <= 0 {
+		return f.Errorf("udpidle", "must be positive")
+	}
+	if cfg.logLevel, err = tunnelcomm.ParseLogLevel(cfg.Log.Level); nil != err {
+		return f.Error("log.level", err)
+	}
+
+	// 服务
+	if len(cfg.Services) == 0 {
+		return f.Errorf("services", "no service specified")
+	}
+	services := make(map[string]int, len(cfg.Services))
+	hosts := make(map[string]bool)
+	for i := 0; i < len(cfg.Services); i++ {
+		path := "services[" + strconv.Itoa(i) + "]"
+		item := cfg.Services[i]
+		if len(item.Name) == 0 {
+			return f.Errorf(path+".name", "service name is empty")
+		}
+		if _, ok := services[item.Name]; ok {
+			return f.Errorf(path+".name", "duplicate service name: %s", item.Name)
+		}
+		if len(item.Target) == 0 {
+			return f.Errorf(path+".target", "service target is empty")
+		}
+		if svcs, err := tunnelcomm.ParseServiceAddrs(item.Name + "=" + item.Target); nil != err || len(svcs) != 1 {
+			if nil == err {
+				err = errors.New("invalid service: " + item.Name)
+			}
+			return f.Error(path, err)
+		}
+		if nil != item.Remote && (*item.Remote < 0 || *item.Remote > 65535) {
+			return f.Errorf(path+".remote", "invalid remote port: %d", *item.Remote)
+		}
+		if len(item.ProxyProtocol) > 0 {
+			if _, err = tunnelcomm.ParseProxyVersion(item.ProxyProtocol); nil != err {
+				return f.Error(path+".proxyprotocol", err)
+			}
+		}
+		for j := 0; j < len(item.Hosts); j++ {
+			host := strings.ToLower(item.Hosts[j])
+			if _, err = tunnelcomm.ParseHostRoutes(host + "=" + item.Name); nil != err {
+				return f.Error(path+".hosts["+strconv.Itoa(j)+"]", err)
+			}
+			if hosts[host] {
+				return f.Errorf(path+".hosts["+strconv.Itoa(j)+"]", "duplicate host: %s", host)
+			}
+			hosts[host] = true
+		}
+		services[item.Name] = i
+	}
+
+	// 服务端, 每个生成一组客户端参数
+	if len(cfg.Servers) == 0 {
+		return f.Errorf("servers", "no server specified")
+	}
+	cfg.options = nil
+	keys := make(map[string]bool, len(cfg.Servers))
+	for i := 0; i < len(cfg.Servers); i++ {
+		path := "servers[" + strconv.Itoa(i) + "]"
+		server := cfg.Servers[i]
+		if _, _, err = net.SplitHostPort(server.Tunnel); nil != err {
+			return f.Error(path+".tunnel", err)
+		}
+		opts := clientOptions{
+			key:         server.Tunnel + "#" + server.ID,
+			serveraddr:  server.Tunnel,
+			clientid:    server.ID,
+			user:        server.User,
+			token:       server.Token,
+			minTCPConn:  cfg.Pool.Min,
+			maxTCPConn:  cfg.Pool.Max,
+			idleTimeout: time.Duration(cfg.Pool.IdleTimeout) * time.Second,
+			shutdown:    time.Duration(cfg.ShutdownTimeout) * time.Second,
+			udpIdle:     time.Duration(cfg.UDPIdle) * time.Second,
+			muxConn:     cfg.Pool.Mux,
+			isdebug:     cfg.logLevel == logs.DEBUG,
+		}
+		names := server.Services
+		if len(names) == 0 {
+			for j := 0; j < len(cfg.Services); j++ {
+				names = append(names, cfg.Services[j].Name)
+			}
+		}
+		for j := 0; j < len(names); j++ {
+			index, ok := services[names[j]]
+			if !ok {
+				return f.Errorf(path+".services["+strconv.Itoa(j)+"]", "unknown service: %s", names[j])
+			}
+			for k := 0; k < len(opts.proxies); k++ {
+				if opts.proxies[k].Name == names[j] {
+					return f.Errorf(path+".services["+strconv.Itoa(j)+"]", "duplicate service name: %s", names[j])
+				}
+			}
+			if err = opts.addService(cfg.Services[index]); nil != err {
+				return f.Error(path, err)
+			}
+		}
+		if server.TLS.Enabled || len(server.TLS.CA) > 0 || len(server.TLS.Cert) > 0 {
+			if (len(server.TLS.Cert) > 0) != (len(server.TLS.Key) > 0) {
+				return f.Errorf(path+".tls", "cert and key must be set together")
+			}
+			if opts.tlsConfig, err = tunnelcomm.NewClientTLSConfig(server.TLS.CA, server.TLS.Cert, server.TLS.Key); nil != err {
+				return f.Error(path+".tls", err)
+			}
+		}
+		if keys[opts.key] {
+			return f.Errorf(path, "duplicate server: %s, set different ids to connect more than once", server.Tunnel)
+		}
+		keys[opts.key] = true
+		if opts.signature, err = cfg.signature(server, opts); nil != err {
+			return f.Error(path+".tls", err)
+		}
+		opts.services = cfg.servicesSignature(opts)
+		cfg.options = append(cfg.options, opts)
+	}
+
+	// 日志
+	cfg.logOutput = nil
+	if len(cfg.Log.File) > 0 {
+		if cfg.logOutput, err = os.OpenFile(cfg.Log.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); nil != err {
+			return f.Error("log.file", err)
+		}
+	}
+	return nil
+}
+
+// signature 客户端连接参数的摘要, 包括证书文件的内容, 重新加载配置时摘要变化的客户端需要重启
+// 服务和连接池参数不在其中, 由servicesSignature比较, 在运行中的客户端上更新
+func (cfg *clientConfig) signature(server serverConfig, opts clientOptions) (string, error) {
+	hash := sha256.New()
+	json.NewEncoder(hash).Encode([]interface{}{server.Tunnel, server.ID, server.User, server.Token, server.TLS, cfg.Pool.Mux, opts.isdebug})
+	files := []string{server.TLS.CA, server.TLS.Cert, server.TLS.Key}
+	for i := 0; i < len(files); i++ {
+		if len(files[i]) == 0 {
+			continue
+		}
+		data, err := os.ReadFile(files[i])
+		if nil != err {
+			return "", err
+		}
+		hash.Write(data)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// servicesSignature 服务和连接池参数的摘要, 重新加载配置时只有该摘要变化的客户端不需要重启
+func (cfg *clientConfig) servicesSignature(opts clientOptions) string {
+	hash := sha256.New()
+	json.NewEncoder(hash).Encode([]interface{}{opts.proxies, opts.remote, opts.hosts, opts.proxyProtocol, opts.minTCPConn, opts.maxTCPConn, opts.idleTimeout, opts.shutdown, opts.udpIdle})
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// addService 添加服务及其远程端口、PROXY协议和域名
+func (opts *clientOptions) addService(item serviceConfig) (err error) {
+	opts.proxies = append(opts.proxies, tunnelcomm.ServiceAddr{Name: item.Name, Addr: item.Target})
+	if nil != item.Remote {
+		if nil == opts.remote {
+			opts.remote = make(map[string]int)
+		}
+		opts.remote[item.Name] = *item.Remote
+	}
+	if len(item.ProxyProtocol) > 0 {
+		if nil == opts.proxyProtocol {
+			opts.proxyProtocol = make(map[string]int)
+		}
+		if opts.proxyProtocol[item.Name], err = tunnelcomm.ParseProxyVersion(item.ProxyProtocol); nil != err {
+			return err
+		}
+	}
+	for i := 0; i < len(item.Hosts); i++ {
+		if nil == opts.hosts {
+			opts.hosts = make(map[string]string)
+		}
+		opts.hosts[strings.ToLower(item.Hosts[i])] = item.Name
+	}
+	return nil
+}
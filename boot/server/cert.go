@@ -0,0 +1,156 @@
+// Copyright (C) 2020 WuPeng <wup364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"tcptunnel/tunnelcomm"
+	"time"
+
+	"github.com/wup364/pakku/utils/fileutil"
+)
+
+// certReservedNames CA和服务端证书使用的文件名, 不能作为客户端名称
+var certReservedNames = []string{"ca", "ca-key", "server", "server-key"}
+
+// runCertCommand 执行`tunnel-server cert`子命令, 创建本地CA并签发服务端和客户端证书
+// 目录中已存在CA和服务端证书时复用, 便于后续继续签发客户端证书
+func runCertCommand(args []string) (err error) {
+	cmd := flag.NewFlagSet("cert", flag.ExitOnError)
+	dir := cmd.String("dir", "./certs", "Output directory of the certificates")
+	days := cmd.Int("days", 825, "Validity of the issued certificates in days")
+	cadays := cmd.Int("cadays", 3650, "Validity of a newly created CA in days")
+	server := cmd.String("server", "tunnel-server", "Common name of the server certificate, '' to skip")
+	san := cmd.String("san", "localhost,127.0.0.1", "Server certificate SAN list (DNS names or IPs), separated by ','")
+	clients := cmd.String("client", "client", "Common names of client certificates to issue, separated by ','")
+	renewServer := cmd.Bool("renewserver", false, "Reissue the server certificate even if it already exists in the directory")
+	if err = cmd.Parse(args); nil != err {
+		return err
+	}
+	names := splitList(*clients)
+	if err = checkClientNames(names); nil != err {
+		return err
+	}
+	if err = fileutil.MkdirAll(*dir); nil != err {
+		return err
+	}
+
+	// 1. 读取或创建CA
+	caFile, caKeyFile := filepath.Join(*dir, "ca.pem"), filepath.Join(*dir, "ca-key.pem")
+	var caPEM, caKeyPEM []byte
+	if fileutil.IsFile(caFile) && fileutil.IsFile(caKeyFile) {
+		if caPEM, err = os.ReadFile(caFile); nil == err {
+			caKeyPEM, err = os.ReadFile(caKeyFile)
+		}
+		fmt.Println("使用已有CA:", caFile)
+	} else {
+		if caPEM, caKeyPEM, err = tunnelcomm.GenerateCA("tcptunnel-ca", time.Duration(*cadays)*24*time.Hour); nil == err {
+			err = writeCertFiles(caFile, caKeyFile, caPEM, caKeyPEM)
+		}
+	}
+	if nil != err {
+		return err
+	}
+
+	// 2. 签发服务端证书, 已存在时不覆盖, 避免追加客户端时替换正在使用的服务端证书
+	validFor := time.Duration(*days) * 24 * time.Hour
+	serverFile, serverKeyFile := filepath.Join(*dir, "server.pem"), filepath.Join(*dir, "server-key.pem")
+	if len(*server) > 0 && !*renewServer && fileutil.IsFile(serverFile) && fileutil.IsFile(serverKeyFile) {
+		fmt.Println("使用已有服务端证书:", serverFile, "(使用--renewserver重新签发)")
+	} else if len(*server) > 0 {
+		var certPEM, keyPEM []byte
+		if certPEM, keyPEM, err = tunnelcomm.IssueCertificate(caPEM, caKeyPEM, *server, splitList(*san), false, validFor); nil != err {
+			return err
+		}
+		if err = writeCertFiles(serverFile, serverKeyFile, certPEM, keyPEM); nil != err {
+			return err
+		}
+	}
+
+	// 3. 签发客户端证书
+	for i := 0; i < len(names); i++ {
+		var certPEM, keyPEM []byte
+		if certPEM, keyPEM, err = tunnelcomm.IssueCertificate(caPEM, caKeyPEM, names[i], nil, true, validFor); nil != err {
+			return err
+		}
+		if err = writeCertFiles(filepath.Join(*dir, names[i]+".pem"), filepath.Join(*dir, names[i]+"-key.pem"), certPEM, keyPEM); nil != err {
+			return err
+		}
+	}
+
+	fmt.Println("服务端启动参数:", fmt.Sprintf("--tlscert=%s --tlskey=%s --tlsclientca=%s", serverFile, serverKeyFile, caFile))
+	for i := 0; i < len(names); i++ {
+		fmt.Println("客户端启动参数:", fmt.Sprintf("--tlsca=%s --tlscert=%s --tlskey=%s",
+			caFile, filepath.Join(*dir, names[i]+".pem"), filepath.Join(*dir, names[i]+"-key.pem")))
+	}
+	return err
+}
+
+// checkClientNames 客户端名称用作文件名, 不能包含路径, 不能与CA、服务端或其他客户端的文件重名
+func checkClientNames(names []string) error {
+	files := make(map[string]bool)
+	for i := 0; i < len(certReservedNames); i++ {
+		files[certReservedNames[i]] = true
+	}
+	for i := 0; i < len(names); i++ {
+		// 文件系统可能不区分大小写
+		name := strings.ToLower(names[i])
+		if strings.ContainsAny(name, `/\:`) || strings.Contains(name, "..") || name == "." {
+			return errors.New("invalid client name: " + names[i] + ", it must not contain a path")
+		}
+		if files[name] || files[name+"-key"] {
+			return errors.New("invalid client name: " + names[i] + ", it conflicts with the ca, server or another client files")
+		}
+		files[name], files[name+"-key"] = true, true
+	}
+	return nil
+}
+
+// runCredentialCommand 执行`tunnel-server credential`子命令, 输出凭据文件中的一行, 文件只保存校验值
+func runCredentialCommand(args []string) (err error) {
+	cmd := flag.NewFlagSet("credential", flag.ExitOnError)
+	user := cmd.String("user", "", "User name of the tunnel client")
+	token := cmd.String("token", "", "Token of the tunnel client")
+	if err = cmd.Parse(args); nil != err {
+		return err
+	}
+	if len(*user) == 0 || len(*token) == 0 || strings.Contains(*user, ":") {
+		return errors.New("user and token are required, and user must not contain ':'")
+	}
+	fmt.Println(tunnelcomm.CredentialLine(*user, *token))
+	return err
+}
+
+// writeCertFiles 写入证书和私钥, 私钥仅当前用户可读
+func writeCertFiles(certFile, keyFile string, certPEM, keyPEM []byte) (err error) {
+	if err = os.WriteFile(certFile, certPEM, 0644); nil == err {
+		if err = os.WriteFile(keyFile, keyPEM, 0600); nil == err {
+			fmt.Println("已生成:", certFile, keyFile)
+		}
+	}
+	return err
+}
+
+// splitList 拆分逗号分隔的列表, 忽略空项
+func splitList(str string) []string {
+	res := make([]string, 0)
+	items := strings.Split(str, ",")
+	for i := 0; i < len(items); i++ {
+		if item := strings.TrimSpace(items[i]); len(item) > 0 {
+			res = append(res, item)
+		}
+	}
+	return res
+}
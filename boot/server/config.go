@@ -0,0 +1,317 @@
+// Copyright (C) 2020 WuPeng <wup364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"tcptunnel/tunnelcomm"
+
+	"github.com/wup364/pakku/utils/logs"
+)
+
+// serverConfig 服务端配置, 来自配置文件和命令行参数, 命令行参数优先
+type serverConfig struct {
+	Tunnel          tunnelConfig     `json:"tunnel"`
+	Listeners       []listenerConfig `json:"listeners"`
+	HTTP            string           `json:"http"`
+	SNI             string           `json:"sni"`
+	ProxyFrom       []string         `json:"proxyfrom"`
+	Clients         clientsConfig    `json:"clients"`
+	Limits          limitsConfig     `json:"limits"`
+	Log             logConfig        `json:"log"`
+	ShutdownTimeout int              `json:"shutdowntimeout"`
+	DrainTimeout    int              `json:"draintimeout"`
+
+	// 以下为校验后的配置
+	file          *tunnelcomm.ConfigFile
+	listens       []tunnelcomm.ServiceAddr
+	ports         tunnelcomm.PortRange
+	proxies       []*net.IPNet
+	tlsConfig     *tls.Config
+	authenticator tunnelcomm.Authenticator
+	logLevel      logs.LoggerLeve
+	logOutput     io.Writer
+}
+
+// tunnelConfig 隧道端口配置
+type tunnelConfig struct {
+	Listen      string `json:"listen"`
+	TLSCert     string `json:"tlscert"`
+	TLSKey      string `json:"tlskey"`
+	TLSClientCA string `json:"tlsclientca"`
+	RemotePorts string `json:"remoteports"`
+}
+
+// listenerConfig 用户侧服务端口配置
+type listenerConfig struct {
+	Name string `json:"name"`
+	Addr string `json:"addr"`
+}
+
+// clientsConfig 允许连接的客户端
+type clientsConfig struct {
+	Tokens   []string `json:"tokens"`
+	AuthFile string   `json:"authfile"`
+}
+
+// limitsConfig 速率和等待限制
+type limitsConfig struct {
+	Speed       int `json:"speed"`
+	UDPIdle     int `json:"udpidle"`
+	WaitTimeout int `json:"waittimeout"`
+	WaitQueue   int `json:"waitqueue"`
+}
+
+// logConfig 日志配置
+type logConfig struct {
+	Level string `json:"level"`
+	File  string `json:"file"`
+}
+
+// flagPaths 命令行参数对应的配置项
+var flagPaths = map[string]string{
+	"listen":          "listeners",
+	"tunnel":          "tunnel.listen",
+	"tlscert":         "tunnel.tlscert",
+	"tlskey":          "tunnel.tlskey",
+	"tlsclientca":     "tunnel.tlsclientca",
+	"remoteports":     "tunnel.remoteports",
+	"http":            "http",
+	"sni":             "sni",
+	"proxyfrom":       "proxyfrom",
+	"token":           "clients.tokens",
+	"authfile":        "clients.authfile",
+	"speed":           "limits.speed",
+	"udpidle":         "limits.udpidle",
+	"waittimeout":     "limits.waittimeout",
+	"waitqueue":       "limits.waitqueue",
+	"debug":           "log.level",
+	"shutdowntimeout": "shutdowntimeout",
+	"draintimeout":    "draintimeout",
+}
+
+// loadServerConfig 加载配置: 命令行参数的默认值, 配置文件, 命令行中设置的参数依次覆盖, 然后校验
+func loadServerConfig(path string, flags *flag.FlagSet) (cfg *serverConfig, err error) {
+	cfg = &serverConfig{}
+	flags.VisitAll(func(f *flag.Flag) {
+		if nil == err {
+			err = cfg.setFlag(f)
+		}
+	})
+	if nil != err {
+		return nil, err
+	}
+	if len(path) > 0 {
+		if cfg.file, err = tunnelcomm.ReadConfigFile(path); nil != err {
+			return nil, err
+		}
+		// 列表中的元素不继承命令行参数的默认值, 文件中没有时才使用
+		listeners := cfg.Listeners
+		cfg.Listeners = nil
+		if err = cfg.file.Decode(cfg); nil != err {
+			return nil, err
+		}
+		if !cfg.file.Has("listeners") {
+			cfg.Listeners = listeners
+		}
+	}
+	explicit := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		if nil == err {
+			explicit[f.Name] = true
+			cfg.file.Override(flagPaths[f.Name])
+			err = cfg.setFlag(f)
+		}
+	})
+	if nil != err {
+		return nil, err
+	}
+	// 凭据文件优先于token, 命令行中只设置了token时不再使用文件中的凭据文件
+	if explicit["token"] && !explicit["authfile"] {
+		cfg.file.Override(flagPaths["authfile"])
+		cfg.Clients.AuthFile = ""
+	}
+	return cfg, cfg.validate()
+}
+
+// setFlag 使用命令行参数设置配置项, 不是配置项的参数忽略
+func (cfg *serverConfig) setFlag(f *flag.Flag) (err error) {
+	val := f.Value.String()
+	switch f.Name {
+	case "listen":
+		cfg.Listeners = nil
+		if len(val) > 0 {
+			var listens []tunnelcomm.ServiceAddr
+			if listens, err = tunnelcomm.ParseServiceAddrs(val); nil != err {
+				return errors.New("listen: " + err.Error())
+			}
+			for i := 0; i < len(listens); i++ {
+				cfg.Listeners = append(cfg.Listeners, listenerConfig{Name: listens[i].Name, Addr: listens[i].Addr})
+			}
+		}
+	case "tunnel":
+		cfg.Tunnel.Listen = val
+	case "tlscert":
+		cfg.Tunnel.TLSCert = val
+	case "tlskey":
+		cfg.Tunnel.TLSKey = val
+	case "tlsclientca":
+		cfg.Tunnel.TLSClientCA = val
+	case "remoteports":
+		cfg.Tunnel.RemotePorts = val
+	case "http":
+		cfg.HTTP = val
+	case "sni":
+		cfg.SNI = val
+	case "proxyfrom":
+		cfg.ProxyFrom = splitList(val)
+	case "token":
+		cfg.Clients.Tokens = splitList(val)
+	case "authfile":
+		cfg.Clients.AuthFile = val
+	case "speed":
+		cfg.Limits.Speed, err = strconv.Atoi(val)
+	case "udpidle":
+		cfg.Limits.UDPIdle, err = strconv.Atoi(val)
+	case "waittimeout":
+		cfg.Limits.WaitTimeout, err = strconv.Atoi(val)
+	case "waitqueue":
+		cfg.Limits.WaitQueue, err = strconv.Atoi(val)
+	case "debug":
+		if cfg.Log.Level = "info"; val == "true" {
+			cfg.Log.Level = "debug"
+		}
+	case "shutdowntimeout":
+		cfg.ShutdownTimeout, err = strconv.Atoi(val)
+	case "draintimeout":
+		cfg.DrainTimeout, err = strconv.Atoi(val)
+	}
+	return err
+}
+
+// validate 校验配置并生成服务使用的对象, 错误指向配置文件中的行
+func (cfg *serverConfig) validate() (err error) {
+	f := cfg.file
+	if _, _, err = net.SplitHostPort(cfg.Tunnel.Listen); nil != err {
+		return f.Error("tunnel.listen", err)
+	}
+	if (len(cfg.Tunnel.TLSCert) > 0) != (len(cfg.Tunnel.TLSKey) > 0) {
+		return f.Errorf("tunnel.tlscert", "tlscert and tlskey must be set together")
+	}
+	if len(cfg.Tunnel.TLSClientCA) > 0 && len(cfg.Tunnel.TLSCert) == 0 {
+		return f.Errorf("tunnel.tlsclientca", "tlsclientca requires tlscert and tlskey")
+	}
+	if len(cfg.Tunnel.TLSCert) > 0 {
+		if cfg.tlsConfig, err = tunnelcomm.NewServerTLSConfig(cfg.Tunnel.TLSCert, cfg.Tunnel.TLSKey, cfg.Tunnel.TLSClientCA); nil != err {
+			return f.Error("tunnel.tlscert", err)
+		}
+	}
+	if len(cfg.Tunnel.RemotePorts) > 0 {
+		if cfg.ports, err = tunnelcomm.ParsePortRange(cfg.Tunnel.RemotePorts); nil != err {
+			return f.Error("tunnel.remoteports", err)
+		}
+	}
+
+	// 用户侧服务
+	cfg.listens = nil
+	for i := 0; i < len(cfg.Listeners); i++ {
+		path := "listeners[" + strconv.Itoa(i) + "]"
+		item := cfg.Listeners[i]
+		if len(item.Name) == 0 {
+			return f.Errorf(path+".name", "service name is empty")
+		}
+		if len(item.Addr) == 0 {
+			return f.Errorf(path+".addr", "service address is empty")
+		}
+		var svcs []tunnelcomm.ServiceAddr
+		if svcs, err = tunnelcomm.ParseServiceAddrs(item.Name + "=" + item.Addr); nil != err || len(svcs) != 1 {
+			if nil == err {
+				err = errors.New("invalid service: " + item.Name)
+			}
+			return f.Error(path, err)
+		}
+		for j := 0; j < len(cfg.listens); j++ {
+			if cfg.listens[j].Name == item.Name {
+				return f.Errorf(path+".name", "duplicate service name: %s", item.Name)
+			}
+		}
+		cfg.listens = append(cfg.listens, svcs[0])
+	}
+	if len(cfg.HTTP) > 0 {
+		if _, _, err = net.SplitHostPort(cfg.HTTP); nil != err {
+			return f.Error("http", err)
+		}
+	}
+	if len(cfg.SNI) > 0 {
+		if _, _, err = net.SplitHostPort(cfg.SNI); nil != err {
+			return f.Error("sni", err)
+		}
+	}
+	cfg.proxies = nil
+	for i := 0; i < len(cfg.ProxyFrom); i++ {
+		var nets []*net.IPNet
+		if nets, err = tunnelcomm.ParseCIDRs(cfg.ProxyFrom[i]); nil != err {
+			return f.Error("proxyfrom["+strconv.Itoa(i)+"]", err)
+		}
+		cfg.proxies = append(cfg.proxies, nets...)
+	}
+
+	// 客户端认证, 凭据文件优先
+	cfg.authenticator = nil
+	if len(cfg.Clients.AuthFile) > 0 {
+		if cfg.authenticator, err = tunnelcomm.NewCredentialFileAuthenticator(cfg.Clients.AuthFile); nil != err {
+			return f.Error("clients.authfile", err)
+		}
+	} else if len(cfg.Clients.Tokens) > 0 {
+		for i := 0; i < len(cfg.Clients.Tokens); i++ {
+			if len(cfg.Clients.Tokens[i]) == 0 {
+				return f.Errorf("clients.tokens["+strconv.Itoa(i)+"]", "token is empty")
+			}
+		}
+		cfg.authenticator = tunnelcomm.NewTokenAuthenticator(cfg.Clients.Tokens...)
+	}
+
+	// 限制
+	if cfg.Limits.Speed < 0 {
+		return f.Errorf("limits.speed", "must not be negative")
+	}
+	if cfg.Limits.UDPIdle <= 0 {
+		return f.Errorf("limits.udpidle", "must be positive")
+	}
+	if cfg.Limits.WaitTimeout <= 0 {
+		return f.Errorf("limits.waittimeout", "must be positive")
+	}
+	if cfg.Limits.WaitQueue < 0 {
+		return f.Errorf("limits.waitqueue", "must not be negative")
+	}
+	if cfg.ShutdownTimeout < 0 {
+		return f.Errorf("shutdowntimeout", "must not be negative")
+	}
+	if cfg.DrainTimeout < 0 {
+		return f.Errorf("draintimeout", "must not be negative")
+	}
+
+	// 日志
+	if cfg.logLevel, err = tunnelcomm.ParseLogLevel(cfg.Log.Level); nil != err {
+		return f.Error("log.level", err)
+	}
+	cfg.logOutput = nil
+	if len(cfg.Log.File) > 0 {
+		if cfg.logOutput, err = os.OpenFile(cfg.Log.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); nil != err {
+			return f.Error("log.file", err)
+		}
+	}
+	return nil
+}
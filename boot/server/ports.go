@@ -0,0 +1,168 @@
+// Copyright (C) 2020 WuPeng <wup364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"tcptunnel/tunnelcomm"
+
+	"github.com/wup364/pakku/utils/logs"
+)
+
+// portSet 服务端打开的端口, 按名称管理, 重新加载配置时打开、关闭或替换
+type portSet struct {
+	handoff   *tunnelcomm.Handoff
+	TCPTunnel *tunnelcomm.TCPTunnelService
+	ports     map[string]*openPort
+	failed    chan error // 端口服务失败
+}
+
+// openPort 已打开的端口
+type openPort struct {
+	addr    string
+	closer  io.Closer
+	removed int32 // 已被关闭, 忽略服务返回的错误
+}
+
+// newPortSet 创建端口集合, 端口通过handoff打开, 升级时交给新程序
+func newPortSet(handoff *tunnelcomm.Handoff, TCPTunnel *tunnelcomm.TCPTunnelService) *portSet {
+	return &portSet{
+		handoff:   handoff,
+		TCPTunnel: TCPTunnel,
+		ports:     make(map[string]*openPort),
+		failed:    make(chan error, 1),
+	}
+}
+
+// portAddrs 配置中的全部端口, 名称->地址, 名称同时用于升级时交接监听
+func portAddrs(cfg *serverConfig) map[string]string {
+	addrs := map[string]string{"tunnel": cfg.Tunnel.Listen}
+	for i := 0; i < len(cfg.listens); i++ {
+		addrs["listen:"+cfg.listens[i].Name] = cfg.listens[i].Addr
+	}
+	if len(cfg.HTTP) > 0 {
+		addrs["http"] = cfg.HTTP
+	}
+	if len(cfg.SNI) > 0 {
+		addrs["sni"] = cfg.SNI
+	}
+	return addrs
+}
+
+// portTitle 端口服务的日志名称
+func portTitle(name string) string {
+	switch name {
+	case "tunnel":
+		return "TunnelService.Start"
+	case "http":
+		return "HTTPService.Start"
+	case "sni":
+		return "SNIService.Start"
+	}
+	return "UserService.Start " + strings.TrimPrefix(name, "listen:")
+}
+
+// apply 打开新增的端口, 关闭删除的端口, 替换地址变化的端口, 返回第一个错误
+// 隧道端口地址变化时需要重启, 继续使用原端口
+func (p *portSet) apply(addrs map[string]string) (err error) {
+	for name, port := range p.ports {
+		if addr, ok := addrs[name]; !ok || addr != port.addr {
+			if name == "tunnel" {
+				logs.Errorln("TunnelService.Reload", "changing the tunnel address requires a restart")
+				continue
+			}
+			p.close(name)
+		}
+	}
+	names := make([]string, 0, len(addrs))
+	for name := range addrs {
+		if _, ok := p.ports[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for i := 0; i < len(names); i++ {
+		if e := p.open(names[i], addrs[names[i]]); nil != e {
+			logs.Errorln(portTitle(names[i]), e)
+			if nil == err {
+				err = e
+			}
+		}
+	}
+	return err
+}
+
+// open 打开端口并开始服务, 服务失败时通过failed通知
+func (p *portSet) open(name, addr string) (err error) {
+	var closer io.Closer
+	var serve func() error
+	var listener net.Listener
+	switch name {
+	case "tunnel":
+		if listener, err = p.handoff.Listen(name, "tcp", addr); nil == err {
+			serve = func() error { return p.TCPTunnel.Serve(context.Background(), listener) }
+		}
+	case "http":
+		if listener, err = p.handoff.Listen(name, "tcp", addr); nil == err {
+			serve = func() error { return p.TCPTunnel.ServeHTTPListener(listener) }
+		}
+	case "sni":
+		if listener, err = p.handoff.Listen(name, "tcp", addr); nil == err {
+			serve = func() error { return p.TCPTunnel.ServeTLSListener(listener) }
+		}
+	default:
+		// 用户侧服务, 用户连接或UDP数据包转发到客户端的同名服务
+		svc := strings.TrimPrefix(name, "listen:")
+		network, address := tunnelcomm.SplitNetworkAddr(addr)
+		if network == "udp" {
+			var pc net.PacketConn
+			if pc, err = p.handoff.ListenPacket(name, network, address); nil == err {
+				closer, serve = pc, func() error { return p.TCPTunnel.ServeUDPListener(pc, svc) }
+			}
+		} else if listener, err = p.handoff.Listen(name, network, address); nil == err {
+			serve = func() error { return p.TCPTunnel.ServeListener(listener, svc) }
+		}
+	}
+	if nil != err {
+		return err
+	}
+	if nil != listener {
+		closer = listener
+	}
+	port := &openPort{addr: addr, closer: closer}
+	p.ports[name] = port
+	go func() {
+		title := portTitle(name)
+		logs.Infoln(title)
+		if err := serve(); nil != err && !errors.Is(err, tunnelcomm.ErrServiceClosed) && atomic.LoadInt32(&port.removed) == 0 {
+			logs.Errorln(title, err)
+			select {
+			case p.failed <- err:
+			default:
+			}
+		}
+	}()
+	return nil
+}
+
+// close 关闭端口, 端口上正在转发的连接不受影响
+func (p *portSet) close(name string) {
+	port := p.ports[name]
+	atomic.StoreInt32(&port.removed, 1)
+	delete(p.ports, name)
+	p.handoff.Remove(name)
+	port.closer.Close()
+	logs.Infof("端口已关闭: %s %s\r\n", name, port.addr)
+}
@@ -10,7 +10,10 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"io"
 	"net"
 	"os"
 	"os/signal"
@@ -21,109 +24,229 @@ import (
 	"github.com/wup364/pakku/utils/logs"
 )
 
+// UPGRADEWAIT 升级时新程序启动后的观察时间, 期间退出视为升级失败
+const UPGRADEWAIT = 2 * time.Second
+
 func main() {
-	// 获取需要加载的配置名字
-	listenaddr := flag.String("listen", "0.0.0.0:8080", "User access listening address")
-	trunneladdr := flag.String("tunnel", "0.0.0.0:8101", "Tunnel working listening address")
-	limitSpeed := flag.Int("speed", 0, "Network speed limit, default '0' without limit")
-	isdebug := flag.Bool("debug", false, "Show debugger console logs")
-	flag.Parse()
+	// 子命令: 证书签发
+	if len(os.Args) > 1 && os.Args[1] == "cert" {
+		if err := runCertCommand(os.Args[2:]); nil != err {
+			logs.Errorln("cert", err)
+			os.Exit(1)
+		}
+		return
+	}
+	// 子命令: 生成凭据文件中的一行
+	if len(os.Args) > 1 && os.Args[1] == "credential" {
+		if err := runCredentialCommand(os.Args[2:]); nil != err {
+			logs.Errorln("credential", err)
+			os.Exit(1)
+		}
+		return
+	}
 
-	if *isdebug {
-		logs.SetLoggerLevel(logs.DEBUG)
-	} else {
-		logs.SetLoggerLevel(logs.INFO)
+	// 获取需要加载的配置名字, 命令行中设置的参数覆盖配置文件
+	configfile := flag.String("config", "", "JSON configuration file, flags set on the command line override it")
+	flag.String("listen", "0.0.0.0:8080", "User access listening address, use 'name=addr,name2=addr2' for multiple services, '' listens only client requested ports")
+	flag.String("tunnel", "0.0.0.0:8101", "Tunnel working listening address")
+	flag.Int("speed", 0, "Network speed limit, default '0' without limit")
+	flag.Bool("debug", false, "Show debugger console logs")
+	flag.String("token", "", "Pre-shared tokens for tunnel client authentication, separated by ',', default '' without authentication")
+	flag.String("authfile", "", "Credential file for tunnel client authentication, each line is generated by 'tunnel-server credential'")
+	flag.String("tlscert", "", "TLS certificate file of the tunnel listener, default '' without TLS")
+	flag.String("tlskey", "", "TLS private key file of the tunnel listener")
+	flag.String("http", "", "HTTP listening address shared by services, requests are routed by the Host header, default '' disabled")
+	flag.String("sni", "", "TLS listening address shared by services, connections are routed by SNI without decryption, default '' disabled")
+	flag.Int("udpidle", 60, "Idle timeout of UDP sessions in seconds")
+	flag.String("remoteports", "", "Port range clients may request to listen on, as '[host:]min-max', default '' not allowed")
+	flag.String("tlsclientca", "", "CA file to verify tunnel client certificates, default '' without client certificate")
+	flag.String("proxyfrom", "", "Trusted proxy CIDRs separated by ',', user connections from them must start with a PROXY protocol header, default '' disabled")
+	flag.Int("waittimeout", 60, "Seconds a user connection waits for an idle tunnel connection")
+	flag.Int("waitqueue", 1024, "Maximum user connections waiting for tunnel connections per service, '0' without limit")
+	flag.Int("draintimeout", 600, "Seconds to wait for active user connections to finish when draining by SIGUSR1 or upgrading by SIGUSR2")
+	flag.Int("shutdowntimeout", 30, "Seconds to wait for active user connections to finish when exiting")
+	flag.Parse()
+	cfg, err := loadServerConfig(*configfile, flag.CommandLine)
+	if nil != err {
+		logs.Errorln("TunnelService.Config", err)
+		os.Exit(1)
 	}
+	configureLog(cfg, nil)
+	isdebug := cfg.logLevel == logs.DEBUG
 
 	// 服务地址
-	logs.Infof("本地监听地址: %s\r\n", *listenaddr)
-	logs.Infof("隧道监听地址: %s\r\n", *trunneladdr)
-	logs.Infof("速率限制: %dKB/S\r\n:", *limitSpeed)
+	for i := 0; i < len(cfg.listens); i++ {
+		logs.Infof("本地监听地址: %s -> %s\r\n", cfg.listens[i].Name, cfg.listens[i].Addr)
+	}
+	logs.Infof("隧道监听地址: %s\r\n", cfg.Tunnel.Listen)
+	logs.Infof("速率限制: %dKB/S\r\n:", cfg.Limits.Speed)
+	if cfg.ports.Max > 0 {
+		logs.Infof("客户端可请求的端口范围: %d-%d\r\n", cfg.ports.Min, cfg.ports.Max)
+	}
+	if len(cfg.proxies) > 0 {
+		logs.Infof("可信代理网段: %v\r\n", cfg.ProxyFrom)
+	}
+	if nil == cfg.authenticator {
+		logs.Infoln("未设置认证token, 任何客户端都可以连接隧道")
+	}
+	if nil != cfg.tlsConfig {
+		logs.Infof("隧道启用TLS, 校验客户端证书: %t\r\n", len(cfg.Tunnel.TLSClientCA) > 0)
+	}
 
-	// 隧道服务启动
-	service := make(chan *tunnelcomm.TCPTunnelService, 1)
+	// 隧道服务启动, 升级时从父进程继承监听
+	handoff, err := tunnelcomm.NewHandoff()
+	if nil != err {
+		logs.Errorln("TunnelService.Handoff", err)
+		os.Exit(1)
+	}
+	var addr *net.TCPAddr
 	for {
-		if addr, err := net.ResolveTCPAddr("tcp", *trunneladdr); nil == err {
-			go func() {
-				logs.Infoln("TunnelService.Start")
-				TCPTunnelService := tunnelcomm.NewTCPTunnelService(addr, *isdebug)
-				service <- TCPTunnelService
-				if err := TCPTunnelService.Start(); nil != err {
-					logs.Errorln("TunnelService.Start", err)
-					os.Exit(0)
-				}
-			}()
+		if addr, err = net.ResolveTCPAddr("tcp", cfg.Tunnel.Listen); nil == err {
 			break
-		} else {
-			logs.Errorln("TunnelService.Start", err)
-			time.Sleep(time.Second * 10)
 		}
+		logs.Errorln("TunnelService.Start", err)
+		time.Sleep(time.Second * 10)
 	}
+	TCPTunnel := tunnelcomm.NewTCPTunnelService(addr, isdebug)
+	configureService(TCPTunnel, cfg)
 
-	// 启动用户侧服务
-	for {
-		if addr, err := net.ResolveTCPAddr("tcp", *listenaddr); nil == err {
-			go func() {
-				logs.Infoln("UserService.Start")
-				if err = startUserService(addr, <-service, *isdebug, *limitSpeed); nil != err {
-					logs.Errorln("UserService.Start", err)
-					os.Exit(0)
-				}
-			}()
-			break
-		} else {
-			logs.Errorln("UserService.Start", err)
-			time.Sleep(time.Second * 10)
-		}
+	// 打开全部端口, 任一端口失败时退出
+	if len(cfg.HTTP) > 0 {
+		logs.Infof("HTTP监听地址: %s\r\n", cfg.HTTP)
 	}
+	if len(cfg.SNI) > 0 {
+		logs.Infof("TLS SNI监听地址: %s\r\n", cfg.SNI)
+	}
+	ports := newPortSet(handoff, TCPTunnel)
+	if err = ports.apply(portAddrs(cfg)); nil != err {
+		os.Exit(1)
+	}
+	handoff.CloseInherited()
 
-	// 监听退出
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
-	logs.Infoln("os singal: ", <-sigs)
-}
+	// 收到退出信号或任一端口服务失败时关闭服务
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	defer stop()
+	// 重新加载信号: 重新读取配置文件并应用变化
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+
+	// 排空信号: 不再接受新的用户连接, 等待正在转发的连接结束后退出
+	drain := make(chan os.Signal, 1)
+	if len(drainSignals) > 0 {
+		signal.Notify(drain, drainSignals...)
+	}
+	// 升级信号: 启动新程序并交出监听, 等待正在转发的连接结束后退出
+	upgrade := make(chan os.Signal, 1)
+	if len(upgradeSignals) > 0 {
+		signal.Notify(upgrade, upgradeSignals...)
+	}
 
-// startUserService 启动用户侧服务
-func startUserService(addr *net.TCPAddr, TCPTunnel *tunnelcomm.TCPTunnelService, debug bool, limitSpeed int) (err error) {
-	if listener, err := net.ListenTCP("tcp", addr); nil == err {
-		for {
-			var err error
-			var conn4src net.Conn
-			// 监听请求
-			if conn4src, err = listener.Accept(); nil != err {
-				logs.Errorln(err)
+	// 监听退出, 等待正在转发的用户连接结束
+	for running := true; running; {
+		select {
+		case <-ctx.Done():
+			logs.Infoln("TunnelService.Shutdown")
+			running = false
+		case <-drain:
+			logs.Infoln("TunnelService.Drain")
+			dctx, dcancel := context.WithTimeout(ctx, time.Duration(cfg.DrainTimeout)*time.Second)
+			if err := TCPTunnel.Drain(dctx); nil != err {
+				logs.Errorln("TunnelService.Drain", err)
+			}
+			dcancel()
+			running = false
+		case <-upgrade:
+			logs.Infoln("TunnelService.Upgrade")
+			if err := startChild(handoff); nil != err {
+				logs.Errorln("TunnelService.Upgrade", err)
 				continue
 			}
-			go func() {
-				defer conn4src.Close()
-				for count := 0; count < 600; count++ {
-					// 获取管道连接
-					if conn4dst := TCPTunnel.GetConn(); nil != conn4dst {
-						defer conn4dst.Close()
-						// 交换数据
-						exchange := func(w net.Conn, r net.Conn) chan struct{} {
-							lock := make(chan struct{})
-							go func() {
-								if _, err := tunnelcomm.ExchangeBuffer(w, r, 2048, limitSpeed); nil != err {
-									logs.Errorln(err)
-								}
-								close(lock)
-							}()
-							return lock
-						}
-						logs.Debugf("Exchange-Start %s\r\n", conn4dst.RemoteAddr().String())
-						select {
-						case <-exchange(conn4dst, conn4src):
-						case <-exchange(conn4src, conn4dst):
-						}
-
-						logs.Debugf("Exchange-End %s\r\n", conn4dst.RemoteAddr().String())
-						break
-					}
-					time.Sleep(time.Millisecond * 100)
-				}
-			}()
+			dctx, dcancel := context.WithTimeout(ctx, time.Duration(cfg.DrainTimeout)*time.Second)
+			if err := TCPTunnel.Detach(dctx); nil != err {
+				logs.Errorln("TunnelService.Detach", err)
+			}
+			dcancel()
+			running = false
+		case <-reload:
+			cfg = reloadConfig(*configfile, cfg, TCPTunnel, ports)
+		case err = <-ports.failed:
+			running = false
 		}
 	}
-	return err
+	sctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeout)*time.Second)
+	defer cancel()
+	if err := TCPTunnel.Shutdown(sctx); nil != err {
+		logs.Errorln("TunnelService.Shutdown", err)
+	}
+	if nil != err {
+		os.Exit(1)
+	}
+}
+
+// startChild 启动新程序并交出监听, 新程序启动后立即退出时视为升级失败
+func startChild(handoff *tunnelcomm.Handoff) error {
+	proc, err := handoff.StartChild()
+	if nil != err {
+		return err
+	}
+	exited := make(chan error, 1)
+	go func() {
+		state, err := proc.Wait()
+		if nil == err {
+			err = errors.New(state.String())
+		}
+		exited <- err
+	}()
+	select {
+	case err = <-exited:
+		return errors.New("new process exited: " + err.Error())
+	case <-time.After(UPGRADEWAIT):
+		logs.Infof("新程序已启动, pid=%d\r\n", proc.Pid)
+		return nil
+	}
+}
+
+// configureService 将配置应用到隧道服务, 启动和重新加载配置时调用
+func configureService(TCPTunnel *tunnelcomm.TCPTunnelService, cfg *serverConfig) {
+	TCPTunnel.SetAuthenticator(cfg.authenticator)
+	TCPTunnel.SetTLSConfig(cfg.tlsConfig)
+	TCPTunnel.SetRemotePorts(cfg.ports)
+	TCPTunnel.SetTrustedProxies(cfg.proxies)
+	TCPTunnel.SetLimitSpeed(cfg.Limits.Speed)
+	TCPTunnel.SetUDPIdleTimeout(time.Duration(cfg.Limits.UDPIdle) * time.Second)
+	TCPTunnel.SetConnWait(time.Duration(cfg.Limits.WaitTimeout)*time.Second, cfg.Limits.WaitQueue)
+}
+
+// configureLog 设置日志级别和输出, 关闭上一次配置打开的日志文件
+func configureLog(cfg, prev *serverConfig) {
+	logs.SetLoggerLevel(cfg.logLevel)
+	if nil != cfg.logOutput {
+		logs.SetOutput(cfg.logOutput)
+	} else if nil != prev && nil != prev.logOutput {
+		logs.SetOutput(os.Stdout)
+	}
+	if nil != prev && nil != prev.logOutput {
+		prev.logOutput.(io.Closer).Close()
+	}
+}
+
+// reloadConfig 重新加载配置文件, 应用端口、认证、限速、TLS证书和日志的变化, 配置有误时继续使用原配置
+// 隧道端口地址变化、启用或关闭TLS需要重启, 其他端口上正在转发的连接不受影响
+func reloadConfig(path string, cfg *serverConfig, TCPTunnel *tunnelcomm.TCPTunnelService, ports *portSet) *serverConfig {
+	logs.Infoln("TunnelService.Reload")
+	next, err := loadServerConfig(path, flag.CommandLine)
+	if nil != err {
+		logs.Errorln("TunnelService.Reload", err)
+		return cfg
+	}
+	if (nil == next.tlsConfig) != (nil == cfg.tlsConfig) {
+		logs.Errorln("TunnelService.Reload", "enabling or disabling tls requires a restart")
+		next.tlsConfig = cfg.tlsConfig
+	}
+	configureLog(next, cfg)
+	configureService(TCPTunnel, next)
+	if err = ports.apply(portAddrs(next)); nil != err {
+		logs.Errorln("TunnelService.Reload", err)
+	}
+	return next
 }
@@ -0,0 +1,302 @@
+// Copyright (C) 2022 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package tunnelcomm
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wup364/pakku/utils/logs"
+)
+
+const (
+	// AUTHNONCELEN 认证随机数字节数
+	AUTHNONCELEN = 32
+	// AUTHKDFITERATIONS 由token派生客户端密钥的PBKDF2迭代次数
+	AUTHKDFITERATIONS = 4096
+	// AUTHKEYCACHE 静态token认证器缓存的用户校验值数量上限
+	AUTHKEYCACHE = 1024
+)
+
+// ErrAuthFailed 认证失败
+var ErrAuthFailed = errors.New("authentication failed")
+
+// Credentials 客户端在挑战应答中提交的凭据
+type Credentials struct {
+	User  string // 用户名, 使用静态token时可以为空
+	Nonce string // 服务端下发的随机数
+	Proof string // 客户端使用密钥对随机数的应答
+}
+
+// Identity 认证通过后的客户端身份
+type Identity struct {
+	Name     string // 身份名称, 如用户名或证书主题
+	ClientID string // 客户端实例ID
+	cert     bool   // 是否由客户端证书认证
+	user     string // 认证时提交的用户名
+	verifier []byte // 认证时匹配的校验值, 替换认证器后用于重新校验
+}
+
+// Authenticator 客户端认证器, 在建立控制连接和数据连接时调用
+type Authenticator interface {
+	// Authenticate 校验凭据, 成功时返回客户端身份
+	Authenticate(clientID string, cred Credentials, remote net.Addr) (Identity, error)
+}
+
+// Revalidator 可以重新校验已认证身份的认证器, 替换认证器后断开凭据已失效的客户端
+type Revalidator interface {
+	// Revalidate 身份认证时使用的凭据是否仍然有效
+	Revalidate(identity Identity) bool
+}
+
+// NewTokenAuthenticator 实例化静态token列表认证器, 持有任意一个token即可通过
+func NewTokenAuthenticator(tokens ...string) *TokenAuthenticator {
+	a := &TokenAuthenticator{users: make(map[string][][]byte)}
+	for i := 0; i < len(tokens); i++ {
+		if len(tokens[i]) > 0 {
+			a.tokens = append(a.tokens, tokens[i])
+			a.keys = append(a.keys, StoredKey(ClientKey(tokens[i], "")))
+		}
+	}
+	return a
+}
+
+// TokenAuthenticator 静态token列表认证器
+type TokenAuthenticator struct {
+	tokens []string
+	keys   [][]byte            // 用户名为空时的校验值
+	users  map[string][][]byte // 用户名 -> 各token派生的校验值, 每个用户只派生一次
+	lock   sync.Mutex
+}
+
+// userKeys 获取用户名对应的各token的校验值, 派生结果缓存, 超过AUTHKEYCACHE时淘汰任意一个用户
+func (a *TokenAuthenticator) userKeys(user string) [][]byte {
+	if len(user) == 0 {
+		return a.keys
+	}
+	a.lock.Lock()
+	keys, ok := a.users[user]
+	a.lock.Unlock()
+	if ok {
+		return keys
+	}
+	keys = make([][]byte, len(a.tokens))
+	for i := 0; i < len(a.tokens); i++ {
+		keys[i] = StoredKey(ClientKey(a.tokens[i], user))
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for name := range a.users {
+		if len(a.users) < AUTHKEYCACHE {
+			break
+		}
+		delete(a.users, name)
+	}
+	a.users[user] = keys
+	return keys
+}
+
+// Authenticate 校验凭据, 身份名称为客户端提交的用户名, 为空时使用客户端ID
+func (a *TokenAuthenticator) Authenticate(clientID string, cred Credentials, remote net.Addr) (Identity, error) {
+	keys := a.userKeys(cred.User)
+	for i := 0; i < len(keys); i++ {
+		if key := keys[i]; VerifyChallenge(key, cred.Nonce, clientID, cred.Proof) {
+			name := cred.User
+			if len(name) == 0 {
+				name = clientID
+			}
+			return Identity{Name: name, ClientID: clientID, user: cred.User, verifier: key}, nil
+		}
+	}
+	return Identity{}, ErrAuthFailed
+}
+
+// Revalidate 身份认证时使用的token是否仍在列表中
+func (a *TokenAuthenticator) Revalidate(identity Identity) bool {
+	if len(identity.verifier) == 0 {
+		return false
+	}
+	keys := a.userKeys(identity.user)
+	for i := 0; i < len(keys); i++ {
+		if hmac.Equal(keys[i], identity.verifier) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewCredentialFileAuthenticator 实例化凭据文件认证器
+// 文件每行一个用户: `用户名:校验值(hex)`, 校验值由CredentialLine生成, `#`开头为注释; 文件变化后自动重新读取
+func NewCredentialFileAuthenticator(path string) (a *CredentialFileAuthenticator, err error) {
+	a = &CredentialFileAuthenticator{path: path}
+	if err = a.reload(); nil != err {
+		return nil, err
+	}
+	return a, err
+}
+
+// CredentialFileAuthenticator 凭据文件认证器
+type CredentialFileAuthenticator struct {
+	path    string
+	modTime time.Time
+	size    int64
+	users   map[string][]byte
+	lock    sync.RWMutex
+}
+
+// Authenticate 校验凭据, 身份名称为用户名
+func (a *CredentialFileAuthenticator) Authenticate(clientID string, cred Credentials, remote net.Addr) (Identity, error) {
+	// 文件格式有误时继续使用上一次的凭据, 下次认证时重新读取
+	if err := a.reload(); nil != err {
+		logs.Errorln("reload credential file error:", err)
+	}
+	a.lock.RLock()
+	key, ok := a.users[cred.User]
+	a.lock.RUnlock()
+	if !ok || !VerifyChallenge(key, cred.Nonce, clientID, cred.Proof) {
+		return Identity{}, ErrAuthFailed
+	}
+	return Identity{Name: cred.User, ClientID: clientID, user: cred.User, verifier: key}, nil
+}
+
+// Revalidate 身份认证时使用的校验值是否仍在凭据文件中
+func (a *CredentialFileAuthenticator) Revalidate(identity Identity) bool {
+	if err := a.reload(); nil != err {
+		logs.Errorln("reload credential file error:", err)
+	}
+	a.lock.RLock()
+	key, ok := a.users[identity.user]
+	a.lock.RUnlock()
+	return ok && len(identity.verifier) > 0 && hmac.Equal(key, identity.verifier)
+}
+
+// reload 文件的修改时间或大小变化时重新读取, 读取成功后才记录文件状态
+func (a *CredentialFileAuthenticator) reload() (err error) {
+	var info os.FileInfo
+	if info, err = os.Stat(a.path); nil != err {
+		return err
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if nil != a.users && info.ModTime().Equal(a.modTime) && info.Size() == a.size {
+		return nil
+	}
+	var fs *os.File
+	if fs, err = os.Open(a.path); nil != err {
+		return err
+	}
+	defer fs.Close()
+	users := make(map[string][]byte)
+	scanner := bufio.NewScanner(fs)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if len(text) == 0 || strings.HasPrefix(text, "#") {
+			continue
+		}
+		var key []byte
+		kv := strings.SplitN(text, ":", 2)
+		if len(kv) == 2 {
+			key, err = hex.DecodeString(strings.TrimSpace(kv[1]))
+		}
+		if len(kv) != 2 || nil != err || len(key) != sha256.Size {
+			return fmt.Errorf("%s:%d: invalid credential, expected 'user:verifier'", a.path, line)
+		}
+		users[strings.TrimSpace(kv[0])] = key
+	}
+	if err = scanner.Err(); nil == err {
+		a.users = users
+		a.modTime, a.size = info.ModTime(), info.Size()
+	}
+	return err
+}
+
+// ClientKey 由token和用户名派生客户端的签名密钥: PBKDF2-HMAC-SHA256(token, "tcptunnel:"+user)
+func ClientKey(token, user string) []byte {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write([]byte("tcptunnel:" + user))
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	key := append([]byte(nil), u...)
+	for i := 1; i < AUTHKDFITERATIONS; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := 0; j < len(key); j++ {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
+
+// StoredKey 服务端保存的校验值: SHA256(客户端密钥), 只能校验应答, 不能用于签名
+func StoredKey(clientKey []byte) []byte {
+	sum := sha256.Sum256(clientKey)
+	return sum[:]
+}
+
+// CredentialLine 生成凭据文件中的一行: `用户名:校验值(hex)`
+func CredentialLine(user, token string) string {
+	return user + ":" + hex.EncodeToString(StoredKey(ClientKey(token, user)))
+}
+
+// challengeSignature 计算挑战签名: HMAC-SHA256(校验值, 带长度前缀的nonce和clientID)
+func challengeSignature(storedKey []byte, nonce, clientID string) []byte {
+	mac := hmac.New(sha256.New, storedKey)
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(nonce)))
+	mac.Write(size[:])
+	mac.Write([]byte(nonce))
+	binary.BigEndian.PutUint32(size[:], uint32(len(clientID)))
+	mac.Write(size[:])
+	mac.Write([]byte(clientID))
+	return mac.Sum(nil)
+}
+
+// SignChallenge 使用客户端密钥应答服务端随机数: 客户端密钥 XOR 挑战签名
+func SignChallenge(clientKey []byte, nonce, clientID string) string {
+	proof := challengeSignature(StoredKey(clientKey), nonce, clientID)
+	for i := 0; i < len(proof) && i < len(clientKey); i++ {
+		proof[i] ^= clientKey[i]
+	}
+	return hex.EncodeToString(proof)
+}
+
+// VerifyChallenge 使用校验值检查客户端的应答: 还原出的客户端密钥的摘要必须等于校验值
+func VerifyChallenge(storedKey []byte, nonce, clientID, proof string) bool {
+	clientKey, err := hex.DecodeString(proof)
+	if nil != err || len(clientKey) != sha256.Size {
+		return false
+	}
+	signature := challengeSignature(storedKey, nonce, clientID)
+	for i := 0; i < len(clientKey); i++ {
+		clientKey[i] ^= signature[i]
+	}
+	return hmac.Equal(StoredKey(clientKey), storedKey)
+}
+
+// newNonce 生成认证用的随机数
+func newNonce() (string, error) {
+	buf := make([]byte, AUTHNONCELEN)
+	if _, err := rand.Read(buf); nil != err {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
@@ -0,0 +1,114 @@
+// Copyright (C) 2022 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package tunnelcomm
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChallenge(t *testing.T) {
+	key := ClientKey("secret", "")
+	nonce, err := newNonce()
+	if nil != err {
+		t.Fatal(err)
+	}
+	stored := StoredKey(key)
+	proof := SignChallenge(key, nonce, "client-1")
+	if !VerifyChallenge(stored, nonce, "client-1", proof) {
+		t.Fatal("valid proof rejected")
+	}
+	if VerifyChallenge(stored, nonce, "client-2", proof) {
+		t.Fatal("proof bound to another client accepted")
+	}
+	if VerifyChallenge(stored, nonce[:2], nonce[2:]+"client-1", proof) {
+		t.Fatal("proof with shifted nonce and client id accepted")
+	}
+	if VerifyChallenge(StoredKey(ClientKey("other", "")), nonce, "client-1", proof) {
+		t.Fatal("proof signed with another token accepted")
+	}
+	// 校验值不能代替客户端密钥签名
+	if VerifyChallenge(stored, nonce, "client-1", SignChallenge(stored, nonce, "client-1")) {
+		t.Fatal("proof signed with the stored key accepted")
+	}
+	if VerifyChallenge(stored, nonce, "client-1", "not-hex") {
+		t.Fatal("invalid proof accepted")
+	}
+}
+
+func TestTokenAuthenticator(t *testing.T) {
+	auth := NewTokenAuthenticator("a", "b")
+	cred := Credentials{Nonce: "nonce", Proof: SignChallenge(ClientKey("b", ""), "nonce", "client-1")}
+	if id, err := auth.Authenticate("client-1", cred, nil); nil != err || id.Name != "client-1" {
+		t.Fatal(id, err)
+	}
+	cred = Credentials{User: "u", Nonce: "nonce", Proof: SignChallenge(ClientKey("a", "u"), "nonce", "client-1")}
+	if id, err := auth.Authenticate("client-1", cred, nil); nil != err || id.Name != "u" {
+		t.Fatal(id, err)
+	}
+	cred.Proof = SignChallenge(ClientKey("c", "u"), "nonce", "client-1")
+	if _, err := auth.Authenticate("client-1", cred, nil); err != ErrAuthFailed {
+		t.Fatal(err)
+	}
+	// 用户的校验值只派生一次, 缓存数量有上限
+	if keys := auth.userKeys("u"); len(auth.users) != 1 || &keys[0][0] != &auth.users["u"][0][0] {
+		t.Fatal("user keys are not cached")
+	}
+	for i := 0; len(auth.users) < AUTHKEYCACHE; i++ {
+		auth.users["user"+strconv.Itoa(i)] = nil
+	}
+	auth.userKeys("v")
+	if _, ok := auth.users["v"]; !ok || len(auth.users) != AUTHKEYCACHE {
+		t.Fatal("user keys cache size:", len(auth.users))
+	}
+}
+
+func TestCredentialFileAuthenticator(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "credentials")
+	write := func(text string, mod time.Time) {
+		if err := os.WriteFile(path, []byte(text), 0600); nil != err {
+			t.Fatal(err)
+		}
+		os.Chtimes(path, mod, mod)
+	}
+	write("# comment\n"+CredentialLine("user1", "secret1")+"\n", time.Now().Add(-time.Minute))
+	auth, err := NewCredentialFileAuthenticator(path)
+	if nil != err {
+		t.Fatal(err)
+	}
+	cred := Credentials{User: "user1", Nonce: "nonce", Proof: SignChallenge(ClientKey("secret1", "user1"), "nonce", "c")}
+	if id, err := auth.Authenticate("c", cred, nil); nil != err || id.Name != "user1" {
+		t.Fatal(id, err)
+	}
+	// 文件变化后重新读取
+	write(CredentialLine("user2", "secret2")+"\n", time.Now())
+	if _, err := auth.Authenticate("c", cred, nil); err != ErrAuthFailed {
+		t.Fatal(err)
+	}
+	cred = Credentials{User: "user2", Nonce: "nonce", Proof: SignChallenge(ClientKey("secret2", "user2"), "nonce", "c")}
+	if id, err := auth.Authenticate("c", cred, nil); nil != err || id.Name != "user2" {
+		t.Fatal(id, err)
+	}
+	// 格式错误时保留上一次的凭据, 之后的认证继续重新读取, 即使修正后的文件大小和修改时间不变
+	line := CredentialLine("user1", "secret1") + "\n"
+	mod := time.Now().Add(time.Minute)
+	write(strings.Repeat("x", len(line)), mod)
+	if _, err := auth.Authenticate("c", cred, nil); nil != err {
+		t.Fatal(err)
+	}
+	write(line, mod)
+	if _, err := auth.Authenticate("c", cred, nil); err != ErrAuthFailed {
+		t.Fatal(err)
+	}
+}
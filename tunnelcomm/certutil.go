@@ -0,0 +1,130 @@
+// Copyright (C) 2022 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package tunnelcomm
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"time"
+)
+
+// GenerateCA 生成自签名CA证书和私钥, 返回PEM格式
+func GenerateCA(commonName string, validFor time.Duration) (certPEM, keyPEM []byte, err error) {
+	var key *ecdsa.PrivateKey
+	if key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); nil != err {
+		return nil, nil, err
+	}
+	var tpl *x509.Certificate
+	if tpl, err = newCertTemplate(commonName, validFor); nil != err {
+		return nil, nil, err
+	}
+	tpl.IsCA = true
+	tpl.BasicConstraintsValid = true
+	tpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature
+	return encodeCert(tpl, tpl, key, key)
+}
+
+// IssueCertificate 使用CA签发证书, hosts为证书的SAN(域名或IP), client为true时签发客户端证书
+func IssueCertificate(caCertPEM, caKeyPEM []byte, commonName string, hosts []string, client bool, validFor time.Duration) (certPEM, keyPEM []byte, err error) {
+	var ca *x509.Certificate
+	var caKey crypto.Signer
+	if ca, caKey, err = parseCA(caCertPEM, caKeyPEM); nil != err {
+		return nil, nil, err
+	}
+	var key *ecdsa.PrivateKey
+	if key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); nil != err {
+		return nil, nil, err
+	}
+	var tpl *x509.Certificate
+	if tpl, err = newCertTemplate(commonName, validFor); nil != err {
+		return nil, nil, err
+	}
+	tpl.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+	if client {
+		tpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	} else {
+		tpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	}
+	for i := 0; i < len(hosts); i++ {
+		if ip := net.ParseIP(hosts[i]); nil != ip {
+			tpl.IPAddresses = append(tpl.IPAddresses, ip)
+		} else if len(hosts[i]) > 0 {
+			tpl.DNSNames = append(tpl.DNSNames, hosts[i])
+		}
+	}
+	if tpl.NotAfter.After(ca.NotAfter) {
+		tpl.NotAfter = ca.NotAfter
+	}
+	return encodeCert(tpl, ca, key, caKey)
+}
+
+// newCertTemplate 证书模板, 序列号随机生成
+func newCertTemplate(commonName string, validFor time.Duration) (*x509.Certificate, error) {
+	if validFor <= 0 {
+		return nil, errors.New("certificate validity must be positive")
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if nil != err {
+		return nil, err
+	}
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(validFor),
+	}, nil
+}
+
+// encodeCert 签名证书并编码为PEM
+func encodeCert(tpl, parent *x509.Certificate, key *ecdsa.PrivateKey, signer crypto.Signer) (certPEM, keyPEM []byte, err error) {
+	var der, keyDer []byte
+	if der, err = x509.CreateCertificate(rand.Reader, tpl, parent, key.Public(), signer); nil != err {
+		return nil, nil, err
+	}
+	if keyDer, err = x509.MarshalPKCS8PrivateKey(key); nil != err {
+		return nil, nil, err
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer})
+	return certPEM, keyPEM, nil
+}
+
+// parseCA 解析PEM格式的CA证书和私钥
+func parseCA(caCertPEM, caKeyPEM []byte) (ca *x509.Certificate, key crypto.Signer, err error) {
+	certBlock, _ := pem.Decode(caCertPEM)
+	keyBlock, _ := pem.Decode(caKeyPEM)
+	if nil == certBlock || nil == keyBlock {
+		return nil, nil, errors.New("invalid CA certificate or key PEM")
+	}
+	if ca, err = x509.ParseCertificate(certBlock.Bytes); nil != err {
+		return nil, nil, err
+	}
+	if !ca.IsCA {
+		return nil, nil, errors.New("the certificate is not a CA: " + ca.Subject.String())
+	}
+	var parsed interface{}
+	if parsed, err = x509.ParsePKCS8PrivateKey(keyBlock.Bytes); nil != err {
+		return nil, nil, err
+	}
+	var ok bool
+	if key, ok = parsed.(crypto.Signer); !ok {
+		return nil, nil, errors.New("unsupported CA private key")
+	}
+	return ca, key, nil
+}
@@ -0,0 +1,86 @@
+// Copyright (C) 2022 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package tunnelcomm
+
+import (
+	"crypto/tls"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIssueCertificateMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0600); nil != err {
+			t.Fatal(err)
+		}
+		return path
+	}
+	caPEM, caKeyPEM, err := GenerateCA("test-ca", time.Hour)
+	if nil != err {
+		t.Fatal(err)
+	}
+	srvPEM, srvKeyPEM, err := IssueCertificate(caPEM, caKeyPEM, "server", []string{"127.0.0.1"}, false, time.Hour)
+	if nil != err {
+		t.Fatal(err)
+	}
+	cliPEM, cliKeyPEM, err := IssueCertificate(caPEM, caKeyPEM, "branch-a", nil, true, time.Hour)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if _, _, err = IssueCertificate(srvPEM, srvKeyPEM, "x", nil, true, time.Hour); nil == err {
+		t.Fatal("a leaf certificate must not issue certificates")
+	}
+
+	caFile := write("ca.pem", caPEM)
+	srvCfg, err := NewServerTLSConfig(write("server.pem", srvPEM), write("server-key.pem", srvKeyPEM), caFile)
+	if nil != err {
+		t.Fatal(err)
+	}
+	cliCfg, err := NewClientTLSConfig(caFile, write("client.pem", cliPEM), write("client-key.pem", cliKeyPEM))
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", srvCfg)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	identity := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if nil != err {
+			identity <- err.Error()
+			return
+		}
+		defer conn.Close()
+		if err = handshakeTLS(conn); nil != err {
+			identity <- err.Error()
+			return
+		}
+		identity <- peerCertIdentity(conn)
+	}()
+	conn, err := tls.Dial("tcp", listener.Addr().String(), cliCfg)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if name := <-identity; name != "branch-a" {
+		t.Fatal(name)
+	}
+	if name := peerCertIdentity(&net.TCPConn{}); name != "" {
+		t.Fatal(name)
+	}
+}
@@ -0,0 +1,246 @@
+// Copyright (C) 2022 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package tunnelcomm
+
+import (
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/wup364/pakku/utils/utypes"
+)
+
+// newClientSession 创建已通过握手的客户端会话
+func newClientSession(conn net.Conn, req HelloRequest, res HelloResponse, identity Identity) *clientSession {
+	client := &clientSession{
+		id:        req.ClientID,
+		conn:      conn,
+		identity:  identity,
+		version:   res.Version,
+		caps:      res.Capabilities,
+		services:  req.Services,
+		ports:     req.Ports,
+		hosts:     req.Hosts,
+		pools:     utypes.NewSafeMap(),
+		sessions:  utypes.NewSafeMap(),
+		listeners: make(map[string]net.Listener),
+		closed:    make(chan struct{}),
+	}
+	if len(client.services) == 0 {
+		client.services = []string{DEFAULTSERVICE}
+	}
+	return client
+}
+
+// errClientClosed 客户端会话已关闭
+var errClientClosed = errors.New("client session closed")
+
+// clientSession 服务端上一个已连接的客户端, 拥有自己的控制连接、空闲连接池和多路复用会话
+type clientSession struct {
+	id        string                  // 客户端ID
+	conn      net.Conn                // 控制连接
+	identity  Identity                // 认证后的身份
+	version   int                     // 握手协商的协议版本
+	caps      []string                // 握手协商的能力列表
+	services  []string                // 客户端提供的服务名, 受lock保护, 更新时整体替换
+	ports     map[string]int          // 握手时请求的远程端口
+	hosts     map[string]string       // 按域名路由的服务, 域名->服务名, 受lock保护, 更新时整体替换
+	listeners map[string]net.Listener // 为客户端打开的远程端口监听, 服务名->监听, 受lock保护
+	pools     *utypes.SafeMap         // 各服务的空闲连接池, 服务名->*utypes.SafeMap
+	sessions  *utypes.SafeMap         // 多路复用会话
+	accepted  bool                    // 是否已应答握手, 之后才能推送命令
+	wlock     sync.Mutex              // 控制连接写锁
+	lock      sync.Mutex              // 保护服务、域名、监听列表、连接池的创建和关闭状态
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// writeCMD 在控制连接上发送命令, 控制连接上的应答和推送可能来自不同的协程
+func (c *clientSession) writeCMD(cmd byte, args ...string) error {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	return CTRLCMD.WriteCMD(c.conn, cmd, args...)
+}
+
+// accept 应答握手, 之后可以推送命令
+func (c *clientSession) accept(res HelloResponse) (err error) {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	if err = CTRLCMD.WriteCMD(c.conn, CTRLCMD.OK, encodeJSONArg(res)); nil == err {
+		c.accepted = true
+	}
+	return err
+}
+
+// push 向客户端推送命令, 客户端未协商该能力或未完成握手时忽略
+func (c *clientSession) push(capability string, cmd byte, args ...string) error {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	if !c.accepted || !hasCapability(c.caps, capability) {
+		return nil
+	}
+	return CTRLCMD.WriteCMD(c.conn, cmd, args...)
+}
+
+// getPool 获取服务的空闲连接池, 不存在时创建
+func (c *clientSession) getPool(service string) *utypes.SafeMap {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	pool, ok := c.pools.Get(service)
+	if !ok {
+		pool = utypes.NewSafeMap()
+		c.pools.Put(service, pool)
+	}
+	return pool.(*utypes.SafeMap)
+}
+
+// putConn 将空闲连接放入服务的连接池, 会话已关闭或服务已删除时返回错误, 由调用方关闭连接
+func (c *clientSession) putConn(service string, conn net.Conn) error {
+	pool := c.getPool(service)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.isClosed() {
+		return errClientClosed
+	}
+	// 服务已被删除时不再接受其连接
+	if !containsService(c.services, service) {
+		return errors.New("unknown service " + service)
+	}
+	return pool.PutX(conn.RemoteAddr().String(), conn)
+}
+
+// addListener 记录为客户端的服务打开的监听, 替换服务原有的监听, 会话已关闭时关闭监听并返回错误
+func (c *clientSession) addListener(service string, listener net.Listener) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.isClosed() {
+		listener.Close()
+		return errClientClosed
+	}
+	if old, ok := c.listeners[service]; ok {
+		old.Close()
+	}
+	c.listeners[service] = listener
+	return nil
+}
+
+// closeListener 关闭服务的远程端口监听, 正在转发的连接不受影响
+func (c *clientSession) closeListener(service string) {
+	c.lock.Lock()
+	listener, ok := c.listeners[service]
+	delete(c.listeners, service)
+	c.lock.Unlock()
+	if ok {
+		listener.Close()
+	}
+}
+
+// listenPorts 为客户端监听的远程端口, 服务名->端口
+func (c *clientSession) listenPorts() map[string]int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	ports := make(map[string]int, len(c.listeners))
+	for name, listener := range c.listeners {
+		ports[name] = listener.Addr().(*net.TCPAddr).Port
+	}
+	return ports
+}
+
+// getServices 客户端提供的服务名, 返回的切片不会被修改
+func (c *clientSession) getServices() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.services
+}
+
+// getHosts 按域名路由的服务, 返回的映射不会被修改
+func (c *clientSession) getHosts() map[string]string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.hosts
+}
+
+// setServices 替换客户端提供的服务和域名路由
+func (c *clientSession) setServices(services []string, hosts map[string]string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.services, c.hosts = services, hosts
+}
+
+// removePool 删除服务的空闲连接池并关闭其中的连接
+func (c *clientSession) removePool(service string) {
+	c.lock.Lock()
+	pool, ok := c.pools.Cut(service)
+	c.lock.Unlock()
+	if ok {
+		conns := pool.(*utypes.SafeMap).Values()
+		for i := 0; i < len(conns); i++ {
+			conns[i].(net.Conn).Close()
+		}
+	}
+}
+
+// countConn 统计服务的空闲连接数, service为空时统计所有服务
+func (c *clientSession) countConn(service string) (count int) {
+	if len(service) > 0 {
+		if pool, ok := c.pools.Get(service); ok {
+			count = pool.(*utypes.SafeMap).Size()
+		}
+		return count
+	}
+	pools := c.pools.Values()
+	for i := 0; i < len(pools); i++ {
+		count += pools[i].(*utypes.SafeMap).Size()
+	}
+	return count
+}
+
+// hasService 客户端是否提供了该服务
+func (c *clientSession) hasService(service string) bool {
+	return containsService(c.getServices(), service)
+}
+
+// isClosed 会话是否已关闭
+func (c *clientSession) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// close 关闭控制连接、远程端口监听、所有空闲连接和多路复用会话, 之后不再接受新的监听和空闲连接
+func (c *clientSession) close() {
+	c.closeOnce.Do(func() {
+		c.lock.Lock()
+		close(c.closed)
+		listeners := c.listeners
+		c.listeners = make(map[string]net.Listener)
+		c.lock.Unlock()
+		c.conn.Close()
+		for _, listener := range listeners {
+			listener.Close()
+		}
+		sessions := c.sessions.Values()
+		c.sessions.Clear()
+		for i := 0; i < len(sessions); i++ {
+			sessions[i].(*MuxSession).Close()
+		}
+		pools := c.pools.Values()
+		c.pools.Clear()
+		for i := 0; i < len(pools); i++ {
+			conns := pools[i].(*utypes.SafeMap).Values()
+			for j := 0; j < len(conns); j++ {
+				conns[j].(net.Conn).Close()
+			}
+		}
+	})
+}
@@ -0,0 +1,40 @@
+// Copyright (C) 2022 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package tunnelcomm
+
+import (
+	"net"
+	"testing"
+)
+
+func TestClientSessionClose(t *testing.T) {
+	ctl, _ := net.Pipe()
+	client := newClientSession(ctl, HelloRequest{ClientID: "c"}, HelloResponse{}, Identity{})
+	data, peer := net.Pipe()
+	defer peer.Close()
+	if err := client.putConn(DEFAULTSERVICE, data); nil != err || client.countConn("") != 1 {
+		t.Fatal(err)
+	}
+	client.close()
+	// 关闭后放回的连接和打开的监听都被拒绝
+	if err := client.putConn(DEFAULTSERVICE, data); err != errClientClosed || client.countConn("") != 0 {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if err = client.addListener(DEFAULTSERVICE, listener); err != errClientClosed {
+		t.Fatal(err)
+	}
+	if _, err = listener.Accept(); nil == err {
+		t.Fatal("listener is not closed")
+	}
+}
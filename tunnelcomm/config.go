@@ -0,0 +1,296 @@
+// Copyright (C) 2022 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package tunnelcomm
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/wup364/pakku/utils/logs"
+)
+
+// ConfigError 配置文件错误, 包含出错配置项所在的行列号
+type ConfigError struct {
+	File   string
+	Line   int    // 从1开始, 为0时配置项不在文件中, 如来自命令行参数
+	Column int    // 从1开始
+	Path   string // 出错的配置项, 如'listeners[1].addr'
+	Err    error
+}
+
+// Error 格式为'文件:行:列: 配置项: 错误'
+func (e *ConfigError) Error() string {
+	msg := e.Err.Error()
+	if len(e.Path) > 0 {
+		msg = e.Path + ": " + msg
+	}
+	if e.Line > 0 {
+		msg = fmt.Sprintf("%s:%d:%d: %s", e.File, e.Line, e.Column, msg)
+	} else if len(e.File) > 0 {
+		msg = e.File + ": " + msg
+	}
+	return msg
+}
+
+// Unwrap 返回原始错误
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// ParseLogLevel 解析日志级别, 可选debug、info、error、none, 为空时为info
+func ParseLogLevel(level string) (logs.LoggerLeve, error) {
+	switch level {
+	case "debug":
+		return logs.DEBUG, nil
+	case "info", "":
+		return logs.INFO, nil
+	case "error":
+		return logs.ERROR, nil
+	case "none":
+		return logs.NONE, nil
+	}
+	return 0, fmt.Errorf("unknown level %q, expected debug, info, error or none", level)
+}
+
+// ConfigFile JSON配置文件, 严格校验配置项并记录其位置, 错误信息可以精确到行
+type ConfigFile struct {
+	name    string
+	data    []byte
+	offsets map[string]int64      // 配置项->在文件中的偏移
+	values  map[int64]configValue // 值的结束偏移->值的位置, 类型错误只有结束偏移
+}
+
+// configValue 值的起始偏移和所属的配置项
+type configValue struct {
+	start int64
+	path  string
+}
+
+// ReadConfigFile 读取配置文件
+func ReadConfigFile(name string) (*ConfigFile, error) {
+	data, err := os.ReadFile(name)
+	if nil != err {
+		return nil, err
+	}
+	return NewConfigFile(name, data), nil
+}
+
+// NewConfigFile 使用已读取的内容创建配置文件, name用于错误信息
+func NewConfigFile(name string, data []byte) *ConfigFile {
+	return &ConfigFile{name: name, data: data, offsets: make(map[string]int64), values: make(map[int64]configValue)}
+}
+
+// Name 文件名
+func (f *ConfigFile) Name() string {
+	return f.name
+}
+
+// Decode 解析到v, v中已有的值作为默认值; 语法错误、未知或重复的配置项、类型不匹配时返回*ConfigError
+func (f *ConfigFile) Decode(v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(f.data))
+	if err := f.walk(dec, "", reflect.TypeOf(v)); nil != err {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return f.errorAt(dec.InputOffset(), "", errors.New("unexpected data after top-level value"))
+	}
+	dec = json.NewDecoder(bytes.NewReader(f.data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); nil != err {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			// 类型错误的偏移在值之后, 指向值的起始位置
+			offset, path := typeErr.Offset, typeErr.Field
+			if val, ok := f.values[offset]; ok {
+				offset, path = val.start, val.path
+			}
+			return f.errorAt(offset, path, fmt.Errorf("expected %s, got %s", typeErr.Type, typeErr.Value))
+		}
+		return f.tokenError(dec, "", err)
+	}
+	return nil
+}
+
+// Errorf 返回配置项path的错误, 配置项不在文件中时没有行列号
+func (f *ConfigFile) Errorf(path string, format string, args ...interface{}) error {
+	return f.Error(path, fmt.Errorf(format, args...))
+}
+
+// Error 返回配置项path的错误, 配置项不在文件中时没有行列号
+func (f *ConfigFile) Error(path string, err error) error {
+	if nil == f {
+		return &ConfigError{Path: path, Err: err}
+	}
+	if offset, ok := f.offsets[path]; ok {
+		return f.errorAt(offset, path, err)
+	}
+	return &ConfigError{File: f.name, Path: path, Err: err}
+}
+
+// Has 配置文件中是否设置了配置项path
+func (f *ConfigFile) Has(path string) bool {
+	if nil == f {
+		return false
+	}
+	_, ok := f.offsets[path]
+	return ok
+}
+
+// Override 配置项path及其子项已被命令行参数覆盖, 之后的错误不再指向文件
+func (f *ConfigFile) Override(path string) {
+	if nil == f {
+		return
+	}
+	for key := range f.offsets {
+		if key == path || strings.HasPrefix(key, path+".") || strings.HasPrefix(key, path+"[") {
+			delete(f.offsets, key)
+		}
+	}
+}
+
+// errorAt 返回文件偏移offset处的错误
+func (f *ConfigFile) errorAt(offset int64, path string, err error) error {
+	if offset > int64(len(f.data)) {
+		offset = int64(len(f.data))
+	}
+	line, column := 1, 1
+	for i := int64(0); i < offset; i++ {
+		if f.data[i] == '\n' {
+			line, column = line+1, 1
+		} else {
+			column++
+		}
+	}
+	return &ConfigError{File: f.name, Line: line, Column: column, Path: path, Err: err}
+}
+
+// tokenError 返回读取JSON时的错误, 语法错误使用其中的偏移
+func (f *ConfigFile) tokenError(dec *json.Decoder, path string, err error) error {
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		return f.errorAt(syntaxErr.Offset, path, err)
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return f.errorAt(dec.InputOffset(), path, err)
+}
+
+// start 返回刚读取的值的起始偏移, 只用于字符串、数字等单行的值和对象、数组的起始符号
+func (f *ConfigFile) start(end int64, tok json.Token) int64 {
+	if _, ok := tok.(json.Delim); ok {
+		return end - 1
+	}
+	if _, ok := tok.(string); ok {
+		// 字符串向前查找未转义的起始引号
+		for i := end - 2; i >= 0; i-- {
+			if f.data[i] == '"' && (i == 0 || f.data[i-1] != '\\') {
+				return i
+			}
+		}
+	}
+	start := end
+	for start > 0 && !bytes.ContainsRune([]byte(" \t\r\n,:[{"), rune(f.data[start-1])) {
+		start--
+	}
+	return start
+}
+
+// walk 按目标类型遍历JSON值, 记录配置项的位置, 检查未知和重复的配置项
+func (f *ConfigFile) walk(dec *json.Decoder, path string, typ reflect.Type) error {
+	tok, err := dec.Token()
+	if nil != err {
+		return f.tokenError(dec, path, err)
+	}
+	end := dec.InputOffset()
+	f.values[end] = configValue{start: f.start(end, tok), path: path}
+	if _, ok := f.offsets[path]; !ok {
+		f.offsets[path] = f.values[end].start
+	}
+	for nil != typ && typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	switch tok {
+	case json.Delim('{'):
+		seen := make(map[string]bool)
+		for dec.More() {
+			if tok, err = dec.Token(); nil != err {
+				return f.tokenError(dec, path, err)
+			}
+			key := tok.(string)
+			child := key
+			if len(path) > 0 {
+				child = path + "." + key
+			}
+			f.offsets[child] = f.start(dec.InputOffset(), tok)
+			if seen[key] {
+				return f.Errorf(child, "duplicate key")
+			}
+			seen[key] = true
+			var elem reflect.Type
+			if nil != typ {
+				switch typ.Kind() {
+				case reflect.Struct:
+					if elem = configField(typ, key); nil == elem {
+						return f.Errorf(child, "unknown key")
+					}
+				case reflect.Map, reflect.Slice, reflect.Array:
+					elem = typ.Elem()
+				}
+			}
+			if err = f.walk(dec, child, elem); nil != err {
+				return err
+			}
+		}
+		_, err = dec.Token()
+	case json.Delim('['):
+		var elem reflect.Type
+		if nil != typ && (typ.Kind() == reflect.Slice || typ.Kind() == reflect.Array) {
+			elem = typ.Elem()
+		}
+		for i := 0; dec.More(); i++ {
+			if err = f.walk(dec, path+"["+strconv.Itoa(i)+"]", elem); nil != err {
+				return err
+			}
+		}
+		_, err = dec.Token()
+	}
+	if nil != err {
+		return f.tokenError(dec, path, err)
+	}
+	return nil
+}
+
+// configField 返回结构体中JSON名称为key的字段类型, 没有时返回nil
+func configField(typ reflect.Type, key string) reflect.Type {
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if len(field.PkgPath) > 0 {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if len(name) == 0 {
+			name = field.Name
+		}
+		if name == key {
+			return field.Type
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+// Copyright (C) 2022 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package tunnelcomm
+
+import (
+	"errors"
+	"testing"
+)
+
+type testConfig struct {
+	Tunnel struct {
+		Listen string `json:"listen"`
+	} `json:"tunnel"`
+	Listeners []struct {
+		Name string `json:"name"`
+		Addr string `json:"addr"`
+	} `json:"listeners"`
+	Speed int            `json:"speed"`
+	Hosts map[string]int `json:"hosts"`
+}
+
+func TestConfigFile(t *testing.T) {
+	data := `{
+  "tunnel": {"listen": "0.0.0.0:8101"},
+  "listeners": [
+    {"name": "web", "addr": "0.0.0.0:8080"},
+    {"name": "ssh",
+     "addr": "bad"}
+  ],
+  "hosts": {"a.example.com": 1}
+}`
+	file := NewConfigFile("server.json", []byte(data))
+	cfg := testConfig{Speed: 100}
+	if err := file.Decode(&cfg); nil != err {
+		t.Fatal(err)
+	}
+	if cfg.Tunnel.Listen != "0.0.0.0:8101" || len(cfg.Listeners) != 2 || cfg.Speed != 100 || cfg.Hosts["a.example.com"] != 1 {
+		t.Fatal(cfg)
+	}
+	err := file.Errorf("listeners[1].addr", "invalid address")
+	if err.Error() != "server.json:6:6: listeners[1].addr: invalid address" {
+		t.Fatal(err)
+	}
+	var cfgErr *ConfigError
+	if !errors.As(err, &cfgErr) || cfgErr.Line != 6 {
+		t.Fatal(err)
+	}
+	// 被命令行参数覆盖后不再指向文件
+	file.Override("listeners")
+	if err = file.Errorf("listeners[1].addr", "invalid address"); err.Error() != "server.json: listeners[1].addr: invalid address" {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct{ data, want string }{
+		{"{\n  \"tunnel\": {\n    \"listn\": \"x\"}}", "server.json:3:5: tunnel.listn: unknown key"},
+		{"{\n  \"speed\": 1,\n  \"speed\": 2}", "server.json:3:3: speed: duplicate key"},
+		{"{\n  \"speed\": \"fast\"}", "server.json:2:12: speed: expected int, got string"},
+		{"{\"listeners\": [{}, {\"addr\": 80}]}", "server.json:1:29: listeners[1].addr: expected string, got number"},
+		{"{\"hosts\": {\"a\": [1]}}", "server.json:1:17: hosts.a: expected int, got array"},
+		{"{\n  \"speed\": 1,\n}", "server.json:2:14: invalid character ',' looking for beginning of value"},
+		{"{\n  \"speed\": 1", "server.json:2:13: unexpected end of JSON input"},
+		{"{} {}", "server.json:1:5: unexpected data after top-level value"},
+	} {
+		cfg := testConfig{}
+		if err := NewConfigFile("server.json", []byte(c.data)).Decode(&cfg); nil == err || err.Error() != c.want {
+			t.Error(err, "want:", c.want)
+		}
+	}
+}
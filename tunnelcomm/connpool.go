@@ -0,0 +1,247 @@
+// Copyright (C) 2022 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package tunnelcomm
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/wup364/pakku/utils/logs"
+)
+
+const (
+	// CAPNEEDCONN 服务端推送连接需求的能力, 客户端不再轮询连接数
+	CAPNEEDCONN = "needconn"
+	// CAPDRAIN 服务端排空时通知客户端的能力
+	CAPDRAIN = "drain"
+	// POOLIDLETIMEOUT 超出最小空闲数的连接默认的空闲超时时间
+	POOLIDLETIMEOUT = 60 * time.Second
+	// CTRLHEARTBEAT 控制通道的心跳间隔
+	CTRLHEARTBEAT = 10 * time.Second
+)
+
+// ErrPoolFull 服务的隧道连接数已达到上限
+var ErrPoolFull = errors.New("tunnel connection pool is full")
+
+// connPool 客户端一个服务的隧道连接统计, 由补充协程按需建立连接
+type connPool struct {
+	idle   int64         // 空闲连接数
+	total  int64         // 连接总数, 包括正在建立的连接
+	demand int64         // 服务端推送的新增排队用户数累计, 补充时取出
+	wake   chan struct{} // 补充连接信号
+}
+
+// newConnPool 创建连接统计
+func newConnPool() *connPool {
+	return &connPool{wake: make(chan struct{}, 1)}
+}
+
+// signal 通知补充协程检查连接数, 多次通知合并为一次
+func (p *connPool) signal() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// reserve 占用一个连接名额, 超过上限时返回false, max为0时不限制
+func (p *connPool) reserve(max int64) bool {
+	if n := atomic.AddInt64(&p.total, 1); max > 0 && n > max {
+		atomic.AddInt64(&p.total, -1)
+		return false
+	}
+	return true
+}
+
+// trimIdle 空闲连接数超过min时减少一个空闲连接, 返回是否可以关闭
+func (p *connPool) trimIdle(min int64) bool {
+	for {
+		n := atomic.LoadInt64(&p.idle)
+		if n <= min {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&p.idle, n, n-1) {
+			return true
+		}
+	}
+}
+
+// SetPoolSize 设置每个服务的连接池大小, min: 保持的空闲连接数, max: 连接总数上限, 0不限制
+// idleTimeout: 超出min的空闲连接在空闲超过该时间后关闭, 0不关闭; 运行中修改时立即按新的大小补充连接
+func (c *TCPTunnelClient) SetPoolSize(min, max int64, idleTimeout time.Duration) {
+	c.lock.Lock()
+	c.minIdle, c.maxConns, c.idleTimeout = min, max, idleTimeout
+	pools := make([]*connPool, 0, len(c.pools))
+	for _, pool := range c.pools {
+		pools = append(pools, pool)
+	}
+	c.lock.Unlock()
+	for i := 0; i < len(pools); i++ {
+		pools[i].signal()
+	}
+}
+
+// poolSize 获取连接池大小的设置
+func (c *TCPTunnelClient) poolSize() (min, max int64, idleTimeout time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.minIdle, c.maxConns, c.idleTimeout
+}
+
+// getPool 获取服务的连接统计
+func (c *TCPTunnelClient) getPool(service string) *connPool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if nil == c.pools {
+		c.pools = make(map[string]*connPool)
+	}
+	pool, ok := c.pools[service]
+	if !ok {
+		pool = newConnPool()
+		c.pools[service] = pool
+	}
+	return pool
+}
+
+// fillPool 收到信号后补充服务的连接, 保持minIdle个空闲连接, 并为服务端排队的用户各建立一个连接, 控制通道关闭或服务删除后退出
+func (c *TCPTunnelClient) fillPool(service string, done chan struct{}) {
+	pool := c.getPool(service)
+	pool.signal()
+	for {
+		select {
+		case <-done:
+			return
+		case <-pool.wake:
+		}
+		if !containsService(c.getServices(), service) {
+			return
+		}
+		// 服务端排空时只为已排队的用户建立连接
+		min, _, _ := c.poolSize()
+		demand := atomic.SwapInt64(&pool.demand, 0)
+		if c.isDraining() {
+			min = 0
+		}
+		for created := int64(0); atomic.LoadInt64(&pool.idle) < min || created < demand; created++ {
+			if err := c.NewC2SConn(service); nil != err {
+				if !errors.Is(err, ErrPoolFull) && !errors.Is(err, ErrClientClosed) {
+					logs.Errorln(err)
+				}
+				break
+			}
+		}
+	}
+}
+
+// serveCtrl 处理服务端在控制通道上推送的命令, 定时发送心跳, 控制通道异常时返回
+func (c *TCPTunnelClient) serveCtrl(conn net.Conn, useMux bool) (err error) {
+	done := make(chan struct{})
+	defer close(done)
+	c.lock.Lock()
+	c.ctrlDone, c.ctrlMux = done, useMux
+	services := c.services
+	c.lock.Unlock()
+	defer func() {
+		c.lock.Lock()
+		c.ctrlDone = nil
+		c.lock.Unlock()
+	}()
+	if !useMux {
+		for i := 0; i < len(services); i++ {
+			go c.fillPool(services[i], done)
+		}
+	}
+	go func() {
+		ticker := time.NewTicker(CTRLHEARTBEAT)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			if err := c.writeCtrl(conn, CTRLCMD.CONNHEART); nil != err {
+				conn.Close()
+				return
+			}
+			// 补充建立失败的连接
+			if useMux {
+				notifyChan(c.muxWake)
+			}
+			services := c.getServices()
+			for i := 0; i < len(services) && !useMux; i++ {
+				c.getPool(services[i]).signal()
+			}
+		}
+	}()
+	if useMux {
+		go c.keepMuxConns(done)
+	}
+	for {
+		var cmd Frame
+		if cmd, err = c.readCMD(conn); nil != err {
+			return err
+		}
+		if cmd.Type == CTRLCMD.NEEDCONN {
+			if useMux || !containsService(c.getServices(), cmd.Arg(0)) {
+				continue
+			}
+			pool := c.getPool(cmd.Arg(0))
+			if n, err := strconv.ParseInt(cmd.Arg(1), 10, 64); nil == err && n > 0 {
+				atomic.AddInt64(&pool.demand, n)
+			}
+			pool.signal()
+		} else if cmd.Type == CTRLCMD.SERVICES {
+			// 服务更新的应答, 交给等待的UpdateServices
+			c.lock.Lock()
+			reply := c.svcReply
+			c.lock.Unlock()
+			if nil != reply {
+				select {
+				case reply <- cmd:
+				default:
+				}
+			}
+		} else if cmd.Type == CTRLCMD.DRAIN {
+			atomic.StoreInt32(&c.draining, 1)
+			logs.Infoln("the server is draining, stop adding tunnel connections")
+		} else if cmd.Type != CTRLCMD.CONNHEART {
+			return errors.New("unexpected control command: " + cmd.String())
+		}
+	}
+}
+
+// isDraining 服务端是否正在排空
+func (c *TCPTunnelClient) isDraining() bool {
+	return atomic.LoadInt32(&c.draining) == 1
+}
+
+// keepMuxConns 收到信号后补充多路复用连接, 会话关闭时和心跳时发出信号, 控制通道关闭后退出
+func (c *TCPTunnelClient) keepMuxConns(done chan struct{}) {
+	notifyChan(c.muxWake)
+	for {
+		select {
+		case <-done:
+			return
+		case <-c.muxWake:
+		}
+		for atomic.LoadInt64(&c.muxActive) < c.muxCount && !c.isDraining() {
+			if err := c.NewMuxConn(); nil != err {
+				if !errors.Is(err, ErrClientClosed) {
+					logs.Errorln(err)
+				}
+				break
+			}
+		}
+	}
+}
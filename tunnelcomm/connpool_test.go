@@ -0,0 +1,82 @@
+// Copyright (C) 2022 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package tunnelcomm
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConnPool(t *testing.T) {
+	pool := newConnPool()
+	if !pool.reserve(2) || !pool.reserve(2) || pool.reserve(2) || pool.total != 2 {
+		t.Fatal("unexpected reserve result", pool.total)
+	}
+	pool.idle = 3
+	if !pool.trimIdle(1) || !pool.trimIdle(1) || pool.trimIdle(1) || pool.idle != 1 {
+		t.Fatal("unexpected trim result", pool.idle)
+	}
+}
+
+func TestNeedConn(t *testing.T) {
+	service, addr := startTestService(t)
+	client := newTestClient(addr, "branch1", "web")
+	client.SetPoolSize(0, 1, POOLIDLETIMEOUT)
+	go client.Start(context.Background())
+	time.Sleep(300 * time.Millisecond)
+	if count := service.CountConn("web"); count != 0 {
+		t.Fatal("unexpected idle connections", count)
+	}
+	// 用户排队后服务端推送需求, 客户端建立连接
+	for i := 0; i < 2; i++ {
+		conn, err := service.AcquireConn(context.Background(), "web", nil, nil)
+		if nil != err {
+			t.Fatal(err)
+		}
+		if got, _ := io.ReadAll(conn); string(got) != "branch1:web" {
+			t.Fatal(string(got))
+		}
+		service.RelaseConn(conn)
+	}
+	if total := atomic.LoadInt64(&client.getPool("web").total); total > 1 {
+		t.Fatal("connection limit exceeded", total)
+	}
+}
+
+func TestNeedConnDelta(t *testing.T) {
+	service, addr := startTestService(t)
+	client := newTestClient(addr, "branch1", "web")
+	client.SetPoolSize(0, 0, POOLIDLETIMEOUT)
+	go client.Start(context.Background())
+	time.Sleep(300 * time.Millisecond)
+	// 多个用户同时排队, 客户端按增量为每个用户建立一个连接
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := service.AcquireConn(context.Background(), "web", nil, nil)
+			if nil != err {
+				t.Error(err)
+				return
+			}
+			io.ReadAll(conn)
+		}()
+	}
+	wg.Wait()
+	time.Sleep(300 * time.Millisecond)
+	if total := atomic.LoadInt64(&client.getPool("web").total); total > 3 {
+		t.Fatal("too many connections for the queued users", total)
+	}
+}
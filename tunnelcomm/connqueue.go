@@ -0,0 +1,88 @@
+// Copyright (C) 2022 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package tunnelcomm
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// CONNWAITTIMEOUT 用户等待隧道连接的默认超时时间
+	CONNWAITTIMEOUT = 60 * time.Second
+	// CONNQUEUEMAX 每个服务默认的最大等待用户数
+	CONNQUEUEMAX = 1024
+)
+
+// ErrConnQueueFull 等待隧道连接的用户已达到上限
+var ErrConnQueueFull = errors.New("connection wait queue is full")
+
+// connQueue 等待服务隧道连接的用户队列, 先到先得, 队首的用户取得连接后才离开队列
+type connQueue struct {
+	lock    sync.Mutex
+	waiters *list.List
+}
+
+// newConnQueue 创建等待队列
+func newConnQueue() *connQueue {
+	return &connQueue{waiters: list.New()}
+}
+
+// push 加入队尾等待, 队列已满时返回错误
+func (q *connQueue) push(max int) (*list.Element, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if max > 0 && q.waiters.Len() >= max {
+		return nil, ErrConnQueueFull
+	}
+	return q.waiters.PushBack(make(chan struct{}, 1)), nil
+}
+
+// remove 离开队列, 返回离开前是否在队首
+func (q *connQueue) remove(e *list.Element) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	front := q.waiters.Front() == e
+	for val := q.waiters.Front(); nil != val; val = val.Next() {
+		if val == e {
+			q.waiters.Remove(e)
+			break
+		}
+	}
+	return front
+}
+
+// isFront 用户是否在队首
+func (q *connQueue) isFront(e *list.Element) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.waiters.Front() == e
+}
+
+// wake 唤醒队首的用户, 用户仍留在队首直到取得连接, 多次唤醒合并为一次
+func (q *connQueue) wake() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if e := q.waiters.Front(); nil != e {
+		select {
+		case e.Value.(chan struct{}) <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// size 等待的用户数
+func (q *connQueue) size() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.waiters.Len()
+}
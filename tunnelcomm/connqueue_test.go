@@ -0,0 +1,94 @@
+// Copyright (C) 2022 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package tunnelcomm
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestConnQueue(t *testing.T) {
+	queue := newConnQueue()
+	first, _ := queue.push(2)
+	second, _ := queue.push(2)
+	if _, err := queue.push(2); !errors.Is(err, ErrConnQueueFull) {
+		t.Fatal(err)
+	}
+	// 先到先得, 被唤醒的用户取得连接前仍在队首
+	queue.wake()
+	select {
+	case <-first.Value.(chan struct{}):
+	default:
+		t.Fatal("first waiter is not woken")
+	}
+	if !queue.isFront(first) || queue.isFront(second) {
+		t.Fatal("woken waiter left the queue")
+	}
+	if !queue.remove(first) || !queue.isFront(second) || !queue.remove(second) || queue.size() != 0 {
+		t.Fatal("unexpected queue state")
+	}
+}
+
+func TestConnQueueDelete(t *testing.T) {
+	service, _ := startTestService(t)
+	service.SetConnWait(100*time.Millisecond, 1)
+	for i := 0; i < 3; i++ {
+		if _, err := service.AcquireConn(context.Background(), "web", nil, nil); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatal(err)
+		}
+	}
+	// 用户离开后删除空队列
+	if service.queues.Size() != 0 {
+		t.Fatal("empty queue is not deleted")
+	}
+}
+
+func TestAcquireConn(t *testing.T) {
+	service, addr := startTestService(t)
+	service.SetConnWait(300*time.Millisecond, 1)
+	if _, err := service.AcquireConn(context.Background(), "web", nil, nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal(err)
+	}
+	service.SetConnWait(10*time.Second, 1)
+	result := make(chan error, 1)
+	go func() {
+		conn, err := service.AcquireConn(context.Background(), "web", nil, nil)
+		if nil == err {
+			if got, _ := io.ReadAll(conn); string(got) != "branch1:web" {
+				err = errors.New("unexpected response: " + string(got))
+			}
+			service.RelaseConn(conn)
+		}
+		result <- err
+	}()
+	for i := 0; i < 50 && service.queueSize("web") == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := service.AcquireConn(context.Background(), "web", nil, nil); !errors.Is(err, ErrConnQueueFull) {
+		t.Fatal(err)
+	}
+	// 客户端连接后唤醒等待的用户
+	start := time.Now()
+	go newTestClient(addr, "branch1", "web").Start(context.Background())
+	select {
+	case err := <-result:
+		if nil != err {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiter is not woken")
+	}
+	if time.Since(start) > 3*time.Second {
+		t.Fatal("waiter is woken too late")
+	}
+}
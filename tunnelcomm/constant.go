@@ -10,13 +10,14 @@
 package tunnelcomm
 
 import (
+	"errors"
 	"net"
 	"time"
 )
 
 const (
-	// CMDMAXLEN 管理命令最大字符数
-	CMDMAXLEN = 512
+	// CMDMAXLEN 管理命令帧负载最大字节数
+	CMDMAXLEN = 256 * 1024
 	// CMDWTIMEOUT TCP写入超时
 	CMDWTIMEOUT = time.Second * 30
 	// CMDRTIMEOUT TCP读取超时
@@ -25,40 +26,80 @@ const (
 
 // ctrlcmd 控制命令
 var CTRLCMD = ctrlcmd{
-	NEWCTRLCONN:    "0",
-	NEWUSERCONN:    "A",
-	COUNTCONN:      "C",
-	CLEARCONN:      "D",
-	RESETCONN:      "R",
-	STARTTRANSPORT: "S",
-	CONNHEART:      "H",
-	OK:             "O",
+	NEWCTRLCONN:    '0',
+	NEWUSERCONN:    'A',
+	COUNTCONN:      'C',
+	CLEARCONN:      'D',
+	RESETCONN:      'R',
+	STARTTRANSPORT: 'S',
+	CONNHEART:      'H',
+	OK:             'O',
+	REJECT:         'E',
+	AUTH:           'K',
+	NEWMUXCONN:     'M',
+	TRANSDATA:      'T',
+	TRANSEOF:       'F',
+	NEEDCONN:       'N',
+	DRAIN:          'Q',
+	SERVICES:       'V',
 }
 
 // ctrlcmd 控制命令
 type ctrlcmd struct {
 	//  管理线程链接
-	NEWCTRLCONN string
+	NEWCTRLCONN byte
 	//  创建连接
-	NEWUSERCONN string
+	NEWUSERCONN byte
 	//  统计连接数
-	COUNTCONN string
+	COUNTCONN byte
 	//  清理连接池
-	CLEARCONN string
+	CLEARCONN byte
 	//  开始传输
-	STARTTRANSPORT string
+	STARTTRANSPORT byte
 	//  心跳包
-	CONNHEART string
+	CONNHEART byte
 	//  准备就绪
-	OK string
+	OK byte
 	//  重置链接
-	RESETCONN string
+	RESETCONN byte
+	//  拒绝请求, 参数为原因
+	REJECT byte
+	//  认证, 服务端发送随机数, 客户端返回签名
+	AUTH byte
+	//  创建多路复用连接
+	NEWMUXCONN byte
+	//  传输数据
+	TRANSDATA byte
+	//  传输结束
+	TRANSEOF byte
+	//  服务端推送的连接需求, 参数为服务名和新增的排队用户数
+	NEEDCONN byte
+	//  服务端正在排空, 客户端停止补充连接
+	DRAIN byte
+	//  客户端更新提供的服务, 参数为JSON格式的服务、远程端口和域名; 服务端以同一命令应答结果
+	SERVICES byte
 }
 
-// WriteCMD 发送控制命令
-func (c *ctrlcmd) WriteCMD(conn net.Conn, cmd string) (err error) {
+// WriteCMD 发送控制命令, args为命令参数
+func (c *ctrlcmd) WriteCMD(conn net.Conn, cmd byte, args ...string) (err error) {
+	return c.WriteFrame(conn, NewFrame(cmd, args...))
+}
+
+// WriteFrame 发送控制帧
+func (c *ctrlcmd) WriteFrame(conn net.Conn, frame Frame) (err error) {
 	if err = conn.SetWriteDeadline(time.Now().Add(CMDWTIMEOUT)); nil == err {
-		_, err = conn.Write([]byte(cmd + "\n"))
+		err = NewFrameEncoder(conn).Encode(frame)
 	}
 	return err
 }
+
+// ReadCMD 读取一个控制帧
+func (c *ctrlcmd) ReadCMD(conn net.Conn) (frame Frame, err error) {
+	if nil == conn {
+		return frame, errors.New("conn is nil")
+	}
+	if err = conn.SetReadDeadline(time.Now().Add(CMDRTIMEOUT)); nil == err {
+		frame, err = NewFrameDecoder(conn).Decode()
+	}
+	return frame, err
+}
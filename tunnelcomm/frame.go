@@ -0,0 +1,142 @@
+// Copyright (C) 2022 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package tunnelcomm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// FRAMEHEADLEN 帧头长度, 1字节类型 + 4字节负载长度(大端)
+const FRAMEHEADLEN = 5
+
+// ErrFrameTooLarge 帧负载超过允许的最大长度
+var ErrFrameTooLarge = errors.New("frame payload too large")
+
+// ErrFrameTruncated 帧数据不完整, 连接上的数据已经无法继续解析
+var ErrFrameTruncated = errors.New("frame truncated")
+
+// Frame 控制帧: 类型 + 负载
+type Frame struct {
+	Type    byte
+	Payload []byte
+}
+
+// NewFrame 使用参数列表构建帧
+func NewFrame(typ byte, args ...string) Frame {
+	return Frame{Type: typ, Payload: EncodeArgs(args...)}
+}
+
+// Args 将负载解析为参数列表
+func (f Frame) Args() ([]string, error) {
+	return DecodeArgs(f.Payload)
+}
+
+// Arg 获取第i个参数, 不存在时返回空字符串
+func (f Frame) Arg(i int) string {
+	if args, err := f.Args(); nil == err && i >= 0 && i < len(args) {
+		return args[i]
+	}
+	return ""
+}
+
+// String 调试输出
+func (f Frame) String() string {
+	if args, err := f.Args(); nil == err {
+		return fmt.Sprintf("%c%q", f.Type, args)
+	}
+	return fmt.Sprintf("%c[%d bytes]", f.Type, len(f.Payload))
+}
+
+// FrameEncoder 帧编码器, 每个帧只调用一次Write, 避免多个写入方交错
+type FrameEncoder struct {
+	w io.Writer
+}
+
+// NewFrameEncoder 实例化帧编码器
+func NewFrameEncoder(w io.Writer) *FrameEncoder {
+	return &FrameEncoder{w: w}
+}
+
+// Encode 写入一个帧
+func (e *FrameEncoder) Encode(f Frame) (err error) {
+	if len(f.Payload) > CMDMAXLEN {
+		return ErrFrameTooLarge
+	}
+	buf := make([]byte, FRAMEHEADLEN+len(f.Payload))
+	buf[0] = f.Type
+	binary.BigEndian.PutUint32(buf[1:FRAMEHEADLEN], uint32(len(f.Payload)))
+	copy(buf[FRAMEHEADLEN:], f.Payload)
+	_, err = e.w.Write(buf)
+	return err
+}
+
+// FrameDecoder 帧解码器, 只读取帧本身的字节, 不会多读后续的数据
+type FrameDecoder struct {
+	r      io.Reader
+	maxLen int
+}
+
+// NewFrameDecoder 实例化帧解码器
+func NewFrameDecoder(r io.Reader) *FrameDecoder {
+	return &FrameDecoder{r: r, maxLen: CMDMAXLEN}
+}
+
+// Decode 读取一个帧, 帧头未读到任何数据时返回原始错误(如超时、EOF), 读取到一半时返回ErrFrameTruncated
+func (d *FrameDecoder) Decode() (f Frame, err error) {
+	head := make([]byte, FRAMEHEADLEN)
+	var n int
+	if n, err = io.ReadFull(d.r, head); nil != err {
+		if n > 0 {
+			err = fmt.Errorf("%w: %s", ErrFrameTruncated, err.Error())
+		}
+		return f, err
+	}
+	f.Type = head[0]
+	size := binary.BigEndian.Uint32(head[1:])
+	if int64(size) > int64(d.maxLen) {
+		return f, ErrFrameTooLarge
+	}
+	if size > 0 {
+		f.Payload = make([]byte, size)
+		if _, err = io.ReadFull(d.r, f.Payload); nil != err {
+			err = fmt.Errorf("%w: %s", ErrFrameTruncated, err.Error())
+		}
+	}
+	return f, err
+}
+
+// EncodeArgs 编码参数列表, 每个参数前带有uvarint长度
+func EncodeArgs(args ...string) []byte {
+	buf := make([]byte, 0)
+	size := make([]byte, binary.MaxVarintLen64)
+	for i := 0; i < len(args); i++ {
+		n := binary.PutUvarint(size, uint64(len(args[i])))
+		buf = append(buf, size[:n]...)
+		buf = append(buf, args[i]...)
+	}
+	return buf
+}
+
+// DecodeArgs 解码参数列表
+func DecodeArgs(payload []byte) ([]string, error) {
+	args := make([]string, 0)
+	for len(payload) > 0 {
+		size, n := binary.Uvarint(payload)
+		if n <= 0 || uint64(len(payload)-n) < size {
+			return args, errors.New("invalid frame arguments")
+		}
+		args = append(args, string(payload[n:n+int(size)]))
+		payload = payload[n+int(size):]
+	}
+	return args, nil
+}
@@ -0,0 +1,67 @@
+// Copyright (C) 2022 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package tunnelcomm
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+func TestFrameCodec(t *testing.T) {
+	buf := new(bytes.Buffer)
+	enc := NewFrameEncoder(buf)
+	if err := enc.Encode(NewFrame(CTRLCMD.COUNTCONN, "25")); nil != err {
+		t.Fatal(err)
+	}
+	if err := enc.Encode(NewFrame(CTRLCMD.OK)); nil != err {
+		t.Fatal(err)
+	}
+	if err := enc.Encode(NewFrame(CTRLCMD.NEWUSERCONN, "a\nb", "")); nil != err {
+		t.Fatal(err)
+	}
+	buf.WriteString("raw data")
+
+	// 逐字节读取, 模拟被TCP拆分的数据
+	r := iotest.OneByteReader(buf)
+	dec := NewFrameDecoder(r)
+	if f, err := dec.Decode(); nil != err || f.Type != CTRLCMD.COUNTCONN || f.Arg(0) != "25" {
+		t.Fatal(f, err)
+	}
+	if f, err := dec.Decode(); nil != err || f.Type != CTRLCMD.OK || len(f.Payload) != 0 {
+		t.Fatal(f, err)
+	}
+	if f, err := dec.Decode(); nil != err || f.Type != CTRLCMD.NEWUSERCONN {
+		t.Fatal(f, err)
+	} else if args, err := f.Args(); nil != err || len(args) != 2 || args[0] != "a\nb" || args[1] != "" {
+		t.Fatal(args, err)
+	}
+	// 帧后面的数据不能被解码器读走
+	if rest, _ := io.ReadAll(r); string(rest) != "raw data" {
+		t.Fatal(string(rest))
+	}
+}
+
+func TestFrameDecodeError(t *testing.T) {
+	if _, err := NewFrameDecoder(bytes.NewReader(nil)).Decode(); err != io.EOF {
+		t.Fatal(err)
+	}
+	if _, err := NewFrameDecoder(bytes.NewReader([]byte{'O', 0})).Decode(); !errors.Is(err, ErrFrameTruncated) {
+		t.Fatal(err)
+	}
+	if _, err := NewFrameDecoder(bytes.NewReader([]byte{'O', 0xff, 0xff, 0xff, 0xff})).Decode(); err != ErrFrameTooLarge {
+		t.Fatal(err)
+	}
+	if _, err := DecodeArgs([]byte{5, 'a'}); nil == err {
+		t.Fatal("expected error")
+	}
+}
@@ -0,0 +1,227 @@
+// Copyright (C) 2022 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package tunnelcomm
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// LISTENERSENV 子进程继承监听的环境变量, 格式为'名称=文件描述符,...'
+const LISTENERSENV = "TUNNEL_LISTENERS"
+
+// fileListener 可以导出文件描述符的监听
+type fileListener interface {
+	File() (*os.File, error)
+}
+
+// Handoff 监听交接, 升级程序时将监听的文件描述符交给新启动的子进程, 子进程继续在原端口上接受连接
+type Handoff struct {
+	inherited map[string]*os.File     // 从父进程继承且尚未使用的监听
+	listeners map[string]fileListener // 当前进程使用的监听, 名称->监听
+	names     []string                // 监听名称, 按打开顺序
+	lock      sync.Mutex
+}
+
+// NewHandoff 创建监听交接, 读取并清除环境变量中从父进程继承的监听
+func NewHandoff() (*Handoff, error) {
+	h := &Handoff{inherited: make(map[string]*os.File), listeners: make(map[string]fileListener)}
+	spec := os.Getenv(LISTENERSENV)
+	os.Unsetenv(LISTENERSENV)
+	if len(spec) == 0 {
+		return h, nil
+	}
+	items := strings.Split(spec, ",")
+	for i := 0; i < len(items); i++ {
+		kv := strings.SplitN(items[i], "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("invalid inherited listener: " + items[i])
+		}
+		fd, err := strconv.Atoi(kv[1])
+		if nil != err || fd < 3 {
+			return nil, errors.New("invalid inherited listener: " + items[i])
+		}
+		h.inherited[kv[0]] = os.NewFile(uintptr(fd), kv[0])
+	}
+	return h, nil
+}
+
+// Listen 打开名为name的流式监听, 有同名且地址一致的继承监听时直接使用, 否则调用net.Listen
+func (h *Handoff) Listen(name, network, address string) (listener net.Listener, err error) {
+	if file := h.take(name); nil != file {
+		listener, err = net.FileListener(file)
+		file.Close()
+		if nil == err && !sameAddr(listener.Addr(), network, address) {
+			// 配置的地址已变化, 关闭继承的监听, unix监听同时删除旧的套接字文件
+			setUnlinkOnClose(listener, true)
+			listener.Close()
+			listener = nil
+		}
+	}
+	if nil == listener && nil == err {
+		listener, err = net.Listen(network, address)
+	} else if nil == err {
+		// 继承的unix监听与新建的一样, 关闭时删除套接字文件
+		setUnlinkOnClose(listener, true)
+	}
+	if nil == err {
+		err = h.add(name, listener)
+	}
+	return listener, err
+}
+
+// ListenPacket 打开名为name的数据包监听, 有同名且地址一致的继承监听时直接使用, 否则调用net.ListenPacket
+func (h *Handoff) ListenPacket(name, network, address string) (pc net.PacketConn, err error) {
+	if file := h.take(name); nil != file {
+		pc, err = net.FilePacketConn(file)
+		file.Close()
+		if nil == err && !sameAddr(pc.LocalAddr(), network, address) {
+			pc.Close()
+			pc = nil
+		}
+	}
+	if nil == pc && nil == err {
+		pc, err = net.ListenPacket(network, address)
+	}
+	if nil == err {
+		err = h.add(name, pc)
+	}
+	return pc, err
+}
+
+// take 取出同名的继承监听
+func (h *Handoff) take(name string) *os.File {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	file, ok := h.inherited[name]
+	if ok {
+		delete(h.inherited, name)
+	}
+	return file
+}
+
+// add 记录当前进程使用的监听, 升级时交给子进程
+func (h *Handoff) add(name string, listener interface{}) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	fl, ok := listener.(fileListener)
+	if !ok {
+		return fmt.Errorf("listener %s can not be handed off", name)
+	}
+	if _, ok = h.listeners[name]; ok {
+		return errors.New("duplicate listener name: " + name)
+	}
+	h.listeners[name] = fl
+	h.names = append(h.names, name)
+	return nil
+}
+
+// Remove 删除名为name的监听记录, 监听已被关闭, 升级时不再交给子进程
+func (h *Handoff) Remove(name string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if _, ok := h.listeners[name]; !ok {
+		return
+	}
+	delete(h.listeners, name)
+	for i := 0; i < len(h.names); i++ {
+		if h.names[i] == name {
+			h.names = append(h.names[:i], h.names[i+1:]...)
+			break
+		}
+	}
+}
+
+// CloseInherited 关闭没有使用的继承监听, 如升级后配置中已删除的端口
+func (h *Handoff) CloseInherited() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for name, file := range h.inherited {
+		file.Close()
+		delete(h.inherited, name)
+	}
+}
+
+// StartChild 使用相同的参数启动当前程序, 并将全部监听交给子进程, 返回子进程
+// 子进程启动后当前进程应停止接受新连接, 处理完现有连接后退出; Windows不支持
+func (h *Handoff) StartChild() (*os.Process, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	executable, err := os.Executable()
+	if nil != err {
+		return nil, err
+	}
+	files := make([]*os.File, 0, len(h.names))
+	defer func() {
+		for i := 0; i < len(files); i++ {
+			files[i].Close()
+		}
+	}()
+	specs := make([]string, 0, len(h.names))
+	for i := 0; i < len(h.names); i++ {
+		file, err := h.listeners[h.names[i]].File()
+		if nil != err {
+			return nil, err
+		}
+		// ExtraFiles中的第i个文件在子进程中的描述符为3+i
+		specs = append(specs, h.names[i]+"="+strconv.Itoa(3+len(files)))
+		files = append(files, file)
+	}
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), LISTENERSENV+"="+strings.Join(specs, ","))
+	cmd.ExtraFiles = files
+	if err = cmd.Start(); nil != err {
+		return nil, err
+	}
+	// 子进程已在使用套接字文件, 当前进程关闭unix监听时不能删除
+	for i := 0; i < len(h.names); i++ {
+		setUnlinkOnClose(h.listeners[h.names[i]], false)
+	}
+	return cmd.Process, nil
+}
+
+// setUnlinkOnClose 设置unix监听关闭时是否删除套接字文件, 其他监听忽略
+func setUnlinkOnClose(listener interface{}, unlink bool) {
+	if ul, ok := listener.(*net.UnixListener); ok {
+		ul.SetUnlinkOnClose(unlink)
+	}
+}
+
+// sameAddr 继承的监听地址是否与配置的地址一致, 配置的端口为0时不比较端口, 任意地址之间视为一致
+func sameAddr(addr net.Addr, network, address string) bool {
+	switch laddr := addr.(type) {
+	case *net.UnixAddr:
+		return strings.HasPrefix(network, "unix") && laddr.Name == address
+	case *net.TCPAddr:
+		want, err := net.ResolveTCPAddr(network, address)
+		return nil == err && sameIPPort(laddr.IP, laddr.Port, want.IP, want.Port)
+	case *net.UDPAddr:
+		want, err := net.ResolveUDPAddr(network, address)
+		return nil == err && sameIPPort(laddr.IP, laddr.Port, want.IP, want.Port)
+	}
+	return false
+}
+
+// sameIPPort 比较监听的IP和端口, want为配置解析后的地址
+func sameIPPort(ip net.IP, port int, wantIP net.IP, wantPort int) bool {
+	if wantPort != 0 && wantPort != port {
+		return false
+	}
+	if len(wantIP) == 0 || wantIP.IsUnspecified() {
+		return len(ip) == 0 || ip.IsUnspecified()
+	}
+	return ip.Equal(wantIP)
+}
@@ -0,0 +1,143 @@
+// Copyright (C) 2022 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//go:build !windows
+// +build !windows
+
+package tunnelcomm
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestHandoff(t *testing.T) {
+	parent, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer parent.Close()
+	file, err := parent.(*net.TCPListener).File()
+	if nil != err {
+		t.Fatal(err)
+	}
+	unused, err := parent.(*net.TCPListener).File()
+	if nil != err {
+		t.Fatal(err)
+	}
+	os.Setenv(LISTENERSENV, "tunnel="+strconv.Itoa(int(file.Fd()))+",http="+strconv.Itoa(int(unused.Fd())))
+	handoff, err := NewHandoff()
+	if nil != err {
+		t.Fatal(err)
+	}
+	if len(os.Getenv(LISTENERSENV)) > 0 {
+		t.Fatal("environment is not cleared")
+	}
+	// 同名的监听使用继承的端口
+	listener, err := handoff.Listen("tunnel", "tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	// 继承的描述符已被关闭, 避免测试中的文件对象重复关闭
+	if err = file.Close(); nil == err {
+		t.Fatal("inherited listener is not closed")
+	}
+	if listener.Addr().String() != parent.Addr().String() {
+		t.Fatal(listener.Addr(), parent.Addr())
+	}
+	if _, err = handoff.Listen("tunnel", "tcp", "127.0.0.1:0"); nil == err {
+		t.Fatal("duplicate listener name is accepted")
+	}
+	other, err := handoff.Listen("sni", "tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if other.Addr().String() == parent.Addr().String() {
+		t.Fatal("new listener uses the inherited port")
+	}
+	handoff.CloseInherited()
+	if err = unused.Close(); nil == err {
+		t.Fatal("unused listener is not closed")
+	}
+
+	os.Setenv(LISTENERSENV, "tunnel=abc")
+	if _, err = NewHandoff(); nil == err {
+		t.Fatal("invalid environment is accepted")
+	}
+}
+
+func TestHandoffAddrChanged(t *testing.T) {
+	parent, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer parent.Close()
+	file, err := parent.(*net.TCPListener).File()
+	if nil != err {
+		t.Fatal(err)
+	}
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	address := free.Addr().String()
+	free.Close()
+	os.Setenv(LISTENERSENV, "tunnel="+strconv.Itoa(int(file.Fd())))
+	handoff, err := NewHandoff()
+	if nil != err {
+		t.Fatal(err)
+	}
+	// 配置的地址已变化, 不使用继承的监听
+	listener, err := handoff.Listen("tunnel", "tcp", address)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if listener.Addr().String() != address {
+		t.Fatal(listener.Addr(), address)
+	}
+	// 继承的描述符已被关闭, 新监听可能复用同一个描述符, 关闭新监听后再释放测试中的文件对象
+	listener.Close()
+	file.Close()
+}
+
+func TestHandoffUnix(t *testing.T) {
+	path := t.TempDir() + "/tunnel.sock"
+	parent, err := net.Listen("unix", path)
+	if nil != err {
+		t.Fatal(err)
+	}
+	// 交给子进程后父进程关闭监听不删除套接字文件
+	setUnlinkOnClose(parent, false)
+	file, err := parent.(*net.UnixListener).File()
+	if nil != err {
+		t.Fatal(err)
+	}
+	parent.Close()
+	if _, err = os.Stat(path); nil != err {
+		t.Fatal("socket file is removed by the parent", err)
+	}
+	os.Setenv(LISTENERSENV, "unix="+strconv.Itoa(int(file.Fd())))
+	handoff, err := NewHandoff()
+	if nil != err {
+		t.Fatal(err)
+	}
+	listener, err := handoff.Listen("unix", "unix", path)
+	if nil != err {
+		t.Fatal(err)
+	}
+	file.Close()
+	// 继承的监听关闭时删除套接字文件
+	listener.Close()
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("socket file is not removed", err)
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright (C) 2022 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package tunnelcomm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+const (
+	// PROTOCOLVERSION 当前支持的最高协议版本
+	PROTOCOLVERSION = 2
+	// MINPROTOCOLVERSION 可以兼容的最低协议版本, 版本1为换行分隔的文本命令, 无法兼容, 双方需要同时升级
+	MINPROTOCOLVERSION = 2
+)
+
+// ErrServerTooOld 服务端不支持版本2及以上的协议, 版本1的服务端收到握手消息后直接断开连接
+var ErrServerTooOld = errors.New("the server is too old, it does not support protocol version 2, upgrade the server")
+
+// capabilities 本端支持的能力列表, 握手时取双方交集
+var capabilities = []string{CAPMUX, CAPREUSE, CAPNEEDCONN, CAPDRAIN, CAPSERVICES}
+
+// HelloRequest 客户端握手消息, 随NEWCTRLCONN发送
+type HelloRequest struct {
+	Version      int               `json:"version"`         // 客户端支持的最高版本
+	MinVersion   int               `json:"minVersion"`      // 客户端支持的最低版本
+	ClientID     string            `json:"clientId"`        // 客户端实例ID
+	Capabilities []string          `json:"capabilities"`    // 客户端支持的能力
+	Services     []string          `json:"services"`        // 客户端提供的服务名
+	Ports        map[string]int    `json:"ports,omitempty"` // 请求服务端监听的远程端口, 服务名->端口, 0为任意空闲端口
+	Hosts        map[string]string `json:"hosts,omitempty"` // 按域名路由的服务, 域名->服务名
+}
+
+// HelloResponse 服务端握手响应, 随OK或REJECT返回
+type HelloResponse struct {
+	Version      int            `json:"version"`          // 服务端选定的版本
+	Capabilities []string       `json:"capabilities"`     // 双方都支持的能力
+	Reason       string         `json:"reason,omitempty"` // 拒绝原因
+	Ports        map[string]int `json:"ports,omitempty"`  // 服务端为客户端监听的远程端口
+}
+
+// newHelloRequest 构建本端的握手消息
+func newHelloRequest(clientID string, services []string, ports map[string]int, hosts map[string]string) HelloRequest {
+	return HelloRequest{
+		Hosts:        hosts,
+		Services:     services,
+		Ports:        ports,
+		Version:      PROTOCOLVERSION,
+		MinVersion:   MINPROTOCOLVERSION,
+		ClientID:     clientID,
+		Capabilities: capabilities,
+	}
+}
+
+// negotiateHello 根据客户端握手消息选定版本和能力, 无法兼容时返回拒绝原因
+func negotiateHello(req HelloRequest) (res HelloResponse, err error) {
+	if len(req.ClientID) == 0 {
+		return res, errors.New("client id is empty")
+	}
+	if err = checkServices(req); nil != err {
+		return res, err
+	}
+	if req.MinVersion == 0 {
+		req.MinVersion = req.Version
+	}
+	if req.Version < MINPROTOCOLVERSION || req.MinVersion > PROTOCOLVERSION {
+		return res, fmt.Errorf("unsupported protocol version: client supports %d-%d, server supports %d-%d",
+			req.MinVersion, req.Version, MINPROTOCOLVERSION, PROTOCOLVERSION)
+	}
+	res.Version = req.Version
+	if res.Version > PROTOCOLVERSION {
+		res.Version = PROTOCOLVERSION
+	}
+	res.Capabilities = intersectCapabilities(capabilities, req.Capabilities)
+	return res, nil
+}
+
+// checkServices 校验客户端请求的服务名、远程端口和域名路由
+func checkServices(req HelloRequest) (err error) {
+	for i := 0; i < len(req.Services); i++ {
+		if err = checkServiceName(req.Services[i]); nil != err {
+			return err
+		}
+	}
+	for name, port := range req.Ports {
+		if port < 0 || port > 65535 {
+			return fmt.Errorf("invalid remote port %d for service %s", port, name)
+		}
+		if !containsService(req.Services, name) && !(len(req.Services) == 0 && name == DEFAULTSERVICE) {
+			return errors.New("remote port is requested for unknown service " + name)
+		}
+	}
+	for host, name := range req.Hosts {
+		if err = checkHostName(host); nil != err {
+			return err
+		}
+		if !containsService(req.Services, name) && !(len(req.Services) == 0 && name == DEFAULTSERVICE) {
+			return errors.New("host " + host + " is routed to unknown service " + name)
+		}
+	}
+	return nil
+}
+
+// intersectCapabilities 取两个能力列表的交集
+func intersectCapabilities(a, b []string) []string {
+	res := make([]string, 0)
+	for i := 0; i < len(a); i++ {
+		for j := 0; j < len(b); j++ {
+			if a[i] == b[j] {
+				res = append(res, a[i])
+				break
+			}
+		}
+	}
+	return res
+}
+
+// hasCapability 能力列表中是否包含指定能力
+func hasCapability(caps []string, name string) bool {
+	for i := 0; i < len(caps); i++ {
+		if caps[i] == name {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeJSONArg 将结构体编码为命令参数
+func encodeJSONArg(v interface{}) string {
+	if buf, err := json.Marshal(v); nil == err {
+		return string(buf)
+	}
+	return ""
+}
+
+// decodeJSONArg 将命令参数解码为结构体
+func decodeJSONArg(arg string, v interface{}) error {
+	if len(arg) == 0 {
+		return errors.New("empty argument")
+	}
+	return json.Unmarshal([]byte(arg), v)
+}
@@ -0,0 +1,78 @@
+// Copyright (C) 2022 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package tunnelcomm
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNegotiateHello(t *testing.T) {
+	req := newHelloRequest("client-1", []string{"ssh", "rdp"}, map[string]int{"ssh": 0}, map[string]string{"*.example.com": "rdp"})
+	if res, err := negotiateHello(req); nil != err || res.Version != PROTOCOLVERSION {
+		t.Fatal(res, err)
+	}
+	// 新客户端兼容当前版本时, 选择当前版本
+	req.Version, req.MinVersion = PROTOCOLVERSION+3, MINPROTOCOLVERSION
+	if res, err := negotiateHello(req); nil != err || res.Version != PROTOCOLVERSION {
+		t.Fatal(res, err)
+	}
+	// 客户端要求的最低版本过高
+	req.MinVersion = PROTOCOLVERSION + 1
+	if _, err := negotiateHello(req); nil == err {
+		t.Fatal("expected version rejection")
+	}
+	// 客户端版本过低
+	req.Version, req.MinVersion = 1, 1
+	if _, err := negotiateHello(req); nil == err {
+		t.Fatal("expected version rejection")
+	}
+	// 服务名不合法
+	req = newHelloRequest("client-1", []string{"a b"}, nil, nil)
+	if _, err := negotiateHello(req); nil == err {
+		t.Fatal("expected service name rejection")
+	}
+	// 请求远程端口的服务不存在
+	req = newHelloRequest("client-1", []string{"ssh"}, map[string]int{"rdp": 3389}, nil)
+	if _, err := negotiateHello(req); nil == err {
+		t.Fatal("expected remote port rejection")
+	}
+	if caps := intersectCapabilities([]string{"a", "b"}, []string{"b", "c"}); len(caps) != 1 || caps[0] != "b" {
+		t.Fatal(caps)
+	}
+}
+
+func TestHelloServerTooOld(t *testing.T) {
+	// 版本1的服务端: 读取换行分隔的文本命令, 不认识的命令直接断开
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if nil != err {
+				return
+			}
+			conn.Read(make([]byte, 512))
+			conn.Close()
+		}
+	}()
+	client := NewTCPTunnelClient(listener.Addr().(*net.TCPAddr), 1, false)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err = client.Start(ctx); !errors.Is(err, ErrServerTooOld) {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright (C) 2022 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package tunnelcomm
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// HTTPHEADMAXLEN HTTP请求头的最大长度
+const HTTPHEADMAXLEN = 64 * 1024
+
+// ServeHTTPListener 接受HTTP用户连接, 根据请求的Host转发到对应服务, 监听或服务关闭后返回
+func (s *TCPTunnelService) ServeHTTPListener(listener net.Listener) error {
+	return s.serve(listener, false, s.handHTTPConn)
+}
+
+// handHTTPConn 读取请求头选择服务, 已读取的数据在隧道连接上重放
+func (s *TCPTunnelService) handHTTPConn(conn net.Conn) {
+	defer conn.Close()
+	if !s.trackConn(conn) {
+		return
+	}
+	defer s.conns.Delete(conn)
+	conn, err := s.readProxyConn(conn)
+	if nil != err {
+		return
+	}
+	host, head, err := readHTTPHost(conn)
+	if nil != err {
+		s.printInfo("Read HTTP request error: ", conn.RemoteAddr().String(), err.Error())
+		writeHTTPError(conn, http.StatusBadRequest, "The request could not be understood by the tunnel server.")
+		return
+	}
+	service := s.getHostService(host)
+	if len(service) == 0 {
+		writeHTTPError(conn, http.StatusNotFound, "No service is registered for host "+host+".")
+		return
+	}
+	if !s.forwardConn(&replayConn{Conn: conn, head: head}, service) {
+		writeHTTPError(conn, http.StatusBadGateway, "The service for host "+host+" is not available.")
+	}
+}
+
+// readHTTPHost 读取HTTP请求头并返回Host, 同时返回已从连接读取的全部数据
+func readHTTPHost(conn net.Conn) (host string, head []byte, err error) {
+	var buf bytes.Buffer
+	conn.SetReadDeadline(time.Now().Add(CMDRTIMEOUT))
+	defer conn.SetReadDeadline(time.Time{})
+	reader := io.TeeReader(io.LimitReader(conn, HTTPHEADMAXLEN), &buf)
+	var req *http.Request
+	if req, err = http.ReadRequest(bufio.NewReader(reader)); nil != err {
+		return host, buf.Bytes(), err
+	}
+	if host = req.Host; len(host) == 0 {
+		return host, buf.Bytes(), errors.New("missing host header")
+	}
+	if hostname, _, err := net.SplitHostPort(host); nil == err {
+		host = hostname
+	}
+	return host, buf.Bytes(), nil
+}
+
+// writeHTTPError 返回错误页面
+func writeHTTPError(conn net.Conn, code int, message string) {
+	body := fmt.Sprintf("<html><head><title>%d %s</title></head><body><h1>%d %s</h1><p>%s</p></body></html>\n",
+		code, http.StatusText(code), code, http.StatusText(code), message)
+	conn.SetWriteDeadline(time.Now().Add(CMDWTIMEOUT))
+	fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nContent-Type: text/html; charset=utf-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s",
+		code, http.StatusText(code), len(body), body)
+}
+
+// replayConn 先返回已读取的数据, 再读取连接
+type replayConn struct {
+	net.Conn
+	head []byte
+}
+
+// Read 先读取重放数据
+func (c *replayConn) Read(p []byte) (int, error) {
+	if len(c.head) > 0 {
+		n := copy(p, c.head)
+		c.head = c.head[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+// CloseWrite 半关闭底层连接
+func (c *replayConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
@@ -0,0 +1,70 @@
+// Copyright (C) 2022 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package tunnelcomm
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestServeHTTPListener(t *testing.T) {
+	service, addr := startTestService(t)
+	client := NewTCPTunnelClient(addr, 2, false)
+	client.SetToken("secret")
+	client.SetServices("web", "api")
+	client.SetHosts(map[string]string{"web.example.com": "web", "*.example.com": "api"})
+	// 回写服务名和完整的请求内容, 验证已读取的请求头被重放
+	client.SetTransportCallback(func(info TransportInfo, conn net.Conn, release func() error) error {
+		if req, err := http.ReadRequest(bufio.NewReader(conn)); nil == err {
+			body, _ := io.ReadAll(req.Body)
+			res := info.Service + " " + req.Host + " " + string(body)
+			fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", len(res), res)
+		}
+		return release()
+	})
+	go client.Start(context.Background())
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go service.ServeHTTPListener(listener)
+	waitConn(t, service, "web").Close()
+
+	for host, want := range map[string]string{
+		"web.example.com":     "web web.example.com hello",
+		"a.example.com:8080":  "api a.example.com:8080 hello",
+		"unknown.example.org": "404",
+		"WEB.EXAMPLE.COM.":    "web WEB.EXAMPLE.COM. hello",
+		"deep.a.example.com":  "api deep.a.example.com hello",
+	} {
+		req, _ := http.NewRequest("POST", "http://"+listener.Addr().String()+"/", strings.NewReader("hello"))
+		req.Host = host
+		res, err := http.DefaultTransport.RoundTrip(req)
+		if nil != err {
+			t.Fatal(host, err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if want == "404" {
+			if res.StatusCode != http.StatusNotFound {
+				t.Fatal(host, res.StatusCode)
+			}
+		} else if string(body) != want {
+			t.Fatal(host, string(body))
+		}
+	}
+}
@@ -0,0 +1,269 @@
+// Copyright (C) 2022 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package tunnelcomm
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/wup364/pakku/utils/logs"
+)
+
+const (
+	// ACCEPTMAXDELAY 监听临时错误时的最大重试间隔
+	ACCEPTMAXDELAY = time.Second
+	// DRAINPOLLINTERVAL 等待活动连接结束时的检查间隔
+	DRAINPOLLINTERVAL = 100 * time.Millisecond
+)
+
+// ErrServiceClosed 隧道服务已关闭
+var ErrServiceClosed = errors.New("tunnel service closed")
+
+// ErrClientClosed 隧道客户端已关闭
+var ErrClientClosed = errors.New("tunnel client closed")
+
+// acceptDelay 计算下一次重试的等待时间, 从5毫秒开始翻倍, 不超过ACCEPTMAXDELAY
+func acceptDelay(delay time.Duration) time.Duration {
+	if delay == 0 {
+		return 5 * time.Millisecond
+	}
+	if delay *= 2; delay > ACCEPTMAXDELAY {
+		delay = ACCEPTMAXDELAY
+	}
+	return delay
+}
+
+// waitDrain 等待活动连接数归零, ctx结束时返回ctx的错误
+func waitDrain(ctx context.Context, active func() int) error {
+	ticker := time.NewTicker(DRAINPOLLINTERVAL)
+	defer ticker.Stop()
+	for active() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// closeAll 关闭集合中的全部对象
+func closeAll(values []interface{}) {
+	for i := 0; i < len(values); i++ {
+		values[i].(io.Closer).Close()
+	}
+}
+
+// isClosed 服务是否已关闭
+func (s *TCPTunnelService) isClosed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// isDraining 服务是否正在排空, 排空后不再接受新的用户连接
+func (s *TCPTunnelService) isDraining() bool {
+	select {
+	case <-s.draining:
+		return true
+	default:
+		return false
+	}
+}
+
+// trackListener 记录正在服务的监听, tunnel为true时是隧道端口, 否则是用户端口
+// 隧道端口在服务关闭后、用户端口在开始排空后不再接受, 关闭监听并返回false
+func (s *TCPTunnelService) trackListener(listener io.Closer, tunnel bool) bool {
+	set, stop := s.listeners, s.draining
+	if tunnel {
+		set, stop = s.tunnels, s.done
+	}
+	set.Put(listener, listener)
+	select {
+	case <-stop:
+		set.Delete(listener)
+		listener.Close()
+		return false
+	default:
+		return true
+	}
+}
+
+// untrackListener 删除监听记录
+func (s *TCPTunnelService) untrackListener(listener io.Closer, tunnel bool) {
+	if tunnel {
+		s.tunnels.Delete(listener)
+	} else {
+		s.listeners.Delete(listener)
+	}
+}
+
+// trackConn 记录正在处理的用户连接, 服务已关闭时返回false
+func (s *TCPTunnelService) trackConn(conn net.Conn) bool {
+	s.conns.Put(conn, conn)
+	if s.isClosed() {
+		s.conns.Delete(conn)
+		return false
+	}
+	return true
+}
+
+// serve 接受连接并交给handle处理, 服务关闭、排空或监听被关闭后返回, 其他错误退避后重试
+func (s *TCPTunnelService) serve(listener net.Listener, tunnel bool, handle func(conn net.Conn)) error {
+	if !s.trackListener(listener, tunnel) {
+		return ErrServiceClosed
+	}
+	defer s.untrackListener(listener, tunnel)
+	var delay time.Duration
+	for {
+		conn, err := listener.Accept()
+		if nil != err {
+			if s.isClosed() || (!tunnel && s.isDraining()) {
+				return ErrServiceClosed
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			delay = acceptDelay(delay)
+			s.printInfo("Accept error: ", err.Error())
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		go handle(conn)
+	}
+}
+
+// Drain 排空服务: 关闭用户端口不再接受新的用户连接, 通知客户端停止补充隧道连接, 然后等待正在转发的用户连接结束
+// 客户端的控制通道保持连接, ctx结束时不再等待并返回ctx的错误, 剩余的用户连接不受影响
+func (s *TCPTunnelService) Drain(ctx context.Context) error {
+	s.drainOnce.Do(func() {
+		close(s.draining)
+		logs.Infof("tunnel service is draining, active=%d\r\n", s.conns.Size())
+		// 之后注册的客户端在握手时通知
+		s.lock.Lock()
+		clients := s.clients.Values()
+		s.lock.Unlock()
+		for i := 0; i < len(clients); i++ {
+			s.pushDrain(clients[i].(*clientSession))
+		}
+	})
+	closeAll(s.listeners.Values())
+	s.listeners.Clear()
+	return waitDrain(ctx, s.conns.Size)
+}
+
+// pushDrain 通知客户端服务正在排空
+func (s *TCPTunnelService) pushDrain(client *clientSession) {
+	if err := client.push(CAPDRAIN, CTRLCMD.DRAIN); nil != err {
+		s.printInfo("Push drain error: ", client.id, err.Error())
+	}
+}
+
+// Shutdown 关闭服务: 关闭隧道端口, 排空用户连接, 然后断开所有客户端
+// ctx结束时不再等待, 直接关闭剩余的用户连接并返回ctx的错误
+func (s *TCPTunnelService) Shutdown(ctx context.Context) (err error) {
+	s.closeOnce.Do(func() { close(s.done) })
+	closeAll(s.tunnels.Values())
+	s.tunnels.Clear()
+	if err = s.Drain(ctx); nil != err {
+		closeAll(s.conns.Values())
+	}
+	// 等待正在注册的客户端完成注册
+	s.lock.Lock()
+	clients := s.clients.Values()
+	s.lock.Unlock()
+	for i := 0; i < len(clients); i++ {
+		s.removeClient(clients[i].(*clientSession))
+	}
+	return err
+}
+
+// Detach 交出服务, 用于升级时新进程已接管监听后调用: 关闭全部监听, 断开客户端使其重连到新进程,
+// 正在转发的用户连接及其多路复用会话保留到结束; ctx结束时不再等待, 关闭剩余的连接并返回ctx的错误
+func (s *TCPTunnelService) Detach(ctx context.Context) (err error) {
+	s.closeOnce.Do(func() { close(s.done) })
+	closeAll(s.tunnels.Values())
+	s.tunnels.Clear()
+	closeAll(s.listeners.Values())
+	s.listeners.Clear()
+	s.lock.Lock()
+	clients := s.clients.Values()
+	s.lock.Unlock()
+	var sessions []interface{}
+	for i := 0; i < len(clients); i++ {
+		client := clients[i].(*clientSession)
+		// 没有数据流的会话随客户端关闭, 客户端可以立即在新进程建立会话
+		keys := client.sessions.Keys()
+		for j := 0; j < len(keys); j++ {
+			if val, ok := client.sessions.Get(keys[j]); ok && val.(*MuxSession).NumStreams() > 0 {
+				sessions = append(sessions, val)
+				client.sessions.Delete(keys[j])
+			}
+		}
+		s.removeClient(client)
+	}
+	logs.Infof("tunnel service is detached, active=%d\r\n", s.conns.Size())
+	if err = waitDrain(ctx, s.conns.Size); nil != err {
+		closeAll(s.conns.Values())
+	}
+	closeAll(sessions)
+	return err
+}
+
+// Close 立即关闭服务, 不等待用户连接结束
+func (s *TCPTunnelService) Close() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.Shutdown(ctx); nil != err && !errors.Is(err, context.Canceled) {
+		return err
+	}
+	return nil
+}
+
+// isClosed 客户端是否已关闭
+func (c *TCPTunnelClient) isClosed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Shutdown 关闭客户端: 关闭空闲连接并不再开始新的传输, 等待正在传输的连接结束, 然后断开控制连接
+// ctx结束时不再等待, 直接关闭全部连接并返回ctx的错误; 关闭后Start返回ErrClientClosed
+func (c *TCPTunnelClient) Shutdown(ctx context.Context) (err error) {
+	c.closeOnce.Do(func() { close(c.done) })
+	c.conns.DoRange(func(key, val interface{}) error {
+		if val.(bool) {
+			key.(net.Conn).Close()
+		}
+		return nil
+	})
+	err = waitDrain(ctx, func() int {
+		return int(atomic.LoadInt64(&c.active))
+	})
+	closeAll(c.conns.Keys())
+	closeAll(c.sessions.Values())
+	c.lock.Lock()
+	if nil != c.ctlConn {
+		c.ctlConn.Close()
+	}
+	c.lock.Unlock()
+	return err
+}
@@ -0,0 +1,244 @@
+// Copyright (C) 2022 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package tunnelcomm
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startSlowService 启动隧道服务和回调延迟delay后应答的客户端, 返回服务和用户端口
+func startSlowService(t *testing.T, delay time.Duration) (*TCPTunnelService, *TCPTunnelClient, net.Listener, chan error) {
+	service, addr := startTestService(t)
+	client := NewTCPTunnelClient(addr, 1, false)
+	client.SetToken("secret")
+	client.SetServices("web")
+	client.SetTransportCallback(func(info TransportInfo, conn net.Conn, release func() error) error {
+		time.Sleep(delay)
+		conn.Write([]byte("done"))
+		return release()
+	})
+	go client.Start(context.Background())
+	for i := 0; i < 50 && service.CountConn("web") == 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- service.ServeListener(listener, "web") }()
+	return service, client, listener, served
+}
+
+func TestServiceShutdown(t *testing.T) {
+	service, _, listener, served := startSlowService(t, 500*time.Millisecond)
+	user, err := net.Dial("tcp", listener.Addr().String())
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer user.Close()
+	user.(*net.TCPConn).CloseWrite()
+	time.Sleep(100 * time.Millisecond)
+	// 等待正在转发的用户连接结束
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err = service.Shutdown(ctx); nil != err {
+		t.Fatal(err)
+	}
+	if got, _ := io.ReadAll(user); string(got) != "done" {
+		t.Fatal(string(got))
+	}
+	if err = <-served; !errors.Is(err, ErrServiceClosed) {
+		t.Fatal(err)
+	}
+	if err = service.Start(context.Background()); !errors.Is(err, ErrServiceClosed) {
+		t.Fatal(err)
+	}
+	if len(service.GetClients()) != 0 {
+		t.Fatal("clients are not disconnected")
+	}
+}
+
+func TestServiceShutdownDeadline(t *testing.T) {
+	service, _, listener, _ := startSlowService(t, 3*time.Second)
+	user, err := net.Dial("tcp", listener.Addr().String())
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer user.Close()
+	user.(*net.TCPConn).CloseWrite()
+	time.Sleep(100 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err = service.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal(err)
+	}
+	// 超时后用户连接被关闭
+	user.SetReadDeadline(time.Now().Add(time.Second))
+	if got, err := io.ReadAll(user); nil != err || len(got) != 0 {
+		t.Fatal(string(got), err)
+	}
+}
+
+func TestClientShutdown(t *testing.T) {
+	_, client, listener, _ := startSlowService(t, 500*time.Millisecond)
+	user, err := net.Dial("tcp", listener.Addr().String())
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer user.Close()
+	user.(*net.TCPConn).CloseWrite()
+	time.Sleep(100 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err = client.Shutdown(ctx); nil != err {
+		t.Fatal(err)
+	}
+	if got, _ := io.ReadAll(user); string(got) != "done" {
+		t.Fatal(string(got))
+	}
+	if err = client.Start(context.Background()); !errors.Is(err, ErrClientClosed) {
+		t.Fatal(err)
+	}
+	// ctx结束时断开控制连接
+	service, addr := startTestService(t)
+	client = newTestClient(addr, "branch1", "web")
+	ctx, cancel = context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() { result <- client.Start(ctx) }()
+	for i := 0; i < 50 && len(service.GetClients()) == 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	cancel()
+	select {
+	case err = <-result:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("client is not stopped")
+	}
+}
+
+func TestServiceDrain(t *testing.T) {
+	service, client, listener, served := startSlowService(t, 500*time.Millisecond)
+	user, err := net.Dial("tcp", listener.Addr().String())
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer user.Close()
+	user.(*net.TCPConn).CloseWrite()
+	time.Sleep(100 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err = service.Drain(ctx); nil != err {
+		t.Fatal(err)
+	}
+	if got, _ := io.ReadAll(user); string(got) != "done" {
+		t.Fatal(string(got))
+	}
+	// 用户端口已关闭, 客户端收到排空通知, 控制通道保持连接
+	if err = <-served; !errors.Is(err, ErrServiceClosed) {
+		t.Fatal(err)
+	}
+	if _, err = net.Dial("tcp", listener.Addr().String()); nil == err {
+		t.Fatal("user listener is not closed")
+	}
+	if !client.isDraining() || len(service.GetClients()) != 1 {
+		t.Fatal("client is not notified")
+	}
+	if err = service.Shutdown(ctx); nil != err {
+		t.Fatal(err)
+	}
+}
+
+func TestServiceDetach(t *testing.T) {
+	t.Run("pool", func(t *testing.T) { testServiceDetach(t, 0) })
+	t.Run("mux", func(t *testing.T) { testServiceDetach(t, 1) })
+}
+
+// testServiceDetach 交出服务后客户端重连到接管地址的新服务, 原服务上正在转发的用户连接继续到结束
+func testServiceDetach(t *testing.T, muxConns int) {
+	service, addr := startTestService(t)
+	client := NewTCPTunnelClient(addr, 1, false)
+	client.SetToken("secret")
+	client.SetServices("web")
+	client.SetMuxConns(muxConns)
+	client.SetTransportCallback(func(info TransportInfo, conn net.Conn, release func() error) error {
+		time.Sleep(2 * time.Second)
+		conn.Write([]byte("done"))
+		return release()
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		for nil == ctx.Err() {
+			client.Start(ctx)
+			time.Sleep(100 * time.Millisecond)
+		}
+	}()
+	// 隧道连接或多路复用会话可用
+	ready := func(service *TCPTunnelService) bool {
+		session := service.getRoute("web")
+		return nil != session && (session.countConn("web") > 0 || session.sessions.Size() > 0)
+	}
+	for i := 0; i < 50 && !ready(service); i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- service.ServeListener(listener, "web") }()
+	user, err := net.Dial("tcp", listener.Addr().String())
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer user.Close()
+	user.(*net.TCPConn).CloseWrite()
+	time.Sleep(100 * time.Millisecond)
+	dctx, dcancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer dcancel()
+	detached := make(chan error, 1)
+	go func() { detached <- service.Detach(dctx) }()
+	// 客户端立即断开, 正在转发的用户连接继续
+	for i := 0; i < 50 && len(service.GetClients()) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(service.GetClients()) != 0 {
+		t.Fatal("clients are not disconnected")
+	}
+	if err = <-served; !errors.Is(err, ErrServiceClosed) {
+		t.Fatal(err)
+	}
+	// 新服务接管隧道地址, 客户端在原用户连接结束前就在新服务上准备好连接
+	next := NewTCPTunnelService(addr, false)
+	next.SetToken("secret")
+	go next.Start(context.Background())
+	defer next.Close()
+	for i := 0; i < 100 && !ready(next); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !ready(next) {
+		t.Fatal("client is not ready on the new service")
+	}
+	if got, _ := io.ReadAll(user); string(got) != "done" {
+		t.Fatal(string(got))
+	}
+	if err = <-detached; nil != err {
+		t.Fatal(err)
+	}
+}
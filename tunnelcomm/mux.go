@@ -0,0 +1,554 @@
+// Copyright (C) 2022 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package tunnelcomm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// CAPMUX 多路复用能力
+	CAPMUX = "mux"
+	// MUXWINDOWSIZE 每个逻辑流的接收窗口大小
+	MUXWINDOWSIZE = 256 * 1024
+	// MUXMAXDATA 单个数据帧的最大负载
+	MUXMAXDATA = 16 * 1024
+	// MUXKEEPALIVE 物理连接心跳间隔, 超过3个间隔没有收到任何数据视为断开
+	MUXKEEPALIVE = time.Second * 15
+	// MUXBACKLOG 等待Accept的逻辑流个数
+	MUXBACKLOG = 256
+	// MUXMAXSTREAMS 单个会话同时打开的逻辑流上限
+	MUXMAXSTREAMS = 1024
+)
+
+// muxFrame 多路复用帧类型, 负载为4字节流ID + 内容
+var muxFrame = struct {
+	OPEN   byte // 打开流, 内容为参数列表
+	DATA   byte // 数据
+	WINDOW byte // 窗口更新, 内容为4字节增量
+	FIN    byte // 发送方不再发送数据
+	RST    byte // 强制关闭流
+	PING   byte // 心跳
+	PONG   byte // 心跳响应
+}{'o', 'd', 'w', 'f', 'r', 'p', 'q'}
+
+// ErrMuxSessionClosed 物理连接已关闭
+var ErrMuxSessionClosed = errors.New("mux session closed")
+
+// ErrMuxStreamReset 逻辑流被对端重置
+var ErrMuxStreamReset = errors.New("mux stream reset by peer")
+
+// muxTimeoutError 读写超时, 实现net.Error
+type muxTimeoutError struct{}
+
+func (muxTimeoutError) Error() string   { return "i/o timeout" }
+func (muxTimeoutError) Timeout() bool   { return true }
+func (muxTimeoutError) Temporary() bool { return true }
+
+// NewMuxSession 在物理连接上创建多路复用会话, 发起连接的一方isClient为true, 双方使用不同奇偶的流ID
+func NewMuxSession(conn net.Conn, isClient bool) *MuxSession {
+	s := &MuxSession{
+		conn:     conn,
+		dec:      NewFrameDecoder(conn),
+		streams:  make(map[uint32]*MuxStream),
+		accepts:  make(chan *MuxStream, MUXBACKLOG),
+		closed:   make(chan struct{}),
+		isClient: isClient,
+		nextID:   2,
+		lastRead: time.Now().UnixNano(),
+	}
+	if isClient {
+		s.nextID = 1
+	}
+	go s.readLoop()
+	go s.keepalive()
+	return s
+}
+
+// MuxSession 多路复用会话, 一个物理连接上承载多个逻辑流
+type MuxSession struct {
+	conn      net.Conn
+	dec       *FrameDecoder
+	wlock     sync.Mutex // 写锁, 保证帧完整写入
+	olock     sync.Mutex // 打开锁, 保证OPEN帧按流ID递增的顺序发送
+	lock      sync.Mutex
+	streams   map[uint32]*MuxStream
+	isClient  bool
+	nextID    uint32
+	remoteID  uint32 // 对端最后打开的流ID, 对端的流ID必须递增
+	lastRead  int64  // 最后收到帧的时间, UnixNano
+	accepts   chan *MuxStream
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Open 打开一个逻辑流, args会随OPEN帧发送给对端
+func (s *MuxSession) Open(args ...string) (*MuxStream, error) {
+	if s.IsClosed() {
+		return nil, ErrMuxSessionClosed
+	}
+	s.olock.Lock()
+	defer s.olock.Unlock()
+	s.lock.Lock()
+	if len(s.streams) >= MUXMAXSTREAMS {
+		s.lock.Unlock()
+		return nil, errors.New("too many mux streams")
+	}
+	id := s.nextID
+	s.nextID += 2
+	stream := newMuxStream(id, s, args)
+	s.streams[id] = stream
+	s.lock.Unlock()
+	if err := s.writeFrame(muxFrame.OPEN, id, EncodeArgs(args...)); nil != err {
+		s.removeStream(id)
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Accept 等待对端打开的逻辑流
+func (s *MuxSession) Accept() (*MuxStream, error) {
+	select {
+	case stream := <-s.accepts:
+		return stream, nil
+	case <-s.closed:
+		return nil, ErrMuxSessionClosed
+	}
+}
+
+// NumStreams 当前逻辑流个数
+func (s *MuxSession) NumStreams() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.streams)
+}
+
+// Available 会话是否可以打开新的逻辑流: 未关闭、逻辑流未达到上限且最近收到过对端的心跳
+func (s *MuxSession) Available() bool {
+	if s.IsClosed() || time.Since(time.Unix(0, atomic.LoadInt64(&s.lastRead))) > MUXKEEPALIVE*2 {
+		return false
+	}
+	return s.NumStreams() < MUXMAXSTREAMS
+}
+
+// IsClosed 会话是否已关闭
+func (s *MuxSession) IsClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Done 会话关闭时返回
+func (s *MuxSession) Done() <-chan struct{} {
+	return s.closed
+}
+
+// RemoteAddr 物理连接的对端地址
+func (s *MuxSession) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+// Close 关闭会话和所有逻辑流
+func (s *MuxSession) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		s.conn.Close()
+		s.lock.Lock()
+		s.streams = make(map[uint32]*MuxStream)
+		s.lock.Unlock()
+	})
+	return nil
+}
+
+// readLoop 读取帧并分发给逻辑流, 需要写入的响应都异步发送, 避免双方同时写满缓冲区时互相阻塞
+func (s *MuxSession) readLoop() {
+	defer s.Close()
+	for {
+		if err := s.conn.SetReadDeadline(time.Now().Add(MUXKEEPALIVE * 3)); nil != err {
+			return
+		}
+		frame, err := s.dec.Decode()
+		if nil != err || len(frame.Payload) < 4 {
+			return
+		}
+		atomic.StoreInt64(&s.lastRead, time.Now().UnixNano())
+		id, body := binary.BigEndian.Uint32(frame.Payload[:4]), frame.Payload[4:]
+		switch frame.Type {
+		case muxFrame.OPEN:
+			// 对端的流ID必须与本端奇偶不同且递增, 否则视为协议错误
+			if id == 0 || (id%2 == 1) == s.isClient || id <= s.remoteID {
+				return
+			}
+			s.remoteID = id
+			args, _ := DecodeArgs(body)
+			stream := newMuxStream(id, s, args)
+			s.lock.Lock()
+			full := len(s.streams) >= MUXMAXSTREAMS
+			if !full {
+				s.streams[id] = stream
+			}
+			s.lock.Unlock()
+			if full {
+				go s.writeFrame(muxFrame.RST, id, nil)
+				continue
+			}
+			select {
+			case s.accepts <- stream:
+			default:
+				go stream.Close()
+			}
+		case muxFrame.DATA:
+			if stream := s.getStream(id); nil != stream {
+				if !stream.pushData(body) {
+					go stream.Close()
+				}
+			} else {
+				go s.writeFrame(muxFrame.RST, id, nil)
+			}
+		case muxFrame.WINDOW:
+			if stream := s.getStream(id); nil != stream && len(body) >= 4 {
+				stream.addWindow(binary.BigEndian.Uint32(body))
+			}
+		case muxFrame.FIN:
+			if stream := s.getStream(id); nil != stream {
+				stream.remoteClose()
+			}
+		case muxFrame.RST:
+			if stream := s.getStream(id); nil != stream {
+				stream.remoteReset()
+			}
+		case muxFrame.PING:
+			go s.writeFrame(muxFrame.PONG, id, nil)
+		case muxFrame.PONG:
+		default:
+			return
+		}
+	}
+}
+
+// keepalive 定时发送心跳
+func (s *MuxSession) keepalive() {
+	ticker := time.NewTicker(MUXKEEPALIVE)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.writeFrame(muxFrame.PING, 0, nil); nil != err {
+				return
+			}
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+// writeFrame 写入一个帧, 写入失败时关闭会话
+func (s *MuxSession) writeFrame(typ byte, id uint32, body []byte) (err error) {
+	if s.IsClosed() {
+		return ErrMuxSessionClosed
+	}
+	payload := make([]byte, 4+len(body))
+	binary.BigEndian.PutUint32(payload, id)
+	copy(payload[4:], body)
+	s.wlock.Lock()
+	defer s.wlock.Unlock()
+	if err = s.conn.SetWriteDeadline(time.Now().Add(CMDWTIMEOUT)); nil == err {
+		err = NewFrameEncoder(s.conn).Encode(Frame{Type: typ, Payload: payload})
+	}
+	if nil != err {
+		s.Close()
+	}
+	return err
+}
+
+// getStream 获取逻辑流
+func (s *MuxSession) getStream(id uint32) *MuxStream {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.streams[id]
+}
+
+// removeStream 移除逻辑流
+func (s *MuxSession) removeStream(id uint32) {
+	s.lock.Lock()
+	delete(s.streams, id)
+	s.lock.Unlock()
+}
+
+// newMuxStream 实例化逻辑流
+func newMuxStream(id uint32, session *MuxSession, args []string) *MuxStream {
+	return &MuxStream{
+		id:         id,
+		session:    session,
+		args:       args,
+		sendWindow: MUXWINDOWSIZE,
+		recvNotify: make(chan struct{}, 1),
+		sendNotify: make(chan struct{}, 1),
+	}
+}
+
+// MuxStream 多路复用的逻辑流, 实现net.Conn, 每个流有独立的流控窗口
+// CloseWrite发送FIN表示不再发送数据; Close时如果对端尚未结束发送则发送RST
+type MuxStream struct {
+	id            uint32
+	session       *MuxSession
+	args          []string
+	lock          sync.Mutex
+	buf           bytes.Buffer  // 接收缓冲区
+	consumed      uint32        // 已读取但尚未通知对端的字节数
+	sendWindow    uint32        // 对端剩余接收窗口
+	recvNotify    chan struct{} // 有新数据或状态变化
+	sendNotify    chan struct{} // 窗口更新或状态变化
+	localFin      bool
+	remoteFin     bool
+	reset         bool
+	closed        bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+// ID 流ID
+func (st *MuxStream) ID() uint32 {
+	return st.id
+}
+
+// Args 打开流时携带的参数
+func (st *MuxStream) Args() []string {
+	return st.args
+}
+
+// Read 读取数据, 对端发送FIN且缓冲区读完后返回io.EOF
+func (st *MuxStream) Read(p []byte) (n int, err error) {
+	for {
+		st.lock.Lock()
+		if st.buf.Len() > 0 {
+			n, _ = st.buf.Read(p)
+			st.consumed += uint32(n)
+			var inc uint32
+			if st.consumed >= MUXWINDOWSIZE/2 && !st.remoteFin {
+				inc, st.consumed = st.consumed, 0
+			}
+			st.lock.Unlock()
+			if inc > 0 {
+				window := make([]byte, 4)
+				binary.BigEndian.PutUint32(window, inc)
+				st.session.writeFrame(muxFrame.WINDOW, st.id, window)
+			}
+			return n, nil
+		}
+		if st.closed {
+			st.lock.Unlock()
+			return 0, io.ErrClosedPipe
+		} else if st.remoteFin {
+			st.lock.Unlock()
+			return 0, io.EOF
+		} else if st.reset {
+			st.lock.Unlock()
+			return 0, ErrMuxStreamReset
+		}
+		deadline := st.readDeadline
+		st.lock.Unlock()
+		if err = st.wait(st.recvNotify, deadline); nil != err {
+			return 0, err
+		}
+	}
+}
+
+// Write 写入数据, 对端接收窗口用尽时阻塞
+func (st *MuxStream) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		st.lock.Lock()
+		if st.closed || st.localFin {
+			st.lock.Unlock()
+			return n, io.ErrClosedPipe
+		} else if st.reset {
+			st.lock.Unlock()
+			return n, ErrMuxStreamReset
+		}
+		if st.sendWindow == 0 {
+			deadline := st.writeDeadline
+			st.lock.Unlock()
+			if err = st.wait(st.sendNotify, deadline); nil != err {
+				return n, err
+			}
+			continue
+		}
+		size := uint32(len(p))
+		if size > st.sendWindow {
+			size = st.sendWindow
+		}
+		if size > MUXMAXDATA {
+			size = MUXMAXDATA
+		}
+		st.sendWindow -= size
+		st.lock.Unlock()
+		if err = st.session.writeFrame(muxFrame.DATA, st.id, p[:size]); nil != err {
+			return n, err
+		}
+		n += int(size)
+		p = p[size:]
+	}
+	return n, err
+}
+
+// CloseWrite 发送FIN, 对端读完数据后收到io.EOF
+func (st *MuxStream) CloseWrite() error {
+	st.lock.Lock()
+	if st.closed || st.localFin || st.reset {
+		st.lock.Unlock()
+		return nil
+	}
+	st.localFin = true
+	st.lock.Unlock()
+	notifyChan(st.sendNotify)
+	return st.session.writeFrame(muxFrame.FIN, st.id, nil)
+}
+
+// Close 关闭流, 对端尚未结束发送时发送RST以释放对端的读写等待
+func (st *MuxStream) Close() (err error) {
+	st.lock.Lock()
+	if st.closed {
+		st.lock.Unlock()
+		return nil
+	}
+	st.closed = true
+	sendRst := !st.remoteFin && !st.reset
+	sendFin := !sendRst && !st.localFin && !st.reset
+	st.localFin = true
+	st.lock.Unlock()
+	notifyChan(st.recvNotify)
+	notifyChan(st.sendNotify)
+	st.session.removeStream(st.id)
+	if sendRst {
+		err = st.session.writeFrame(muxFrame.RST, st.id, nil)
+	} else if sendFin {
+		err = st.session.writeFrame(muxFrame.FIN, st.id, nil)
+	}
+	return err
+}
+
+// LocalAddr 物理连接的本地地址
+func (st *MuxStream) LocalAddr() net.Addr {
+	return st.session.conn.LocalAddr()
+}
+
+// RemoteAddr 物理连接的对端地址
+func (st *MuxStream) RemoteAddr() net.Addr {
+	return st.session.conn.RemoteAddr()
+}
+
+// SetDeadline 设置读写超时
+func (st *MuxStream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+// SetReadDeadline 设置读超时
+func (st *MuxStream) SetReadDeadline(t time.Time) error {
+	st.lock.Lock()
+	st.readDeadline = t
+	st.lock.Unlock()
+	notifyChan(st.recvNotify)
+	return nil
+}
+
+// SetWriteDeadline 设置写超时
+func (st *MuxStream) SetWriteDeadline(t time.Time) error {
+	st.lock.Lock()
+	st.writeDeadline = t
+	st.lock.Unlock()
+	notifyChan(st.sendNotify)
+	return nil
+}
+
+// pushData 收到数据, 超出接收窗口时返回false
+func (st *MuxStream) pushData(body []byte) bool {
+	st.lock.Lock()
+	defer notifyChan(st.recvNotify)
+	defer st.lock.Unlock()
+	if st.closed || st.remoteFin {
+		return true
+	}
+	if st.buf.Len()+len(body) > MUXWINDOWSIZE {
+		return false
+	}
+	st.buf.Write(body)
+	return true
+}
+
+// addWindow 对端窗口更新
+func (st *MuxStream) addWindow(inc uint32) {
+	st.lock.Lock()
+	st.sendWindow += inc
+	st.lock.Unlock()
+	notifyChan(st.sendNotify)
+}
+
+// remoteClose 对端发送FIN
+func (st *MuxStream) remoteClose() {
+	st.lock.Lock()
+	st.remoteFin = true
+	finished := st.localFin
+	st.lock.Unlock()
+	notifyChan(st.recvNotify)
+	if finished {
+		st.session.removeStream(st.id)
+	}
+}
+
+// remoteReset 对端发送RST
+func (st *MuxStream) remoteReset() {
+	st.lock.Lock()
+	st.reset = true
+	st.lock.Unlock()
+	notifyChan(st.recvNotify)
+	notifyChan(st.sendNotify)
+	st.session.removeStream(st.id)
+}
+
+// wait 等待通知、超时或会话关闭
+func (st *MuxStream) wait(notify chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return muxTimeoutError{}
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-notify:
+		return nil
+	case <-timeout:
+		return muxTimeoutError{}
+	case <-st.session.closed:
+		return ErrMuxSessionClosed
+	}
+}
+
+// notifyChan 非阻塞通知
+func notifyChan(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright (C) 2022 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package tunnelcomm
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newMuxPair 创建一对通过本地TCP连接的会话
+func newMuxPair(t *testing.T) (client, server *MuxSession) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := listener.Accept()
+		accepted <- conn
+	}()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if nil != err {
+		t.Fatal(err)
+	}
+	client, server = NewMuxSession(conn, true), NewMuxSession(<-accepted, false)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestMuxStreamEcho(t *testing.T) {
+	client, server := newMuxPair(t)
+	// 客户端回显所有流的数据
+	go func() {
+		for {
+			stream, err := client.Accept()
+			if nil != err {
+				return
+			}
+			go func() {
+				io.Copy(stream, stream)
+				stream.CloseWrite()
+			}()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stream, err := server.Open("svc")
+			if nil != err {
+				t.Error(err)
+				return
+			}
+			defer stream.Close()
+			// 大于接收窗口的数据, 验证流控
+			data := make([]byte, MUXWINDOWSIZE*3+123)
+			rand.Read(data)
+			go func() {
+				stream.Write(data)
+				stream.CloseWrite()
+			}()
+			stream.SetReadDeadline(time.Now().Add(10 * time.Second))
+			if echo, err := io.ReadAll(stream); nil != err || !bytes.Equal(echo, data) {
+				t.Error("echo mismatch", len(echo), err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestMuxStreamClose(t *testing.T) {
+	client, server := newMuxPair(t)
+	stream, err := server.Open("a", "b")
+	if nil != err {
+		t.Fatal(err)
+	}
+	remote, err := client.Accept()
+	if nil != err {
+		t.Fatal(err)
+	}
+	if args := remote.Args(); len(args) != 2 || args[0] != "a" || args[1] != "b" {
+		t.Fatal(args)
+	}
+	// 对端未结束发送时关闭, 对端收到RST
+	stream.Close()
+	remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = remote.Read(make([]byte, 1)); err != ErrMuxStreamReset {
+		t.Fatal(err)
+	}
+	// 读超时
+	stream, _ = server.Open()
+	stream.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err = stream.Read(make([]byte, 1)); nil == err {
+		t.Fatal("expected timeout")
+	} else if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatal(err)
+	}
+	// 会话关闭后读写返回错误
+	client.Close()
+	stream.SetReadDeadline(time.Time{})
+	if _, err = stream.Read(make([]byte, 1)); nil == err {
+		t.Fatal("expected session closed")
+	}
+}
+
+func TestMuxInvalidOpen(t *testing.T) {
+	// 服务端会话只接受对端打开的奇数且递增的流ID
+	cases := []struct {
+		ids   []uint32
+		valid bool
+	}{{[]uint32{1, 3}, true}, {[]uint32{2}, false}, {[]uint32{1, 1}, false}, {[]uint32{3, 1}, false}}
+	for _, c := range cases {
+		ids := c.ids
+		local, remote := net.Pipe()
+		session := NewMuxSession(local, false)
+		go io.Copy(io.Discard, remote)
+		enc := NewFrameEncoder(remote)
+		for i := 0; i < len(ids); i++ {
+			payload := make([]byte, 4)
+			binary.BigEndian.PutUint32(payload, ids[i])
+			enc.Encode(Frame{Type: muxFrame.OPEN, Payload: payload})
+		}
+		select {
+		case <-session.Done():
+			if c.valid {
+				t.Fatal("valid ids rejected", ids)
+			}
+		case <-time.After(200 * time.Millisecond):
+			if !c.valid || !session.Available() {
+				t.Fatal("invalid ids accepted", ids)
+			}
+		}
+		session.Close()
+		remote.Close()
+	}
+}
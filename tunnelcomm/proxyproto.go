@@ -0,0 +1,242 @@
+// Copyright (C) 2022 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package tunnelcomm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// PROXYV1 文本格式的PROXY协议头
+	PROXYV1 = 1
+	// PROXYV2 二进制格式的PROXY协议头
+	PROXYV2 = 2
+)
+
+// PROXYV1MAXLEN v1协议头的最大长度
+const PROXYV1MAXLEN = 107
+
+// proxyV2Sig PROXY协议v2的签名
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ErrProxyHeader PROXY协议头格式错误
+var ErrProxyHeader = errors.New("invalid proxy protocol header")
+
+// ParseProxyVersion 解析PROXY协议版本, 支持'v1'、'v2'
+func ParseProxyVersion(version string) (int, error) {
+	switch version {
+	case "v1", "1":
+		return PROXYV1, nil
+	case "v2", "2":
+		return PROXYV2, nil
+	}
+	return 0, errors.New("unsupported proxy protocol version: " + version)
+}
+
+// BuildProxyHeader 构建携带用户地址的PROXY协议头, 地址未知时构建不携带地址的头
+func BuildProxyHeader(version int, src, dst net.Addr) ([]byte, error) {
+	srcIP, srcPort := splitAddr(src)
+	dstIP, dstPort := splitAddr(dst)
+	ipv4 := nil != srcIP.To4() && nil != dstIP.To4()
+	known := nil != srcIP && nil != dstIP && (ipv4 || nil == srcIP.To4() && nil == dstIP.To4())
+	if version == PROXYV1 {
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n"), nil
+		}
+		family := "TCP6"
+		if ipv4 {
+			family = "TCP4"
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, srcIP.String(), dstIP.String(), srcPort, dstPort)), nil
+	} else if version != PROXYV2 {
+		return nil, fmt.Errorf("unsupported proxy protocol version: %d", version)
+	}
+	var buf bytes.Buffer
+	buf.Write(proxyV2Sig)
+	if !known {
+		// LOCAL命令, 不携带地址
+		buf.Write([]byte{0x20, 0x00, 0x00, 0x00})
+		return buf.Bytes(), nil
+	}
+	var addrs []byte
+	if ipv4 {
+		buf.Write([]byte{0x21, 0x11})
+		addrs = append(append(addrs, srcIP.To4()...), dstIP.To4()...)
+	} else {
+		buf.Write([]byte{0x21, 0x21})
+		addrs = append(append(addrs, srcIP.To16()...), dstIP.To16()...)
+	}
+	addrs = append(addrs, byte(srcPort>>8), byte(srcPort), byte(dstPort>>8), byte(dstPort))
+	binary.Write(&buf, binary.BigEndian, uint16(len(addrs)))
+	buf.Write(addrs)
+	return buf.Bytes(), nil
+}
+
+// splitAddr 获取地址的IP和端口, 不是IP地址时返回nil
+func splitAddr(addr net.Addr) (net.IP, int) {
+	switch val := addr.(type) {
+	case *net.TCPAddr:
+		return val.IP, val.Port
+	case *net.UDPAddr:
+		return val.IP, val.Port
+	}
+	return nil, 0
+}
+
+// parseAddr 解析'ip:port'格式的地址, 解析失败时返回nil
+func parseAddr(addr string) net.Addr {
+	host, port, err := net.SplitHostPort(addr)
+	if nil != err {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	portNum, err := strconv.Atoi(port)
+	if nil == ip || nil != err || portNum < 0 || portNum > 65535 {
+		return nil
+	}
+	return &net.TCPAddr{IP: ip, Port: portNum}
+}
+
+// addrString 地址的字符串形式, 为空时返回空字符串
+func addrString(addr net.Addr) string {
+	if nil == addr {
+		return ""
+	}
+	return addr.String()
+}
+
+// ReadProxyHeader 来自可信网段trusted的连接必须以PROXY协议v1或v2头开始, 返回的连接使用协议头中的用户地址
+// 其他来源的连接不读取协议头, 原样返回, 避免用户伪造地址; 协议头不携带地址时(UNKNOWN或LOCAL)使用连接本身的地址
+func ReadProxyHeader(conn net.Conn, trusted []*net.IPNet) (net.Conn, error) {
+	if !containsIP(trusted, conn.RemoteAddr()) {
+		return conn, nil
+	}
+	return readProxyHeader(conn)
+}
+
+// readProxyHeader 读取连接开头的PROXY协议v1或v2头, 只读取协议头本身
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(CMDRTIMEOUT))
+	defer conn.SetReadDeadline(time.Time{})
+	head := make([]byte, len(proxyV2Sig))
+	if _, err := io.ReadFull(conn, head); nil != err {
+		return nil, err
+	}
+	var src, dst net.Addr
+	var err error
+	if bytes.Equal(head, proxyV2Sig) {
+		src, dst, err = readProxyV2(conn)
+	} else if bytes.HasPrefix(head, []byte("PROXY ")) {
+		src, dst, err = readProxyV1(conn, head)
+	} else {
+		err = ErrProxyHeader
+	}
+	if nil != err {
+		return nil, err
+	}
+	return &proxyConn{Conn: conn, src: src, dst: dst}, nil
+}
+
+// readProxyV1 读取v1协议头的剩余部分并解析地址
+func readProxyV1(conn net.Conn, head []byte) (src, dst net.Addr, err error) {
+	line := append([]byte{}, head...)
+	buf := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= PROXYV1MAXLEN {
+			return nil, nil, ErrProxyHeader
+		}
+		if _, err = io.ReadFull(conn, buf); nil != err {
+			return nil, nil, err
+		}
+		line = append(line, buf[0])
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, ErrProxyHeader
+	}
+	src, dst = parseAddr(net.JoinHostPort(fields[2], fields[4])), parseAddr(net.JoinHostPort(fields[3], fields[5]))
+	if nil == src || nil == dst {
+		return nil, nil, ErrProxyHeader
+	}
+	return src, dst, nil
+}
+
+// readProxyV2 读取v2协议头的剩余部分并解析地址
+func readProxyV2(conn net.Conn) (src, dst net.Addr, err error) {
+	head := make([]byte, 4)
+	if _, err = io.ReadFull(conn, head); nil != err {
+		return nil, nil, err
+	}
+	if head[0]>>4 != 2 {
+		return nil, nil, ErrProxyHeader
+	}
+	body := make([]byte, binary.BigEndian.Uint16(head[2:]))
+	if _, err = io.ReadFull(conn, body); nil != err {
+		return nil, nil, err
+	}
+	// LOCAL命令或非TCP/UDP地址不携带用户地址
+	if head[0]&0x0f != 1 {
+		return nil, nil, nil
+	}
+	switch head[1] >> 4 {
+	case 1:
+		if len(body) < 12 {
+			return nil, nil, ErrProxyHeader
+		}
+		src = &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}
+		dst = &net.TCPAddr{IP: net.IP(body[4:8]), Port: int(binary.BigEndian.Uint16(body[10:12]))}
+	case 2:
+		if len(body) < 36 {
+			return nil, nil, ErrProxyHeader
+		}
+		src = &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}
+		dst = &net.TCPAddr{IP: net.IP(body[16:32]), Port: int(binary.BigEndian.Uint16(body[34:36]))}
+	}
+	return src, dst, nil
+}
+
+// proxyConn 使用PROXY协议头中地址的连接
+type proxyConn struct {
+	net.Conn
+	src net.Addr
+	dst net.Addr
+}
+
+// RemoteAddr 用户的真实地址
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if nil != c.src {
+		return c.src
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr 用户访问的地址
+func (c *proxyConn) LocalAddr() net.Addr {
+	if nil != c.dst {
+		return c.dst
+	}
+	return c.Conn.LocalAddr()
+}
+
+// CloseWrite 半关闭底层连接
+func (c *proxyConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
@@ -0,0 +1,115 @@
+// Copyright (C) 2022 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package tunnelcomm
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestBuildProxyHeader(t *testing.T) {
+	src, dst := parseAddr("192.168.1.2:51234"), parseAddr("10.0.0.1:443")
+	if header, err := BuildProxyHeader(PROXYV1, src, dst); nil != err || string(header) != "PROXY TCP4 192.168.1.2 10.0.0.1 51234 443\r\n" {
+		t.Fatal(string(header), err)
+	}
+	if header, _ := BuildProxyHeader(PROXYV1, parseAddr("[2001:db8::1]:80"), parseAddr("[::1]:8080")); string(header) != "PROXY TCP6 2001:db8::1 ::1 80 8080\r\n" {
+		t.Fatal(string(header))
+	}
+	if header, _ := BuildProxyHeader(PROXYV1, nil, dst); string(header) != "PROXY UNKNOWN\r\n" {
+		t.Fatal(string(header))
+	}
+	header, err := BuildProxyHeader(PROXYV2, src, dst)
+	want := append(append([]byte{}, proxyV2Sig...), 0x21, 0x11, 0x00, 0x0c, 192, 168, 1, 2, 10, 0, 0, 1, 0xc8, 0x22, 0x01, 0xbb)
+	if nil != err || !bytes.Equal(header, want) {
+		t.Fatal(header, err)
+	}
+	if header, _ = BuildProxyHeader(PROXYV2, &net.UnixAddr{Name: "/tmp/a.sock"}, dst); !bytes.Equal(header[12:], []byte{0x20, 0x00, 0x00, 0x00}) {
+		t.Fatal(header)
+	}
+	if _, err = BuildProxyHeader(3, src, dst); nil == err {
+		t.Fatal("expected version error")
+	}
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	src, dst := parseAddr("192.168.1.2:51234"), parseAddr("[2001:db8::1]:443")
+	v1, _ := BuildProxyHeader(PROXYV1, src, parseAddr("10.0.0.1:443"))
+	v2, _ := BuildProxyHeader(PROXYV2, src, parseAddr("10.0.0.1:443"))
+	v2ipv6, _ := BuildProxyHeader(PROXYV2, dst, dst)
+	local, _ := BuildProxyHeader(PROXYV2, nil, nil)
+	for _, tc := range []struct {
+		header []byte
+		src    string
+	}{
+		{v1, "192.168.1.2:51234"},
+		{v2, "192.168.1.2:51234"},
+		{v2ipv6, "[2001:db8::1]:443"},
+		{[]byte("PROXY UNKNOWN\r\n"), "pipe"},
+		{local, "pipe"},
+	} {
+		client, server := net.Pipe()
+		go func() {
+			client.Write(append(tc.header, "hello"...))
+			client.Close()
+		}()
+		conn, err := readProxyHeader(server)
+		if nil != err || conn.RemoteAddr().String() != tc.src {
+			t.Fatal(tc.src, conn, err)
+		}
+		// 协议头之后的数据原样保留
+		if data, _ := io.ReadAll(conn); string(data) != "hello" {
+			t.Fatal(string(data))
+		}
+		server.Close()
+	}
+	for _, header := range []string{"GET / HTTP/1.1\r\n\r\n", "PROXY TCP4 1.2.3.4\r\n", "PROXY TCP4 a b 1 2\r\n"} {
+		client, server := net.Pipe()
+		go func() {
+			client.Write([]byte(header))
+			client.Close()
+		}()
+		if _, err := readProxyHeader(server); nil == err {
+			t.Fatal("expected header error: " + header)
+		}
+		server.Close()
+	}
+}
+
+func TestReadProxyHeaderTrusted(t *testing.T) {
+	header, _ := BuildProxyHeader(PROXYV1, parseAddr("192.168.1.2:51234"), parseAddr("10.0.0.1:443"))
+	trusted, _ := ParseCIDRs("127.0.0.0/8")
+	untrusted, _ := ParseCIDRs("10.0.0.0/8")
+	for _, tc := range []struct {
+		nets []*net.IPNet
+		src  string
+		data string
+	}{
+		{trusted, "192.168.1.2:51234", "hello"},
+		// 不可信来源的协议头不解析, 作为普通数据
+		{untrusted, "", string(header) + "hello"},
+		{nil, "", string(header) + "hello"},
+	} {
+		client, server := newConnPair(t)
+		client.Write(append(header, "hello"...))
+		client.Close()
+		conn, err := ReadProxyHeader(server, tc.nets)
+		if len(tc.src) == 0 {
+			tc.src = client.LocalAddr().String()
+		}
+		if nil != err || conn.RemoteAddr().String() != tc.src {
+			t.Fatal(tc.src, conn, err)
+		}
+		if data, _ := io.ReadAll(conn); string(data) != tc.data {
+			t.Fatal(string(data))
+		}
+	}
+}
@@ -0,0 +1,234 @@
+// Copyright (C) 2022 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package tunnelcomm
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// DEFAULTSERVICE 未指定服务名时使用的服务名
+const DEFAULTSERVICE = "default"
+
+// ServiceAddr 服务名和对应地址, 客户端为代理目标地址, 服务端为用户侧监听地址
+type ServiceAddr struct {
+	Name string
+	Addr string
+}
+
+// SplitNetworkAddr 拆分带协议前缀的地址, 如'udp://127.0.0.1:53'、'unix:///var/run/docker.sock', 没有前缀时为tcp
+func SplitNetworkAddr(addr string) (network, address string) {
+	if index := strings.Index(addr, "://"); index > -1 {
+		return strings.ToLower(addr[:index]), addr[index+3:]
+	}
+	return "tcp", addr
+}
+
+// ParseServiceAddrs 解析'name=addr,name2=addr2'格式的服务列表, 只有一个地址时可以省略服务名
+func ParseServiceAddrs(spec string) (res []ServiceAddr, err error) {
+	items := strings.Split(spec, ",")
+	for i := 0; i < len(items); i++ {
+		item := strings.TrimSpace(items[i])
+		if len(item) == 0 {
+			continue
+		}
+		svc := ServiceAddr{Name: DEFAULTSERVICE, Addr: item}
+		if index := strings.Index(item, "="); index > -1 {
+			svc.Name, svc.Addr = strings.TrimSpace(item[:index]), strings.TrimSpace(item[index+1:])
+		} else if len(items) > 1 {
+			return nil, errors.New("service name is required when there are multiple services: " + item)
+		}
+		if err = checkServiceName(svc.Name); nil != err {
+			return nil, err
+		}
+		if len(svc.Addr) == 0 {
+			return nil, errors.New("service address is empty: " + svc.Name)
+		}
+		if network, _ := SplitNetworkAddr(svc.Addr); network != "tcp" && network != "udp" && network != "unix" {
+			return nil, errors.New("unsupported network: " + svc.Addr)
+		}
+		for j := 0; j < len(res); j++ {
+			if res[j].Name == svc.Name {
+				return nil, errors.New("duplicate service name: " + svc.Name)
+			}
+		}
+		res = append(res, svc)
+	}
+	if len(res) == 0 {
+		return nil, errors.New("no service specified")
+	}
+	return res, nil
+}
+
+// containsService 服务列表中是否包含指定服务
+func containsService(services []string, name string) bool {
+	for i := 0; i < len(services); i++ {
+		if services[i] == name {
+			return true
+		}
+	}
+	return false
+}
+
+// checkServiceName 服务名只能包含字母、数字和'-_.'
+func checkServiceName(name string) error {
+	if len(name) == 0 || len(name) > 64 {
+		return errors.New("invalid service name length: " + name)
+	}
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return errors.New("invalid service name: " + name)
+		}
+	}
+	return nil
+}
+
+// ParseHostRoutes 解析'host=name,host2=name2'格式的域名路由, 域名可以用'*.'开头匹配所有子域名, 省略服务名时使用默认服务
+func ParseHostRoutes(spec string) (map[string]string, error) {
+	res := make(map[string]string)
+	items := strings.Split(spec, ",")
+	for i := 0; i < len(items); i++ {
+		item := strings.TrimSpace(items[i])
+		if len(item) == 0 {
+			continue
+		}
+		host, name := item, DEFAULTSERVICE
+		if index := strings.Index(item, "="); index > -1 {
+			host, name = strings.TrimSpace(item[:index]), strings.TrimSpace(item[index+1:])
+		}
+		host = strings.ToLower(host)
+		if err := checkHostName(host); nil != err {
+			return nil, err
+		}
+		if err := checkServiceName(name); nil != err {
+			return nil, err
+		}
+		if _, ok := res[host]; ok {
+			return nil, errors.New("duplicate host: " + host)
+		}
+		res[host] = name
+	}
+	if len(res) == 0 {
+		return nil, errors.New("no host specified")
+	}
+	return res, nil
+}
+
+// checkHostName 域名只能包含小写字母、数字和'-.', 可以用'*.'开头
+func checkHostName(host string) error {
+	name := strings.TrimPrefix(host, "*.")
+	if len(name) == 0 || len(name) > 253 || strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".") {
+		return errors.New("invalid host name: " + host)
+	}
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '.') {
+			return errors.New("invalid host name: " + host)
+		}
+	}
+	return nil
+}
+
+// hostCandidates 域名的匹配顺序, 先精确匹配, 再由近到远匹配通配符
+func hostCandidates(host string) []string {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	res := []string{host}
+	for index := strings.Index(host, "."); index > -1; index = strings.Index(host, ".") {
+		host = host[index+1:]
+		res = append(res, "*."+host)
+	}
+	return res
+}
+
+// ParseCIDRs 解析','分隔的网段列表, 单个IP视为只包含该IP的网段
+func ParseCIDRs(spec string) (res []*net.IPNet, err error) {
+	items := strings.Split(spec, ",")
+	for i := 0; i < len(items); i++ {
+		item := strings.TrimSpace(items[i])
+		if len(item) == 0 {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			if ip := net.ParseIP(item); nil == ip {
+				return nil, errors.New("invalid ip: " + item)
+			} else if nil != ip.To4() {
+				item += "/32"
+			} else {
+				item += "/128"
+			}
+		}
+		var ipnet *net.IPNet
+		if _, ipnet, err = net.ParseCIDR(item); nil != err {
+			return nil, err
+		}
+		res = append(res, ipnet)
+	}
+	return res, nil
+}
+
+// containsIP 网段列表中是否包含地址的IP
+func containsIP(nets []*net.IPNet, addr net.Addr) bool {
+	ip, _ := splitAddr(addr)
+	for i := 0; i < len(nets) && nil != ip; i++ {
+		if nets[i].Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// PortRange 允许客户端请求的远程端口范围
+type PortRange struct {
+	Host string // 监听地址, 为空时监听所有地址
+	Min  int
+	Max  int
+}
+
+// ParsePortRange 解析'[host:]min-max'格式的端口范围, 只有一个端口时可以省略'-max'
+func ParsePortRange(spec string) (res PortRange, err error) {
+	ports := spec
+	if index := strings.LastIndex(spec, ":"); index > -1 {
+		res.Host, ports = strings.Trim(spec[:index], "[]"), spec[index+1:]
+	}
+	minPort, maxPort := ports, ports
+	if index := strings.Index(ports, "-"); index > -1 {
+		minPort, maxPort = ports[:index], ports[index+1:]
+	}
+	if res.Min, err = strconv.Atoi(strings.TrimSpace(minPort)); nil == err {
+		res.Max, err = strconv.Atoi(strings.TrimSpace(maxPort))
+	}
+	if nil != err || res.Min < 1 || res.Max > 65535 || res.Min > res.Max {
+		return res, errors.New("invalid port range: " + spec)
+	}
+	return res, nil
+}
+
+// Contains 端口是否在范围内
+func (r PortRange) Contains(port int) bool {
+	return r.Min > 0 && port >= r.Min && port <= r.Max
+}
+
+// Listen 监听范围内的端口, port为0时从范围内选择一个空闲端口
+func (r PortRange) Listen(port int) (net.Listener, error) {
+	if port != 0 {
+		if !r.Contains(port) {
+			return nil, fmt.Errorf("port %d is not in the allowed range %d-%d", port, r.Min, r.Max)
+		}
+		return net.Listen("tcp", net.JoinHostPort(r.Host, strconv.Itoa(port)))
+	}
+	for port = r.Min; port <= r.Max && r.Min > 0; port++ {
+		if listener, err := net.Listen("tcp", net.JoinHostPort(r.Host, strconv.Itoa(port))); nil == err {
+			return listener, nil
+		}
+	}
+	return nil, fmt.Errorf("no free port in the allowed range %d-%d", r.Min, r.Max)
+}
@@ -0,0 +1,90 @@
+// Copyright (C) 2022 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package tunnelcomm
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseServiceAddrs(t *testing.T) {
+	svcs, err := ParseServiceAddrs("ssh=127.0.0.1:22, rdp = 192.168.2.9:3389")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if want := []ServiceAddr{{"ssh", "127.0.0.1:22"}, {"rdp", "192.168.2.9:3389"}}; !reflect.DeepEqual(svcs, want) {
+		t.Fatal(svcs)
+	}
+	if svcs, err = ParseServiceAddrs("127.0.0.1:80"); nil != err || svcs[0].Name != DEFAULTSERVICE {
+		t.Fatal(svcs, err)
+	}
+	if svcs, err = ParseServiceAddrs("docker=unix:///var/run/docker.sock"); nil != err {
+		t.Fatal(err)
+	}
+	if network, address := SplitNetworkAddr(svcs[0].Addr); network != "unix" || address != "/var/run/docker.sock" {
+		t.Fatal(network, address)
+	}
+	for _, spec := range []string{"", "a=1,a=2", "127.0.0.1:22,rdp=127.0.0.1:3389", "a b=127.0.0.1:22", "ssh=", "ssh=sctp://127.0.0.1:22"} {
+		if _, err = ParseServiceAddrs(spec); nil == err {
+			t.Fatal("expected error:", spec)
+		}
+	}
+}
+
+func TestParsePortRange(t *testing.T) {
+	ports, err := ParsePortRange("127.0.0.1:20000-20100")
+	if nil != err || ports.Host != "127.0.0.1" || ports.Min != 20000 || ports.Max != 20100 {
+		t.Fatal(ports, err)
+	}
+	if ports, err = ParsePortRange("2222"); nil != err || ports.Min != 2222 || ports.Max != 2222 || !ports.Contains(2222) {
+		t.Fatal(ports, err)
+	}
+	for _, spec := range []string{"", "a-b", "200-100", "0-10", "1-70000"} {
+		if _, err = ParsePortRange(spec); nil == err {
+			t.Fatal("expected error:", spec)
+		}
+	}
+	if _, err = ports.Listen(2223); nil == err {
+		t.Fatal("expected out of range error")
+	}
+}
+
+func TestParseHostRoutes(t *testing.T) {
+	hosts, err := ParseHostRoutes("App.Example.com=web, *.example.com=api")
+	if nil != err || hosts["app.example.com"] != "web" || hosts["*.example.com"] != "api" {
+		t.Fatal(hosts, err)
+	}
+	if hosts, err = ParseHostRoutes("example.com"); nil != err || hosts["example.com"] != DEFAULTSERVICE {
+		t.Fatal(hosts, err)
+	}
+	for _, spec := range []string{"", "a.com=x,a.com=y", "a_b.com=x", ".com=x", "a.com=a b"} {
+		if _, err = ParseHostRoutes(spec); nil == err {
+			t.Fatal("expected error:", spec)
+		}
+	}
+	if want := []string{"a.b.com", "*.b.com", "*.com"}; !reflect.DeepEqual(hostCandidates("A.b.com."), want) {
+		t.Fatal(hostCandidates("A.b.com."))
+	}
+}
+
+func TestParseCIDRs(t *testing.T) {
+	nets, err := ParseCIDRs("10.0.0.0/8, 192.168.1.5,::1")
+	if nil != err || len(nets) != 3 {
+		t.Fatal(nets, err)
+	}
+	for addr, want := range map[string]bool{"10.1.2.3:80": true, "192.168.1.5:1": true, "192.168.1.6:1": false, "[::1]:80": true} {
+		if containsIP(nets, parseAddr(addr)) != want {
+			t.Fatal(addr)
+		}
+	}
+	if _, err = ParseCIDRs("10.0.0.0/33"); nil == err {
+		t.Fatal("expected cidr error")
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright (C) 2022 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package tunnelcomm
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/wup364/pakku/utils/logs"
+)
+
+// CAPSERVICES 客户端可以在控制通道上更新提供的服务, 不需要重新握手
+const CAPSERVICES = "services"
+
+// updateServices 更新客户端提供的服务、远程端口和域名路由, 返回为客户端监听的全部远程端口
+// 先打开新的远程端口再替换路由, 失败时不改变原有的服务; 删除的服务关闭空闲连接和远程端口, 正在转发的连接继续到结束
+func (s *TCPTunnelService) updateServices(client *clientSession, req HelloRequest) (ports map[string]int, err error) {
+	if err = checkServices(req); nil != err {
+		return nil, err
+	}
+	services := req.Services
+	if len(services) == 0 {
+		services = []string{DEFAULTSERVICE}
+	}
+	// 打开新增或端口变化的远程端口, 端口为0时保留已有的监听
+	current := client.listenPorts()
+	opened := make(map[string]net.Listener)
+	defer func() {
+		if nil != err {
+			for _, listener := range opened {
+				listener.Close()
+			}
+		}
+	}()
+	if len(req.Ports) > 0 {
+		var allowed PortRange
+		s.getSettings(func() { allowed = s.ports })
+		if allowed.Min == 0 {
+			return nil, errors.New("the server does not allow remote ports")
+		}
+		for name, port := range req.Ports {
+			if assigned, ok := current[name]; ok && (port == 0 || port == assigned) {
+				continue
+			}
+			var listener net.Listener
+			if listener, err = allowed.Listen(port); nil != err {
+				return nil, err
+			}
+			opened[name] = listener
+		}
+	}
+	// 替换路由
+	s.lock.Lock()
+	if client.isClosed() {
+		s.lock.Unlock()
+		return nil, errClientClosed
+	}
+	if err = s.checkRoutes(services, req.Hosts, client); nil != err {
+		s.lock.Unlock()
+		return nil, err
+	}
+	oldServices, oldHosts := client.getServices(), client.getHosts()
+	client.setServices(services, req.Hosts)
+	s.unmapRoutes(client, oldServices, oldHosts)
+	for i := 0; i < len(services); i++ {
+		s.routes.Put(services[i], client)
+	}
+	for host := range req.Hosts {
+		s.hosts.Put(host, client)
+	}
+	s.lock.Unlock()
+	// 删除的服务和不再需要的远程端口
+	for i := 0; i < len(oldServices); i++ {
+		if !containsService(services, oldServices[i]) {
+			client.removePool(oldServices[i])
+		}
+	}
+	for name := range current {
+		if _, ok := req.Ports[name]; !ok || nil != opened[name] {
+			client.closeListener(name)
+		}
+	}
+	for name, listener := range opened {
+		if err = client.addListener(name, listener); nil != err {
+			return nil, err
+		}
+		go s.ServeListener(listener, name)
+	}
+	// 新增的服务唤醒已排队的用户, 并推送排队用户数, 服务不存在时推送的需求已被丢弃
+	for i := 0; i < len(services); i++ {
+		if !containsService(oldServices, services[i]) {
+			s.notifyConn(services[i])
+			if n := s.queueSize(services[i]); n > 0 {
+				s.needConn(services[i], n)
+			}
+		}
+	}
+	logs.Infof("client services updated, client=%s, services=%v, ports=%v\r\n", client.id, services, client.listenPorts())
+	return client.listenPorts(), nil
+}
+
+// UpdateServices 更新运行中客户端提供的服务、远程端口和域名路由, 新增的服务开始建立连接, 删除的服务不再接受新的用户
+// 未连接时只更新设置; 服务端不支持时断开控制连接, 重新握手后生效; 服务端拒绝时保留原服务并返回原因
+func (c *TCPTunnelClient) UpdateServices(services []string, ports map[string]int, hosts map[string]string) error {
+	if len(services) == 0 {
+		services = []string{DEFAULTSERVICE}
+	}
+	c.ulock.Lock()
+	defer c.ulock.Unlock()
+	reply := make(chan Frame, 1)
+	c.lock.Lock()
+	conn, done, useMux, old := c.ctlConn, c.ctrlDone, c.ctrlMux, c.services
+	live := nil != done && hasCapability(c.caps, CAPSERVICES)
+	if live {
+		c.svcReply = reply
+	}
+	c.lock.Unlock()
+	if !live {
+		c.setServices(services, ports, hosts)
+		if nil != conn {
+			conn.Close()
+		}
+		return nil
+	}
+	defer func() {
+		c.lock.Lock()
+		c.svcReply = nil
+		c.lock.Unlock()
+	}()
+	req := HelloRequest{Services: services, Ports: ports, Hosts: hosts}
+	if err := c.writeCtrl(conn, CTRLCMD.SERVICES, encodeJSONArg(req)); nil != err {
+		return err
+	}
+	select {
+	case cmd := <-reply:
+		var res HelloResponse
+		if err := decodeJSONArg(cmd.Arg(0), &res); nil != err {
+			return err
+		}
+		if len(res.Reason) > 0 {
+			return errors.New("update services rejected: " + res.Reason)
+		}
+		c.setServices(services, ports, hosts)
+		c.lock.Lock()
+		c.assignedPorts = res.Ports
+		c.lock.Unlock()
+	case <-done:
+		// 控制通道已断开, 重新握手后生效
+		c.setServices(services, ports, hosts)
+		return nil
+	case <-time.After(CMDRTIMEOUT):
+		c.setServices(services, ports, hosts)
+		conn.Close()
+		return nil
+	}
+	// 新增的服务开始补充连接, 删除的服务的补充协程收到信号后退出
+	for i := 0; i < len(services) && !useMux; i++ {
+		if !containsService(old, services[i]) {
+			go c.fillPool(services[i], done)
+		}
+	}
+	for i := 0; i < len(old) && !useMux; i++ {
+		if !containsService(services, old[i]) {
+			c.getPool(old[i]).signal()
+		}
+	}
+	return nil
+}
+
+// setServices 更新提供的服务、远程端口和域名路由
+func (c *TCPTunnelClient) setServices(services []string, ports map[string]int, hosts map[string]string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.services, c.remotePorts, c.hosts = services, ports, hosts
+}
+
+// getServices 提供的服务名, 返回的切片不会被修改
+func (c *TCPTunnelClient) getServices() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.services
+}
+
+// writeCtrl 在控制连接上发送命令, 心跳和服务更新来自不同的协程
+func (c *TCPTunnelClient) writeCtrl(conn net.Conn, cmd byte, args ...string) error {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	return CTRLCMD.WriteCMD(conn, cmd, args...)
+}
@@ -0,0 +1,76 @@
+// Copyright (C) 2022 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package tunnelcomm
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUpdateServices(t *testing.T) {
+	service, addr := startTestService(t)
+	service.SetRemotePorts(PortRange{Host: "127.0.0.1", Min: 1024, Max: 65535})
+	client := newTestClient(addr, "branch1", "web")
+	go client.Start(context.Background())
+	go newTestClient(addr, "branch2", "rdp").Start(context.Background())
+	service.RelaseConn(waitConn(t, service, "web"))
+	waitConn(t, service, "rdp").Close()
+	session, _ := service.clients.Get("branch1")
+
+	// 新增服务和远程端口, 不需要重新连接
+	if err := client.UpdateServices([]string{"web", "ssh"}, map[string]int{"ssh": 0}, nil); nil != err {
+		t.Fatal(err)
+	}
+	conn := waitConn(t, service, "ssh")
+	if got, _ := io.ReadAll(conn); string(got) != "branch1:ssh" {
+		t.Fatal(string(got))
+	}
+	service.RelaseConn(conn)
+	port := client.GetRemotePorts()["ssh"]
+	if port == 0 {
+		t.Fatal("remote port is not assigned")
+	}
+	user, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if nil != err {
+		t.Fatal(err)
+	}
+	user.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if got, _ := io.ReadAll(user); string(got) != "branch1:ssh" {
+		t.Fatal(string(got))
+	}
+	user.Close()
+
+	// 服务名已被其他客户端使用时拒绝, 保留原服务
+	if err = client.UpdateServices([]string{"web", "rdp"}, nil, nil); nil == err || !strings.Contains(err.Error(), "service rdp") {
+		t.Fatal(err)
+	}
+	if route := service.getRoute("ssh"); nil == route || route.id != "branch1" {
+		t.Fatal("services are changed by a rejected update")
+	}
+
+	// 删除服务后不再路由, 远程端口关闭
+	if err = client.UpdateServices([]string{"ssh"}, nil, nil); nil != err {
+		t.Fatal(err)
+	}
+	if nil != service.getRoute("web") || service.CountConn("web") != 0 {
+		t.Fatal("removed service is still routed")
+	}
+	if _, err = net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port))); nil == err {
+		t.Fatal("remote port of the removed service is still open")
+	}
+	if current, _ := service.clients.Get("branch1"); current != session {
+		t.Fatal("client reconnected for the update")
+	}
+}
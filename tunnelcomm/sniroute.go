@@ -0,0 +1,93 @@
+// Copyright (C) 2022 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package tunnelcomm
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/wup364/pakku/utils/logs"
+)
+
+// errSNIRead 读取到ClientHello后中止握手
+var errSNIRead = errors.New("client hello read")
+
+// ServeTLSListener 接受TLS用户连接, 不解密数据, 根据ClientHello中的SNI转发到对应服务, 监听或服务关闭后返回
+func (s *TCPTunnelService) ServeTLSListener(listener net.Listener) error {
+	return s.serve(listener, false, s.handTLSConn)
+}
+
+// handTLSConn 读取ClientHello选择服务, 已读取的数据在隧道连接上重放
+func (s *TCPTunnelService) handTLSConn(conn net.Conn) {
+	defer conn.Close()
+	if !s.trackConn(conn) {
+		return
+	}
+	defer s.conns.Delete(conn)
+	conn, err := s.readProxyConn(conn)
+	if nil != err {
+		return
+	}
+	host, head, err := readSNIHost(conn)
+	if nil != err {
+		s.printInfo("Read TLS client hello error: ", conn.RemoteAddr().String(), err.Error())
+		return
+	}
+	service := s.getHostService(host)
+	if len(service) == 0 {
+		logs.Infof("no service is registered for SNI host %s, conn=%s\r\n", host, conn.RemoteAddr().String())
+		return
+	}
+	s.forwardConn(&replayConn{Conn: conn, head: head}, service)
+}
+
+// readSNIHost 读取TLS ClientHello并返回SNI, 同时返回已从连接读取的全部数据
+func readSNIHost(conn net.Conn) (host string, head []byte, err error) {
+	var buf bytes.Buffer
+	conn.SetReadDeadline(time.Now().Add(CMDRTIMEOUT))
+	defer conn.SetReadDeadline(time.Time{})
+	reader := io.TeeReader(io.LimitReader(conn, HTTPHEADMAXLEN), &buf)
+	err = tls.Server(&sniConn{Conn: conn, reader: reader}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			host = hello.ServerName
+			return nil, errSNIRead
+		},
+	}).Handshake()
+	if !errors.Is(err, errSNIRead) {
+		if nil == err {
+			err = errors.New("unexpected TLS handshake result")
+		}
+		return host, buf.Bytes(), err
+	}
+	if len(host) == 0 {
+		return host, buf.Bytes(), errors.New("missing SNI in client hello")
+	}
+	return host, buf.Bytes(), nil
+}
+
+// sniConn 只读连接, 用于解析ClientHello, 不向客户端写入任何数据
+type sniConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+// Read 从记录数据的reader读取
+func (c *sniConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// Write 丢弃握手过程中的响应
+func (c *sniConn) Write(p []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
@@ -0,0 +1,76 @@
+// Copyright (C) 2022 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package tunnelcomm
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServeTLSListener(t *testing.T) {
+	caPEM, caKeyPEM, err := GenerateCA("test-ca", time.Hour)
+	if nil != err {
+		t.Fatal(err)
+	}
+	certPEM, keyPEM, err := IssueCertificate(caPEM, caKeyPEM, "backend", []string{"web.example.com", "*.example.com"}, false, time.Hour)
+	if nil != err {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if nil != err {
+		t.Fatal(err)
+	}
+	service, addr := startTestService(t)
+	client := NewTCPTunnelClient(addr, 2, false)
+	client.SetToken("secret")
+	client.SetServices("web", "api")
+	client.SetHosts(map[string]string{"web.example.com": "web", "*.example.com": "api"})
+	// 后端服务终止TLS, 回写服务名和SNI
+	client.SetTransportCallback(func(info TransportInfo, conn net.Conn, release func() error) error {
+		tlsConn := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{cert}})
+		if err := tlsConn.Handshake(); nil == err {
+			tlsConn.Write([]byte(info.Service + " " + tlsConn.ConnectionState().ServerName))
+			tlsConn.CloseWrite()
+		}
+		return release()
+	})
+	go client.Start(context.Background())
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go service.ServeTLSListener(listener)
+	waitConn(t, service, "web").Close()
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caPEM)
+	for host, want := range map[string]string{"web.example.com": "web web.example.com", "a.example.com": "api a.example.com"} {
+		conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{ServerName: host, RootCAs: roots})
+		if nil != err {
+			t.Fatal(host, err)
+		}
+		got, err := io.ReadAll(conn)
+		conn.Close()
+		if nil != err || string(got) != want {
+			t.Fatal(host, string(got), err)
+		}
+	}
+	// 未注册的域名直接关闭连接
+	if conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{ServerName: "unknown.example.org", RootCAs: roots}); nil == err {
+		conn.Close()
+		t.Fatal("expected handshake failure")
+	}
+}
@@ -10,38 +10,96 @@
 package tunnelcomm
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"strconv"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/wup364/pakku/utils/logs"
 	"github.com/wup364/pakku/utils/strutil"
+	"github.com/wup364/pakku/utils/utypes"
 )
 
-// NewTCPTunnelClient 实例化TCP隧道客户端
-func NewTCPTunnelClient(tunnelServer *net.TCPAddr, maxTCPConn int64, isdebug bool) *TCPTunnelClient {
+// NewTCPTunnelClient 实例化TCP隧道客户端, minIdle为每个服务保持的空闲连接数
+func NewTCPTunnelClient(tunnelServer *net.TCPAddr, minIdle int64, isdebug bool) *TCPTunnelClient {
 	return &TCPTunnelClient{
 		cid:          strutil.GetUUID(),
 		debug:        isdebug,
-		maxCount:     maxTCPConn,
+		minIdle:      minIdle,
+		idleTimeout:  POOLIDLETIMEOUT,
 		tunnelServer: tunnelServer,
+		conns:        utypes.NewSafeMap(),
+		sessions:     utypes.NewSafeMap(),
+		muxWake:      make(chan struct{}, 1),
+		done:         make(chan struct{}),
 	}
 }
 
-// onTransport 当链接上隧道后的回调函数, conn: 链接对象, release: 释放资源
-type onTransport func(conn net.Conn, release func() error) error
+// onTransport 当链接上隧道后的回调函数, info: 传输信息, conn: 链接对象, release: 释放资源
+type onTransport func(info TransportInfo, conn net.Conn, release func() error) error
+
+// TransportInfo 一次传输的信息
+type TransportInfo struct {
+	Service string   // 服务名
+	SrcAddr net.Addr // 用户的来源地址, 未知时为nil
+	DstAddr net.Addr // 用户访问的服务端地址, 未知时为nil
+}
+
+// newTransportInfo 根据服务名和服务端发送的地址参数构建传输信息
+func newTransportInfo(service string, args []string) TransportInfo {
+	info := TransportInfo{Service: service}
+	if len(args) > 0 {
+		info.SrcAddr = parseAddr(args[0])
+	}
+	if len(args) > 1 {
+		info.DstAddr = parseAddr(args[1])
+	}
+	return info
+}
 
 // TCPTunnelClient TCP隧道客户端
 type TCPTunnelClient struct {
 	dataExchangeFunc onTransport
 	tunnelServer     *net.TCPAddr
-	cid              string // 实例ID
-	debug            bool   // 是否输出调试信息
-	maxCount         int64  // 保持空闲连接数
-	connCount        int64
+	cid              string        // 实例ID
+	debug            bool          // 是否输出调试信息
+	minIdle          int64         // 每个服务保持的空闲连接数
+	maxConns         int64         // 每个服务的连接数上限, 0不限制
+	idleTimeout      time.Duration // 超出minIdle的空闲连接的超时时间
+	pools            map[string]*connPool
+	ctlConn          net.Conn        // 当前的控制连接
+	conns            *utypes.SafeMap // 数据连接, 连接->是否空闲
+	sessions         *utypes.SafeMap // 多路复用会话
+	active           int64           // 正在传输的连接数
+	draining         int32           // 服务端是否正在排空, 重新连接后清除
+	done             chan struct{}   // 客户端关闭信号
+	closeOnce        sync.Once
+	version          int      // 握手协商的协议版本
+	caps             []string // 握手协商的能力列表
+	token            string   // 预共享token
+	tokenKey         []byte   // 由token和用户名派生的认证密钥
+	user             string   // 认证用户名
+	tlsConfig        *tls.Config
+	muxCount         int64             // 多路复用物理连接数, 为0时不使用多路复用
+	muxActive        int64             // 当前控制通道的服务端上可用的多路复用连接数
+	muxGen           int64             // 控制通道的代数, 每次握手后增加, 多路复用连接只计入所属的代
+	muxWake          chan struct{}     // 补充多路复用连接信号
+	services         []string          // 提供的服务名, 每个服务单独保持空闲连接
+	remotePorts      map[string]int    // 请求服务端监听的远程端口
+	assignedPorts    map[string]int    // 服务端实际监听的远程端口
+	hosts            map[string]string // 按域名路由的服务, 域名->服务名
+	ctrlDone         chan struct{}     // 当前控制通道的结束信号, 未使用推送模式时为nil
+	ctrlMux          bool              // 当前控制通道是否使用多路复用
+	svcReply         chan Frame        // 等待服务端应答服务更新
+	ulock            sync.Mutex        // 服务更新锁, 同时只有一个更新
+	wlock            sync.Mutex        // 控制连接写锁
+	lock             sync.Mutex        // 保护服务、端口、域名、连接统计和控制连接
 }
 
 // SetTransportCallback 设置当链接上隧道后的回调函数
@@ -49,43 +107,169 @@ func (c *TCPTunnelClient) SetTransportCallback(fuc onTransport) {
 	c.dataExchangeFunc = fuc
 }
 
+// SetToken 设置预共享token, 用于应答服务端的认证挑战
+func (c *TCPTunnelClient) SetToken(token string) {
+	c.token = token
+	c.deriveKey()
+}
+
+// SetUser 设置认证用户名, 服务端使用凭据文件认证时需要
+func (c *TCPTunnelClient) SetUser(user string) {
+	c.user = user
+	c.deriveKey()
+}
+
+// deriveKey 由token和用户名派生认证密钥
+func (c *TCPTunnelClient) deriveKey() {
+	if len(c.token) == 0 {
+		c.tokenKey = nil
+	} else {
+		c.tokenKey = ClientKey(c.token, c.user)
+	}
+}
+
+// SetTLSConfig 设置连接隧道服务端的TLS配置, 为空时使用明文TCP
+func (c *TCPTunnelClient) SetTLSConfig(cfg *tls.Config) {
+	c.tlsConfig = cfg
+}
+
+// SetMuxConns 设置多路复用的物理连接数, 服务端支持时每个用户连接只占用一个逻辑流, 为0时每个用户连接独占一个隧道连接
+func (c *TCPTunnelClient) SetMuxConns(count int) {
+	c.muxCount = int64(count)
+}
+
+// SetServices 设置提供的服务名, 服务端为每个服务开放单独的用户端口, 为空时只提供默认服务; 运行中更新使用UpdateServices
+func (c *TCPTunnelClient) SetServices(names ...string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.services = names
+}
+
+// SetRemotePorts 请求服务端为服务监听远程端口, 服务名->端口, 端口为0时由服务端选择空闲端口
+func (c *TCPTunnelClient) SetRemotePorts(ports map[string]int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.remotePorts = ports
+}
+
+// SetHosts 设置按域名路由的服务, 域名->服务名, 服务端的HTTP端口和TLS端口根据域名转发到对应服务
+func (c *TCPTunnelClient) SetHosts(hosts map[string]string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.hosts = hosts
+}
+
+// GetRemotePorts 获取服务端为服务监听的远程端口
+func (c *TCPTunnelClient) GetRemotePorts() map[string]int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	ports := make(map[string]int, len(c.assignedPorts))
+	for name, port := range c.assignedPorts {
+		ports[name] = port
+	}
+	return ports
+}
+
+// SetID 设置客户端ID, 服务端以ID区分客户端, 固定ID后客户端重启时会替换服务端上的旧会话, 为空时使用随机ID
+func (c *TCPTunnelClient) SetID(id string) {
+	if len(id) > 0 {
+		c.cid = id
+	}
+}
+
 // GetID 获取实例ID
 func (c *TCPTunnelClient) GetID() string {
 	return c.cid
 }
 
-// Start 连接隧道服务
-func (c *TCPTunnelClient) Start() (err error) {
-	if c.maxCount == 0 {
-		c.maxCount = 50
+// Start 连接隧道服务, 阻塞直到控制连接断开; ctx结束时断开控制连接并返回ctx的错误, 客户端关闭后返回ErrClientClosed
+func (c *TCPTunnelClient) Start(ctx context.Context) (err error) {
+	if c.isClosed() {
+		return ErrClientClosed
 	}
+	c.lock.Lock()
+	if len(c.services) == 0 {
+		c.services = []string{DEFAULTSERVICE}
+	}
+	c.lock.Unlock()
+	defer func() {
+		if nil != ctx.Err() {
+			err = ctx.Err()
+		} else if c.isClosed() {
+			err = ErrClientClosed
+		}
+	}()
 	// 连接到服务端
 	var conn net.Conn
-	if conn, err = net.DialTCP("tcp", nil, c.tunnelServer); nil == err {
+	if conn, err = c.dialContext(ctx); nil == err {
 		defer conn.Close()
-		// 1. 先清空服务端现有隧道连接缓存
-		if err = CTRLCMD.WriteCMD(conn, CTRLCMD.NEWCTRLCONN); nil == err {
-			logs.Infoln("console is connected, conn=" + conn.LocalAddr().String())
+		// 拨号期间客户端可能已关闭, 关闭后不再记录控制连接
+		c.lock.Lock()
+		if c.isClosed() {
+			c.lock.Unlock()
+			return ErrClientClosed
+		}
+		c.ctlConn = conn
+		c.lock.Unlock()
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-ctx.Done():
+				conn.Close()
+			case <-stop:
+			}
+		}()
+		// 1. 握手, 服务端会清空现有隧道连接缓存
+		if err = c.hello(conn); nil == err {
+			logs.Infof("console is connected, conn=%s, version=%d, capabilities=%v\r\n", conn.LocalAddr().String(), c.version, c.caps)
+			useMux := c.muxCount > 0 && c.HasCapability(CAPMUX)
+			if c.muxCount > 0 && !useMux {
+				logs.Infoln("the server does not support multiplexing, fall back to one connection per session")
+			}
+			atomic.StoreInt32(&c.draining, 0)
+			// 原服务端交出服务后保留的会话不再计入, 立即在新的服务端建立会话
+			c.lock.Lock()
+			c.muxGen++
+			atomic.StoreInt64(&c.muxActive, 0)
+			c.lock.Unlock()
+			// 2. 服务端推送连接需求
+			if c.HasCapability(CAPNEEDCONN) {
+				return c.serveCtrl(conn, useMux)
+			}
 			errorCount := 0
 			for {
-				// 2. 查询服务端的连接情况
-				if err = CTRLCMD.WriteCMD(conn, CTRLCMD.COUNTCONN); nil == err {
-					var cmdval string
-					if cmdval, err = c.readCMD(conn); nil == err {
-						if c.connCount, err = strconv.ParseInt(cmdval, 10, 64); nil == err {
-							// 3. 如果个数不够则需要创建新连接
-							if c.maxCount > c.connCount {
-								if err := c.NewC2SConn(); nil != err {
+				// 3. 查询服务端的连接情况, 多路复用时所有服务共用会话
+				if useMux {
+					if _, err = c.countConn(conn, ""); nil == err {
+						if atomic.LoadInt64(&c.muxActive) < c.muxCount {
+							if err := c.NewMuxConn(); nil != err {
+								logs.Errorln(err)
+							}
+						}
+						time.Sleep(time.Duration(500) * time.Millisecond)
+					}
+				} else {
+					created := false
+					services := c.getServices()
+					for i := 0; i < len(services) && nil == err; i++ {
+						var count int64
+						if count, err = c.countConn(conn, services[i]); nil == err {
+							// 4. 如果个数不够则需要创建新连接
+							if min, _, _ := c.poolSize(); min > count || count == 0 {
+								if err := c.NewC2SConn(services[i]); nil != err {
 									logs.Errorln(err)
 								}
-							} else {
-								time.Sleep(time.Duration(500) * time.Millisecond)
+								created = true
 							}
 						}
 					}
+					if !created {
+						time.Sleep(time.Duration(500) * time.Millisecond)
+					}
 				}
 				if nil != err {
-					if errorCount > 10 {
+					if errorCount > 10 || nil != ctx.Err() || c.isClosed() {
 						break
 					}
 					errorCount++
@@ -100,12 +284,116 @@ func (c *TCPTunnelClient) Start() (err error) {
 	return err
 }
 
-// NewC2SConn 添加隧道空闲连接
-func (c *TCPTunnelClient) NewC2SConn() (err error) {
+// countConn 查询服务端空闲连接数, service为空时查询所有服务
+func (c *TCPTunnelClient) countConn(conn net.Conn, service string) (count int64, err error) {
+	if err = CTRLCMD.WriteCMD(conn, CTRLCMD.COUNTCONN, service); nil == err {
+		var cmd Frame
+		if cmd, err = c.readCMD(conn); nil == err && cmd.Type != CTRLCMD.COUNTCONN {
+			err = errors.New("unexpected response: " + cmd.String())
+		}
+		if nil == err {
+			count, err = strconv.ParseInt(cmd.Arg(0), 10, 64)
+		}
+	}
+	return count, err
+}
+
+// newHelloRequest 使用当前的服务、远程端口和域名构建握手消息
+func (c *TCPTunnelClient) newHelloRequest() HelloRequest {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return newHelloRequest(c.cid, c.services, c.remotePorts, c.hosts)
+}
+
+// hello 发送握手消息, 协商协议版本和能力
+func (c *TCPTunnelClient) hello(conn net.Conn) (err error) {
+	if err = CTRLCMD.WriteCMD(conn, CTRLCMD.NEWCTRLCONN, encodeJSONArg(c.newHelloRequest())); nil != err {
+		return err
+	}
+	var cmd Frame
+	if cmd, err = c.waitAccepted(conn); nil != err {
+		// 版本1的服务端不认识握手消息, 不应答直接断开
+		if errors.Is(err, io.EOF) {
+			return fmt.Errorf("handshake failed: %w", ErrServerTooOld)
+		}
+		return errors.New("handshake failed: " + err.Error())
+	}
+	var res HelloResponse
+	if err = decodeJSONArg(cmd.Arg(0), &res); nil != err {
+		return fmt.Errorf("handshake failed, invalid response %s: %s", cmd.String(), err.Error())
+	}
+	if cmd.Type == CTRLCMD.REJECT {
+		return fmt.Errorf("handshake rejected by server(version %d): %s", res.Version, res.Reason)
+	} else if cmd.Type != CTRLCMD.OK {
+		return errors.New("handshake failed, unexpected response: " + cmd.String())
+	}
+	// 原控制通道的数据连接可能仍在读取协商结果
+	c.lock.Lock()
+	c.version, c.caps = res.Version, res.Capabilities
+	c.assignedPorts = res.Ports
+	c.lock.Unlock()
+	for name, port := range res.Ports {
+		logs.Infof("remote port is listening, service=%s, port=%d\r\n", name, port)
+	}
+	return err
+}
+
+// waitAccepted 等待服务端的受理结果(OK或REJECT), 期间应答服务端的认证挑战
+func (c *TCPTunnelClient) waitAccepted(conn net.Conn) (cmd Frame, err error) {
+	for {
+		if cmd, err = c.readCMD(conn); nil != err || cmd.Type != CTRLCMD.AUTH {
+			return cmd, err
+		}
+		if len(c.tokenKey) == 0 {
+			return cmd, errors.New("the server requires authentication, but no token is set")
+		}
+		if err = CTRLCMD.WriteCMD(conn, CTRLCMD.AUTH, SignChallenge(c.tokenKey, cmd.Arg(0), c.cid), c.user); nil != err {
+			return cmd, err
+		}
+	}
+}
+
+// GetVersion 获取握手协商的协议版本
+func (c *TCPTunnelClient) GetVersion() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.version
+}
+
+// HasCapability 握手协商的能力中是否包含指定能力
+func (c *TCPTunnelClient) HasCapability(name string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return hasCapability(c.caps, name)
+}
+
+// NewC2SConn 为服务添加隧道空闲连接, 连接数达到上限时返回ErrPoolFull
+func (c *TCPTunnelClient) NewC2SConn(service string) (err error) {
+	if c.isClosed() {
+		return ErrClientClosed
+	}
+	pool := c.getPool(service)
+	if _, max, _ := c.poolSize(); !pool.reserve(max) {
+		return ErrPoolFull
+	}
+	defer func() {
+		if nil != err {
+			atomic.AddInt64(&pool.total, -1)
+		}
+	}()
 	var conn net.Conn
-	if conn, err = net.DialTCP("tcp", nil, c.tunnelServer); nil == err {
-		if err = CTRLCMD.WriteCMD(conn, CTRLCMD.NEWUSERCONN); nil == err {
-			go c.handConn(conn)
+	if conn, err = c.dial(); nil == err {
+		if err = CTRLCMD.WriteCMD(conn, CTRLCMD.NEWUSERCONN, c.cid, service); nil == err {
+			var cmd Frame
+			if cmd, err = c.waitAccepted(conn); nil == err && cmd.Type != CTRLCMD.OK {
+				var res HelloResponse
+				decodeJSONArg(cmd.Arg(0), &res)
+				err = errors.New("tunnel connection rejected: " + res.Reason)
+			}
+		}
+		if nil == err {
+			atomic.AddInt64(&pool.idle, 1)
+			go c.handConn(conn, service)
 		} else {
 			conn.Close()
 		}
@@ -113,31 +401,148 @@ func (c *TCPTunnelClient) NewC2SConn() (err error) {
 	return err
 }
 
-// handConn 处理服务端发送过来命令
-func (c *TCPTunnelClient) handConn(conn net.Conn) {
+// dial 连接隧道服务端
+func (c *TCPTunnelClient) dial() (net.Conn, error) {
+	return c.dialContext(context.Background())
+}
+
+// dialContext 连接隧道服务端, ctx结束时放弃连接
+func (c *TCPTunnelClient) dialContext(ctx context.Context) (net.Conn, error) {
+	if nil == c.tlsConfig {
+		dialer := &net.Dialer{}
+		return dialer.DialContext(ctx, "tcp", c.tunnelServer.String())
+	}
+	dialer := &tls.Dialer{NetDialer: &net.Dialer{Timeout: CMDWTIMEOUT}, Config: c.tlsConfig}
+	return dialer.DialContext(ctx, "tcp", c.tunnelServer.String())
+}
+
+// NewMuxConn 添加多路复用连接, 服务端在该连接上为每个用户连接打开一个逻辑流
+func (c *TCPTunnelClient) NewMuxConn() (err error) {
+	if c.isClosed() {
+		return ErrClientClosed
+	}
+	var conn net.Conn
+	if conn, err = c.dial(); nil == err {
+		if err = CTRLCMD.WriteCMD(conn, CTRLCMD.NEWMUXCONN, c.cid); nil == err {
+			var cmd Frame
+			if cmd, err = c.waitAccepted(conn); nil == err && cmd.Type != CTRLCMD.OK {
+				var res HelloResponse
+				decodeJSONArg(cmd.Arg(0), &res)
+				err = errors.New("mux connection rejected: " + res.Reason)
+			}
+		}
+		if nil != err {
+			conn.Close()
+			return err
+		}
+		session := NewMuxSession(conn, true)
+		c.sessions.Put(session, session)
+		c.lock.Lock()
+		gen := c.muxGen
+		atomic.AddInt64(&c.muxActive, 1)
+		c.lock.Unlock()
+		go func() {
+			// 会话关闭后通知补充连接, 之前的控制通道建立的会话已不在计数中
+			defer notifyChan(c.muxWake)
+			defer func() {
+				c.lock.Lock()
+				if gen == c.muxGen {
+					atomic.AddInt64(&c.muxActive, -1)
+				}
+				c.lock.Unlock()
+			}()
+			defer c.sessions.Delete(session)
+			defer session.Close()
+			for {
+				stream, err := session.Accept()
+				if nil != err {
+					return
+				}
+				go c.handStream(stream)
+			}
+		}()
+	}
+	return err
+}
+
+// handStream 处理服务端打开的逻辑流, 参数为服务名和用户地址, 逻辑流不能复用, 用完即关闭
+func (c *TCPTunnelClient) handStream(stream *MuxStream) {
+	defer stream.Close()
+	if c.isClosed() {
+		return
+	}
+	atomic.AddInt64(&c.active, 1)
+	defer atomic.AddInt64(&c.active, -1)
+	service, args := DEFAULTSERVICE, stream.Args()
+	if len(args) > 0 && len(args[0]) > 0 {
+		service, args = args[0], args[1:]
+	}
+	if nil != c.dataExchangeFunc {
+		c.dataExchangeFunc(newTransportInfo(service, args), stream, stream.Close)
+	}
+}
+
+// handConn 处理服务端发送过来命令, 连接只传输所属服务的数据
+// 连接建立时已计入空闲连接, 开始传输时移出, 复用后重新计入
+func (c *TCPTunnelClient) handConn(conn net.Conn, service string) {
 	if nil != conn {
-		defer conn.Close()
+		pool := c.getPool(service)
+		idle, idleSince := true, time.Now()
+		c.conns.Put(conn, true)
+		defer func() {
+			if idle {
+				atomic.AddInt64(&pool.idle, -1)
+			}
+			atomic.AddInt64(&pool.total, -1)
+			c.conns.Delete(conn)
+			conn.Close()
+		}()
 		for {
 			//
-			if cmd, _ := c.readCMD(conn); cmd == CTRLCMD.STARTTRANSPORT {
+			if cmd, _ := c.readCMD(conn); cmd.Type == CTRLCMD.STARTTRANSPORT {
+				// 空闲连接减少, 通知补充
+				idle = false
+				atomic.AddInt64(&pool.idle, -1)
+				pool.signal()
+				// 客户端关闭后不再开始新的传输
+				c.conns.Put(conn, false)
+				if c.isClosed() {
+					break
+				}
 				// 向服务器响应可以进行传输数据
-				if _, err := conn.Write([]byte(CTRLCMD.OK)); nil == err {
+				if err := CTRLCMD.WriteCMD(conn, CTRLCMD.OK); nil == err {
 					// 开始传输数据
 					if nil != c.dataExchangeFunc {
-						err = c.dataExchangeFunc(conn, func() (err error) {
+						atomic.AddInt64(&c.active, 1)
+						if c.HasCapability(CAPREUSE) {
 							// 用过的CONN还是回收利用
-							// return c.writeCMD(conn, CTRLCMD.RESETCONN)
-							return errors.New("break")
-						})
-						if nil == err {
+							tconn := newTransportConn(conn)
+							err = c.dataExchangeFunc(newTransportInfo(service, []string{cmd.Arg(0), cmd.Arg(1)}), tconn, func() error {
+								return c.resetConn(tconn)
+							})
+						} else {
+							err = c.dataExchangeFunc(newTransportInfo(service, []string{cmd.Arg(0), cmd.Arg(1)}), conn, func() (err error) {
+								return errors.New("break")
+							})
+						}
+						atomic.AddInt64(&c.active, -1)
+						if nil == err && !c.isClosed() {
+							idle, idleSince = true, time.Now()
+							atomic.AddInt64(&pool.idle, 1)
+							c.conns.Put(conn, true)
 							continue
 						}
 					}
 				}
 				break
 
-				// 响应服务器的PING, 表示自己还活着
-			} else if cmd == CTRLCMD.CONNHEART {
+				// 响应服务器的PING, 表示自己还活着; 超出最小空闲数且空闲超时的连接不响应直接关闭
+			} else if cmd.Type == CTRLCMD.CONNHEART {
+				if min, _, timeout := c.poolSize(); timeout > 0 && time.Since(idleSince) > timeout && pool.trimIdle(min) {
+					idle = false
+					c.printInfo("Idle-Conn-Timeout: ", conn.LocalAddr().String())
+					break
+				}
 				if err := CTRLCMD.WriteCMD(conn, CTRLCMD.OK); nil != err {
 					break
 				}
@@ -150,6 +555,23 @@ func (c *TCPTunnelClient) handConn(conn net.Conn) {
 	}
 }
 
+// resetConn 结束传输会话并等待服务端的RESETCONN, 成功后连接回到等待命令的状态
+func (c *TCPTunnelClient) resetConn(tconn *transportConn) (err error) {
+	if err = tconn.finish(CMDRTIMEOUT); nil == err {
+		var cmd Frame
+		if cmd, err = c.readCMD(tconn.Conn); nil == err && cmd.Type != CTRLCMD.RESETCONN {
+			err = errors.New("unexpected command after transport: " + cmd.String())
+		}
+		if nil == err {
+			err = CTRLCMD.WriteCMD(tconn.Conn, CTRLCMD.RESETCONN)
+		}
+	}
+	if nil != err {
+		c.printInfo("Reset-Conn error: ", err.Error())
+	}
+	return err
+}
+
 // printInfo 打印信息
 func (c *TCPTunnelClient) printInfo(str ...string) {
 	if c.debug {
@@ -158,21 +580,11 @@ func (c *TCPTunnelClient) printInfo(str ...string) {
 }
 
 // readCMD 读取隧道响应消息
-func (s *TCPTunnelClient) readCMD(conn net.Conn) (cmd string, err error) {
-	b := make([]byte, CMDMAXLEN)
-	if err = conn.SetReadDeadline(time.Now().Add(CMDRTIMEOUT)); nil == err {
-		var n int
-		if n, err = conn.Read(b); nil == err || err == io.EOF {
-			if n > 0 {
-				err = nil
-				cmd = strings.Split(string(b[:n]), "\n")[0]
-			}
-		}
-	}
-	if nil != err {
-		s.printInfo("READ-CMD error: ", err.Error())
+func (c *TCPTunnelClient) readCMD(conn net.Conn) (cmd Frame, err error) {
+	if cmd, err = CTRLCMD.ReadCMD(conn); nil != err {
+		c.printInfo("READ-CMD error: ", err.Error())
 	} else {
-		s.printInfo("READ-CMD:", cmd)
+		c.printInfo("READ-CMD:", cmd.String())
 	}
 	return cmd, err
 }
@@ -10,12 +10,15 @@
 package tunnelcomm
 
 import (
+	"container/list"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"strconv"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/wup364/pakku/utils/logs"
@@ -27,20 +30,58 @@ import (
 // TCPTunnelService 实例化TCP隧道服务端
 func NewTCPTunnelService(listen *net.TCPAddr, isdebug bool) *TCPTunnelService {
 	return &TCPTunnelService{
-		conns:  utypes.NewSafeMap(),
-		sid:    strutil.GetUUID(),
-		listen: listen,
-		debug:  isdebug,
+		clients:   utypes.NewSafeMap(),
+		routes:    utypes.NewSafeMap(),
+		hosts:     utypes.NewSafeMap(),
+		queues:    utypes.NewSafeMap(),
+		listeners: utypes.NewSafeMap(),
+		tunnels:   utypes.NewSafeMap(),
+		draining:  make(chan struct{}),
+		conns:     utypes.NewSafeMap(),
+		done:      make(chan struct{}),
+		sid:       strutil.GetUUID(),
+		listen:    listen,
+		debug:     isdebug,
+		udpIdle:   UDPIDLETIMEOUT,
+		wait:      CONNWAITTIMEOUT,
+		waitMax:   CONNQUEUEMAX,
 	}
 }
 
-// TCPTunnelService TCP隧道服务端
+// TCPTunnelService TCP隧道服务端, 可以同时接入多个客户端
 type TCPTunnelService struct {
-	sid     string          // 实例ID
-	debug   bool            // 是否输出调试信息
-	listen  *net.TCPAddr    // 管道服务端口
-	conns   *utypes.SafeMap // 连上来的线程
-	ctlConn net.Conn        // 控制线程, 只能连接一次
+	sid       string          // 实例ID
+	debug     bool            // 是否输出调试信息
+	listen    *net.TCPAddr    // 管道服务端口
+	clients   *utypes.SafeMap // 已连接的客户端, 客户端ID->*clientSession
+	routes    *utypes.SafeMap // 服务路由, 服务名->*clientSession
+	hosts     *utypes.SafeMap // 域名路由, 域名->*clientSession
+	auth      Authenticator   // 认证器, 为空时不认证
+	tlsConfig *tls.Config     // 隧道端口TLS配置, 为空时使用明文TCP
+	ports     PortRange       // 允许客户端请求的远程端口范围, 为空时不允许
+	speed     int             // 用户连接转发限速, 单位KB/S, 0不限制
+	udpIdle   time.Duration   // UDP会话的空闲超时时间
+	proxies   []*net.IPNet    // 可信的代理网段, 来自这些网段的用户连接需携带PROXY协议头
+	queues    *utypes.SafeMap // 等待隧道连接的用户, 服务名->*connQueue, 队列为空时删除
+	qlock     sync.Mutex      // 等待队列的创建和删除锁
+	wait      time.Duration   // 用户等待隧道连接的超时时间
+	waitMax   int             // 每个服务的最大等待用户数, 0不限制
+	listeners *utypes.SafeMap // 正在服务的用户端口, 排空服务时关闭
+	tunnels   *utypes.SafeMap // 正在服务的隧道端口, 关闭服务时关闭
+	conns     *utypes.SafeMap // 正在处理的用户连接, 关闭服务时等待其结束
+	done      chan struct{}   // 服务关闭信号
+	closeOnce sync.Once
+	draining  chan struct{} // 服务排空信号
+	drainOnce sync.Once
+	lock      sync.Mutex   // 客户端注册锁
+	settings  sync.RWMutex // 运行时可以修改的设置锁, 如认证器、TLS配置、限速
+}
+
+// pooledConn 从连接池取出的数据连接, 释放后放回所属客户端的连接池
+type pooledConn struct {
+	*transportConn
+	client  *clientSession
+	service string
 }
 
 // GetID 获取实例ID
@@ -48,91 +89,363 @@ func (s *TCPTunnelService) GetID() string {
 	return s.sid
 }
 
-// Start 启动隧道服务
-func (s *TCPTunnelService) Start() (err error) {
+// SetToken 设置预共享token, 客户端需要通过挑战应答证明自己持有该token, 为空时不认证
+func (s *TCPTunnelService) SetToken(token string) {
+	if len(token) == 0 {
+		s.SetAuthenticator(nil)
+	} else {
+		s.SetAuthenticator(NewTokenAuthenticator(token))
+	}
+}
+
+// SetAuthenticator 设置认证器, 在建立控制连接和数据连接时调用, 为空时不认证
+// 认证器实现了Revalidator时, 断开凭据在新认证器中已失效的客户端, 证书认证的客户端不受影响
+func (s *TCPTunnelService) SetAuthenticator(auth Authenticator) {
+	s.settings.Lock()
+	s.auth = auth
+	s.settings.Unlock()
+	if checker, ok := auth.(Revalidator); ok {
+		s.revokeClients(checker)
+	}
+}
+
+// revokeClients 断开认证时使用的凭据已失效的客户端
+func (s *TCPTunnelService) revokeClients(checker Revalidator) {
+	clients := s.clients.Values()
+	for i := 0; i < len(clients); i++ {
+		client := clients[i].(*clientSession)
+		if client.identity.cert || checker.Revalidate(client.identity) {
+			continue
+		}
+		logs.Infof("credential revoked, client=%s, identity=%s\r\n", client.id, client.identity.Name)
+		s.removeClient(client)
+	}
+}
+
+// SetTLSConfig 设置隧道端口的TLS配置, 配置了客户端CA时, 客户端证书主题即为客户端身份
+// 启动时已启用TLS的服务可以随时替换配置以轮换证书, 新配置对之后的连接生效; 启动后不能启用或关闭TLS
+func (s *TCPTunnelService) SetTLSConfig(cfg *tls.Config) {
+	s.settings.Lock()
+	defer s.settings.Unlock()
+	s.tlsConfig = cfg
+}
+
+// SetRemotePorts 设置允许客户端请求的远程端口范围, 客户端断开后关闭为其打开的端口
+func (s *TCPTunnelService) SetRemotePorts(ports PortRange) {
+	s.settings.Lock()
+	defer s.settings.Unlock()
+	s.ports = ports
+}
+
+// SetLimitSpeed 设置用户连接的转发限速, 单位KB/S, 0不限制
+func (s *TCPTunnelService) SetLimitSpeed(limitSpeed int) {
+	s.settings.Lock()
+	defer s.settings.Unlock()
+	s.speed = limitSpeed
+}
+
+// SetUDPIdleTimeout 设置UDP会话的空闲超时时间, 超时后释放会话占用的隧道连接
+func (s *TCPTunnelService) SetUDPIdleTimeout(timeout time.Duration) {
+	s.settings.Lock()
+	defer s.settings.Unlock()
+	if timeout > 0 {
+		s.udpIdle = timeout
+	}
+}
+
+// SetTrustedProxies 设置可信的代理网段, 来自这些网段的用户连接必须以PROXY协议头开始, 协议头中的地址作为用户地址
+func (s *TCPTunnelService) SetTrustedProxies(nets []*net.IPNet) {
+	s.settings.Lock()
+	defer s.settings.Unlock()
+	s.proxies = nets
+}
+
+// SetConnWait 设置用户等待隧道连接的超时时间和每个服务的最大等待用户数, 等待数为0时不限制
+func (s *TCPTunnelService) SetConnWait(timeout time.Duration, max int) {
+	s.settings.Lock()
+	defer s.settings.Unlock()
+	if timeout > 0 {
+		s.wait = timeout
+	}
+	if max >= 0 {
+		s.waitMax = max
+	}
+}
+
+// getSettings 读取运行时可以修改的设置
+func (s *TCPTunnelService) getSettings(read func()) {
+	s.settings.RLock()
+	defer s.settings.RUnlock()
+	read()
+}
+
+// Start 启动隧道服务, 阻塞直到服务关闭, 关闭后返回ErrServiceClosed
+// ctx结束时立即关闭服务, 需要等待用户连接结束时使用Shutdown
+func (s *TCPTunnelService) Start(ctx context.Context) (err error) {
 	// 启动控制端口
 	var svr *net.TCPListener
-	if svr, err = net.ListenTCP("tcp", s.listen); nil == err {
-		for {
-			conn, err := svr.AcceptTCP()
-			if nil != err {
-				s.printInfo("AcceptTCP error: ", err.Error())
-				continue
-			}
-			// 处理控制命令
-			if cmds, err := s.readCMD(conn); nil == err {
-				for i := 0; i < len(cmds); i++ {
-					if err = s.handCMD(cmds[i], conn); nil != err {
-						logs.Infoln("HAND-CMD-ERROR: " + err.Error())
-						// 不要关闭控制通道连接
-						if nil == s.ctlConn || s.ctlConn.RemoteAddr().String() != conn.RemoteAddr().String() {
-							conn.Close()
-						}
-						break
-					}
+	if svr, err = net.ListenTCP("tcp", s.listen); nil != err {
+		return err
+	}
+	return s.Serve(ctx, svr)
+}
+
+// Serve 在已打开的监听上启动隧道服务, 如从父进程继承的监听, 其他同Start
+// 监听被外部关闭时返回net.ErrClosed, 服务本身不受影响, 已连接的客户端继续工作
+func (s *TCPTunnelService) Serve(ctx context.Context, listener net.Listener) error {
+	var tlsConfig *tls.Config
+	s.getSettings(func() { tlsConfig = s.tlsConfig })
+	if nil != tlsConfig {
+		// 每个连接使用当前的配置, 替换配置后新连接使用新证书
+		listener = tls.NewListener(listener, &tls.Config{
+			GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+				var cfg *tls.Config
+				s.getSettings(func() { cfg = s.tlsConfig })
+				if nil == cfg {
+					return nil, errors.New("tls is disabled")
 				}
-			} else {
-				conn.Close()
-			}
+				return cfg, nil
+			},
+		})
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Close()
+		case <-stop:
 		}
+	}()
+	return s.serve(listener, true, s.handNewConn)
+}
+
+// handNewConn 处理新连接的第一个命令, 认证过程较慢, 不能阻塞监听
+func (s *TCPTunnelService) handNewConn(conn net.Conn) {
+	if s.isClosed() {
+		conn.Close()
+		return
+	}
+	if err := handshakeTLS(conn); nil != err {
+		s.printInfo("TLS handshake error: ", conn.RemoteAddr().String(), err.Error())
+		conn.Close()
+		return
+	}
+	if cmd, err := s.readCMD(conn); nil == err {
+		if err = s.handCMD(cmd, conn); nil != err {
+			logs.Infoln("HAND-CMD-ERROR: " + err.Error())
+			conn.Close()
+		}
+	} else {
+		conn.Close()
+	}
+}
+
+// GetClients 获取已连接的客户端ID
+func (s *TCPTunnelService) GetClients() []string {
+	keys := s.clients.Keys()
+	res := make([]string, len(keys))
+	for i := 0; i < len(keys); i++ {
+		res[i] = keys[i].(string)
+	}
+	return res
+}
+
+// GetServices 获取所有已连接客户端提供的服务名
+func (s *TCPTunnelService) GetServices() []string {
+	keys := s.routes.Keys()
+	res := make([]string, len(keys))
+	for i := 0; i < len(keys); i++ {
+		res[i] = keys[i].(string)
+	}
+	return res
+}
+
+// CountConn 统计服务的空闲连接数, service为空时统计所有客户端的所有服务
+func (s *TCPTunnelService) CountConn(service string) (count int) {
+	if len(service) > 0 {
+		if client := s.getRoute(service); nil != client {
+			count = client.countConn(service)
+		}
+		return count
+	}
+	clients := s.clients.Values()
+	for i := 0; i < len(clients); i++ {
+		count += clients[i].(*clientSession).countConn("")
+	}
+	return count
+}
+
+// getRoute 获取提供该服务的客户端, 没有时返回nil
+func (s *TCPTunnelService) getRoute(service string) *clientSession {
+	if val, ok := s.routes.Get(service); ok {
+		return val.(*clientSession)
+	}
+	return nil
+}
+
+// addClient 注册客户端及其服务路由, 同一客户端重连时替换旧的会话, 服务名已被其他客户端使用时拒绝
+func (s *TCPTunnelService) addClient(client *clientSession) (err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.isClosed() {
+		return ErrServiceClosed
+	}
+	var old *clientSession
+	if val, ok := s.clients.Get(client.id); ok {
+		if old = val.(*clientSession); old.identity.Name != client.identity.Name {
+			return errors.New("invalid command: client id " + client.id + " is used by another identity")
+		}
+	}
+	if err = s.checkRoutes(client.services, client.hosts, old); nil != err {
+		return err
+	}
+	if nil != old {
+		logs.Infof("client reconnected, replace the old control channel, client=%s, conn=%s\r\n", old.id, old.conn.RemoteAddr().String())
+		s.unmapClient(old)
+		old.close()
+	}
+	s.clients.Put(client.id, client)
+	for i := 0; i < len(client.services); i++ {
+		s.routes.Put(client.services[i], client)
+	}
+	for host := range client.hosts {
+		s.hosts.Put(host, client)
 	}
 	return err
 }
 
-// clearAllConns 关闭所有连接
-func (s *TCPTunnelService) clearAllConns() {
-	if s.conns != nil && s.conns.Size() > 0 {
-		conns := s.conns.Values()
-		s.conns.Clear()
-		go func() {
-			for i := 0; i < len(conns); i++ {
-				if conn, ok := conns[i].(net.Conn); ok {
-					s.printInfo("Close-Conn: ", conn.RemoteAddr().String())
-					conn.Close()
-				}
-			}
-		}()
+// checkRoutes 检查服务名和域名没有被其他客户端使用, owner为可以替换的客户端, 调用方持有s.lock
+func (s *TCPTunnelService) checkRoutes(services []string, hosts map[string]string, owner *clientSession) error {
+	for i := 0; i < len(services); i++ {
+		if route := s.getRoute(services[i]); nil != route && route != owner {
+			return fmt.Errorf("invalid command: service %s is provided by client %s", services[i], route.id)
+		}
+	}
+	for host := range hosts {
+		if val, ok := s.hosts.Get(host); ok && val != owner {
+			return fmt.Errorf("invalid command: host %s is routed to client %s", host, val.(*clientSession).id)
+		}
 	}
+	return nil
+}
+
+// removeClient 注销客户端并关闭其所有连接
+func (s *TCPTunnelService) removeClient(client *clientSession) {
+	s.lock.Lock()
+	s.unmapClient(client)
+	s.lock.Unlock()
+	client.close()
+}
+
+// unmapClient 删除客户端及其服务路由, 已被新会话替换的不删除
+func (s *TCPTunnelService) unmapClient(client *clientSession) {
+	if val, ok := s.clients.Get(client.id); ok && val == client {
+		s.clients.Delete(client.id)
+	}
+	s.unmapRoutes(client, client.getServices(), client.getHosts())
 }
 
-// handCMD 处理控制命令, 返回执行异常
-func (s *TCPTunnelService) handCMD(cmd string, conn net.Conn) (err error) {
-	if len(cmd) == 0 || nil == conn {
+// unmapRoutes 删除仍指向客户端的服务路由和域名路由
+func (s *TCPTunnelService) unmapRoutes(client *clientSession, services []string, hosts map[string]string) {
+	for i := 0; i < len(services); i++ {
+		if s.getRoute(services[i]) == client {
+			s.routes.Delete(services[i])
+		}
+	}
+	for host := range hosts {
+		if val, ok := s.hosts.Get(host); ok && val == client {
+			s.hosts.Delete(host)
+		}
+	}
+}
+
+// getHostService 获取域名对应的服务名, 没有时返回空
+func (s *TCPTunnelService) getHostService(host string) string {
+	candidates := hostCandidates(host)
+	for i := 0; i < len(candidates); i++ {
+		if val, ok := s.hosts.Get(candidates[i]); ok {
+			return val.(*clientSession).getHosts()[candidates[i]]
+		}
+	}
+	return ""
+}
+
+// handCMD 处理新连接的第一个命令, 返回执行异常
+func (s *TCPTunnelService) handCMD(cmd Frame, conn net.Conn) (err error) {
+	if nil == conn {
 		return errors.New("invalid command")
 
 		// 控制通道连接信号
-	} else if cmd == CTRLCMD.NEWCTRLCONN {
-		if nil != s.ctlConn {
-			return errors.New("invalid command: the control channel cannot be connected repeatedly")
+	} else if cmd.Type == CTRLCMD.NEWCTRLCONN {
+		var req HelloRequest
+		var res HelloResponse
+		if err = decodeJSONArg(cmd.Arg(0), &req); nil != err {
+			return s.reject(conn, errors.New("invalid hello message, the client may be too old"))
+		}
+		if res, err = negotiateHello(req); nil != err {
+			return s.reject(conn, err)
+		}
+		var identity Identity
+		if identity, err = s.challenge(conn, req.ClientID); nil != err {
+			return s.reject(conn, err)
+		}
+		client := newClientSession(conn, req, res, identity)
+		if err = s.addClient(client); nil != err {
+			return s.reject(conn, err)
+		}
+		if res.Ports, err = s.openRemotePorts(client); nil != err {
+			err = s.reject(conn, err)
+			s.removeClient(client)
+			return err
+		}
+		if err = client.accept(res); nil != err {
+			s.removeClient(client)
+			return err
+		}
+		if s.isDraining() {
+			s.pushDrain(client)
 		}
-		s.ctlConn = conn
-		s.clearAllConns()
-		go s.startCmdCtrl()   // 启动控制端
-		go s.startConnCheck() // 启动心跳检测
-		logs.Infoln("console is connected, conn=" + conn.RemoteAddr().String())
+		go s.startCmdCtrl(client)   // 启动控制端
+		go s.startConnCheck(client) // 启动心跳检测
+		logs.Infof("console is connected, conn=%s, client=%s, identity=%s, version=%d, capabilities=%v, services=%v, ports=%v\r\n", conn.RemoteAddr().String(), req.ClientID, identity.Name, res.Version, res.Capabilities, client.services, res.Ports)
 
 		// 新隧道链接信号
-	} else if cmd == CTRLCMD.NEWUSERCONN {
-		if nil == s.ctlConn {
-			return errors.New("invalid command: waiting for control channel connection")
+	} else if cmd.Type == CTRLCMD.NEWUSERCONN {
+		var client *clientSession
+		if client, err = s.verifyDataConn(cmd, conn); nil != err {
+			return err
 		}
-		if s.ctlConn.RemoteAddr().String() == conn.RemoteAddr().String() {
-			return errors.New("invalid command: cannot use control channel as tunnel")
+		service := cmd.Arg(1)
+		if len(service) == 0 {
+			service = DEFAULTSERVICE
+		}
+		if !client.hasService(service) {
+			return s.reject(conn, errors.New("invalid command: unknown service "+service))
+		}
+		if err = CTRLCMD.WriteCMD(conn, CTRLCMD.OK); nil == err {
+			if err = client.putConn(service, conn); nil == err {
+				s.notifyConn(service)
+			}
 		}
-		s.conns.PutX(conn.RemoteAddr().String(), conn)
 
-		// 统计隧道连接数量
-	} else if cmd == CTRLCMD.COUNTCONN {
-		if nil == s.ctlConn {
-			return errors.New("invalid command: waiting for control channel connection")
+		// 新多路复用连接信号
+	} else if cmd.Type == CTRLCMD.NEWMUXCONN {
+		var client *clientSession
+		if client, err = s.verifyDataConn(cmd, conn); nil != err {
+			return err
 		}
-		if s.ctlConn.RemoteAddr().String() != conn.RemoteAddr().String() {
-			return errors.New("invalid command: insufficient permissions, the current connection is not a control channel")
+		if !hasCapability(client.caps, CAPMUX) {
+			return s.reject(conn, errors.New("invalid command: multiplexing is not negotiated"))
 		}
-		if err = conn.SetWriteDeadline(time.Now().Add(CMDWTIMEOUT)); nil == err {
-			_, err = conn.Write([]byte(strconv.Itoa(s.conns.Size())))
+		if err = CTRLCMD.WriteCMD(conn, CTRLCMD.OK); nil == err {
+			s.addMuxSession(client, conn)
 		}
 
+		// 控制命令只能在控制通道上发送
+	} else if cmd.Type == CTRLCMD.COUNTCONN {
+		err = errors.New("invalid command: insufficient permissions, the current connection is not a control channel")
+
 		// 无效命令
 	} else {
 		err = errors.New("invalid command")
@@ -141,26 +454,332 @@ func (s *TCPTunnelService) handCMD(cmd string, conn net.Conn) (err error) {
 	return err
 }
 
-// startCmdCtrl 启动命令控制端
-func (s *TCPTunnelService) startCmdCtrl() {
-	defer func() {
-		s.clearAllConns()
-		if nil != s.ctlConn {
-			s.ctlConn.Close()
-			s.ctlConn = nil
+// openRemotePorts 为客户端监听请求的远程端口, 返回实际监听的端口
+func (s *TCPTunnelService) openRemotePorts(client *clientSession) (ports map[string]int, err error) {
+	if len(client.ports) == 0 {
+		return nil, nil
+	}
+	var allowed PortRange
+	s.getSettings(func() { allowed = s.ports })
+	if allowed.Min == 0 {
+		return nil, errors.New("the server does not allow remote ports")
+	}
+	ports = make(map[string]int, len(client.ports))
+	var opened []net.Listener
+	for name, port := range client.ports {
+		var listener net.Listener
+		if listener, err = allowed.Listen(port); nil != err {
+			break
 		}
+		// 客户端已断开时监听被立即关闭
+		if err = client.addListener(name, listener); nil != err {
+			break
+		}
+		opened = append(opened, listener)
+		ports[name] = listener.Addr().(*net.TCPAddr).Port
+		go s.ServeListener(listener, name)
+	}
+	if nil != err {
+		for i := 0; i < len(opened); i++ {
+			opened[i].Close()
+		}
+		return nil, err
+	}
+	return ports, err
+}
+
+// ServeListener 接受用户连接并转发到提供该服务的客户端, 监听或服务关闭后返回
+func (s *TCPTunnelService) ServeListener(listener net.Listener, service string) error {
+	return s.serve(listener, false, func(conn net.Conn) {
+		s.handUserConn(conn, service)
+	})
+}
+
+// handUserConn 等待服务的空闲隧道连接并交换数据, 超时后关闭用户连接
+func (s *TCPTunnelService) handUserConn(conn4src net.Conn, service string) {
+	defer conn4src.Close()
+	if !s.trackConn(conn4src) {
+		return
+	}
+	defer s.conns.Delete(conn4src)
+	if conn, err := s.readProxyConn(conn4src); nil == err {
+		s.forwardConn(conn, service)
+	}
+}
+
+// readProxyConn 来自可信代理的用户连接读取PROXY协议头, 返回使用真实用户地址的连接, 其他连接原样返回
+func (s *TCPTunnelService) readProxyConn(conn net.Conn) (net.Conn, error) {
+	var proxies []*net.IPNet
+	s.getSettings(func() { proxies = s.proxies })
+	pconn, err := ReadProxyHeader(conn, proxies)
+	if nil != err {
+		logs.Infof("read proxy protocol header failed, conn=%s, error=%s\r\n", conn.RemoteAddr().String(), err.Error())
+		return nil, err
+	}
+	return pconn, nil
+}
+
+// forwardConn 等待服务的空闲隧道连接并交换数据, 没有可用隧道连接时返回false
+func (s *TCPTunnelService) forwardConn(conn4src net.Conn, service string) bool {
+	s.printInfo("User-Conn: ", conn4src.RemoteAddr().String(), service)
+	// 获取管道连接
+	conn4dst, err := s.AcquireConn(context.Background(), service, conn4src.RemoteAddr(), conn4src.LocalAddr())
+	if nil != err {
+		s.printInfo("Acquire-Conn error: ", service, err.Error())
+		return false
+	}
+	// 交换数据, 结束后释放隧道连接以便复用
+	var speed int
+	s.getSettings(func() { speed = s.speed })
+	logs.Debugf("Exchange-Start %s\r\n", conn4dst.RemoteAddr().String())
+	if err := PipeConn(conn4src, conn4dst, 2048, speed); nil != err {
+		logs.Errorln(err)
+	}
+	logs.Debugf("Exchange-End %s\r\n", conn4dst.RemoteAddr().String())
+	s.RelaseConn(conn4dst)
+	return true
+}
+
+// AcquireConn 获取服务的隧道连接, 没有空闲连接时按先后顺序排队等待, 有新连接时唤醒
+// 等待超过SetConnWait设置的超时时间或ctx结束时返回错误, 排队用户已达上限时返回ErrConnQueueFull, 服务关闭时返回ErrServiceClosed
+func (s *TCPTunnelService) AcquireConn(ctx context.Context, service string, src, dst net.Addr) (net.Conn, error) {
+	var wait time.Duration
+	var waitMax int
+	s.getSettings(func() { wait, waitMax = s.wait, s.waitMax })
+	// 没有用户排队时直接获取, 已有用户排队时新用户不能插队
+	if s.queueSize(service) == 0 {
+		if conn := s.GetConn(service, src, dst); nil != conn {
+			return conn, nil
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+	queue, waiter, err := s.enqueue(service, waitMax)
+	if nil != err {
+		return nil, err
+	}
+	s.needConn(service, 1)
+	for {
+		// 只有队首的用户获取连接, 取得连接前一直留在队首
+		if queue.isFront(waiter) {
+			if conn := s.GetConn(service, src, dst); nil != conn {
+				s.dequeue(service, queue, waiter)
+				return conn, nil
+			}
+			// 加入队列前到达的连接不会再通知
+			if s.hasIdleConn(service) {
+				queue.wake()
+			}
+		}
+		select {
+		case <-waiter.Value.(chan struct{}):
+		case <-s.done:
+			s.dequeue(service, queue, waiter)
+			return nil, ErrServiceClosed
+		case <-ctx.Done():
+			s.dequeue(service, queue, waiter)
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// enqueue 加入服务的等待队列, 队列不存在时创建
+func (s *TCPTunnelService) enqueue(service string, max int) (*connQueue, *list.Element, error) {
+	s.qlock.Lock()
+	defer s.qlock.Unlock()
+	val, ok := s.queues.Get(service)
+	if !ok {
+		val = newConnQueue()
+		s.queues.Put(service, val)
+	}
+	queue := val.(*connQueue)
+	waiter, err := queue.push(max)
+	return queue, waiter, err
+}
+
+// dequeue 离开服务的等待队列, 队列为空时删除, 离开的是队首时唤醒下一个用户
+func (s *TCPTunnelService) dequeue(service string, queue *connQueue, waiter *list.Element) {
+	s.qlock.Lock()
+	defer s.qlock.Unlock()
+	if queue.remove(waiter) {
+		queue.wake()
+	}
+	if queue.size() == 0 {
+		s.queues.Delete(service)
+	}
+}
+
+// queueSize 服务排队等待的用户数
+func (s *TCPTunnelService) queueSize(service string) int {
+	if queue, ok := s.queues.Get(service); ok {
+		return queue.(*connQueue).size()
+	}
+	return 0
+}
+
+// notifyConn 服务有新的隧道连接, 唤醒等待的用户
+func (s *TCPTunnelService) notifyConn(service string) {
+	if queue, ok := s.queues.Get(service); ok {
+		queue.(*connQueue).wake()
+	}
+}
+
+// needConn 向提供服务的客户端推送新增的连接需求, 客户端据此补充连接
+// 只推送增量, 客户端累加后为每个需求建立一个连接
+func (s *TCPTunnelService) needConn(service string, delta int) {
+	if client := s.getRoute(service); nil != client {
+		count := strconv.Itoa(delta)
+		go func() {
+			if err := client.push(CAPNEEDCONN, CTRLCMD.NEEDCONN, service, count); nil != err {
+				s.printInfo("Push need conn error: ", client.id, err.Error())
+			}
+		}()
+	}
+}
+
+// hasIdleConn 服务是否有空闲连接或可以打开逻辑流的多路复用会话
+func (s *TCPTunnelService) hasIdleConn(service string) bool {
+	client := s.getRoute(service)
+	if nil == client {
+		return false
+	}
+	if client.countConn(service) > 0 {
+		return true
+	}
+	sessions := client.sessions.Values()
+	for i := 0; i < len(sessions); i++ {
+		if sessions[i].(*MuxSession).Available() {
+			return true
+		}
+	}
+	return false
+}
+
+// handCtrlCMD 处理客户端控制通道上的命令
+func (s *TCPTunnelService) handCtrlCMD(client *clientSession, cmd Frame) (err error) {
+	// 统计隧道连接数量
+	if cmd.Type == CTRLCMD.COUNTCONN {
+		err = client.writeCMD(CTRLCMD.COUNTCONN, strconv.Itoa(client.countConn(cmd.Arg(0))))
+
+		// 控制通道心跳
+	} else if cmd.Type == CTRLCMD.CONNHEART {
+		err = client.writeCMD(CTRLCMD.CONNHEART)
+
+		// 更新客户端提供的服务, 拒绝时保留原服务并返回原因
+	} else if cmd.Type == CTRLCMD.SERVICES {
+		var req HelloRequest
+		var res HelloResponse
+		if err = decodeJSONArg(cmd.Arg(0), &req); nil == err {
+			res.Ports, err = s.updateServices(client, req)
+		}
+		if nil != err {
+			res.Reason = err.Error()
+			logs.Infof("update services rejected, client=%s, error=%s\r\n", client.id, err.Error())
+		}
+		err = client.writeCMD(CTRLCMD.SERVICES, encodeJSONArg(res))
+
+		// 无效命令
+	} else {
+		err = errors.New("invalid command: " + cmd.String())
+	}
+	return err
+}
+
+// verifyDataConn 校验数据连接, 必须属于已连接的客户端且身份与其控制通道一致
+func (s *TCPTunnelService) verifyDataConn(cmd Frame, conn net.Conn) (client *clientSession, err error) {
+	val, ok := s.clients.Get(cmd.Arg(0))
+	if !ok {
+		return nil, s.reject(conn, errors.New("invalid command: unknown client "+cmd.Arg(0)))
+	}
+	client = val.(*clientSession)
+	var identity Identity
+	if identity, err = s.challenge(conn, client.id); nil != err {
+		return nil, s.reject(conn, err)
+	}
+	if identity.Name != client.identity.Name {
+		return nil, s.reject(conn, errors.New("invalid command: identity does not match the control channel"))
+	}
+	return client, err
+}
+
+// addMuxSession 将连接转为客户端的多路复用会话, 会话关闭后自动移除
+func (s *TCPTunnelService) addMuxSession(client *clientSession, conn net.Conn) {
+	key := conn.RemoteAddr().String()
+	session := NewMuxSession(conn, false)
+	client.sessions.Put(key, session)
+	if client.isClosed() {
+		session.Close()
+	}
+	s.printInfo("Mux-Session: ", client.id, key)
+	services := client.getServices()
+	for i := 0; i < len(services); i++ {
+		s.notifyConn(services[i])
+	}
+	go func() {
+		<-session.Done()
+		client.sessions.Delete(key)
+		s.printInfo("Mux-Session-Closed: ", client.id, key)
 	}()
+}
+
+// challenge 挑战应答认证, 发送随机数并交由认证器校验客户端的凭据
+// 客户端已出示经过校验的证书时, 直接使用证书主题作为身份
+func (s *TCPTunnelService) challenge(conn net.Conn, clientID string) (identity Identity, err error) {
+	if name := peerCertIdentity(conn); len(name) > 0 {
+		return Identity{Name: name, ClientID: clientID, cert: true}, nil
+	}
+	var auth Authenticator
+	s.getSettings(func() { auth = s.auth })
+	if nil == auth {
+		return Identity{Name: clientID, ClientID: clientID}, nil
+	}
+	cred := Credentials{}
+	if cred.Nonce, err = newNonce(); nil != err {
+		return identity, err
+	}
+	if err = CTRLCMD.WriteCMD(conn, CTRLCMD.AUTH, cred.Nonce); nil != err {
+		return identity, err
+	}
+	var cmd Frame
+	if cmd, err = s.readCMD(conn); nil != err {
+		return identity, err
+	}
+	if cmd.Type != CTRLCMD.AUTH {
+		return identity, ErrAuthFailed
+	}
+	cred.Proof, cred.User = cmd.Arg(0), cmd.Arg(1)
+	if identity, err = auth.Authenticate(clientID, cred, conn.RemoteAddr()); nil != err {
+		logs.Infof("authentication failed, conn=%s, client=%s, user=%s, error=%s\r\n", conn.RemoteAddr().String(), clientID, cred.User, err.Error())
+		return identity, ErrAuthFailed
+	}
+	return identity, err
+}
+
+// reject 向对端发送拒绝原因, 返回原因
+func (s *TCPTunnelService) reject(conn net.Conn, reason error) error {
+	res := HelloResponse{Version: PROTOCOLVERSION, Capabilities: capabilities, Reason: reason.Error()}
+	if err := CTRLCMD.WriteCMD(conn, CTRLCMD.REJECT, encodeJSONArg(res)); nil != err {
+		s.printInfo("Send reject error: ", err.Error())
+	}
+	return reason
+}
+
+// startCmdCtrl 启动客户端的命令控制端, 退出时注销客户端
+func (s *TCPTunnelService) startCmdCtrl(client *clientSession) {
+	defer s.removeClient(client)
 	errorCount := 0
-	for {
-		if cmds, err := s.readCMD(s.ctlConn); nil == err && len(cmds) > 0 {
+	for !client.isClosed() {
+		if cmd, err := s.readCMD(client.conn); nil == err {
 			errorCount = 0
-			for i := 0; i < len(cmds); i++ {
-				if err = s.handCMD(cmds[i], s.ctlConn); nil != err {
-					logs.Infoln("HAND-CMD-ERROR: " + err.Error())
-				}
+			if err = s.handCtrlCMD(client, cmd); nil != err {
+				logs.Infoln("HAND-CMD-ERROR: " + err.Error())
 			}
 		} else {
-			logs.Infof("控制指令读取失败, cmd=%d, error=%s, count=%s \r\n", errorCount, cmds, err)
+			logs.Infof("控制指令读取失败, client=%s, count=%d, error=%s \r\n", client.id, errorCount, err)
+			// 连接已关闭或帧数据已损坏, 无法继续解析
+			if errors.Is(err, io.EOF) || errors.Is(err, ErrFrameTruncated) || errors.Is(err, ErrFrameTooLarge) {
+				break
+			}
 			if errorCount++; errorCount <= 30 {
 				time.Sleep(time.Second)
 				continue
@@ -168,63 +787,96 @@ func (s *TCPTunnelService) startCmdCtrl() {
 			break
 		}
 	}
+	logs.Infof("console is disconnected, client=%s, conn=%s\r\n", client.id, client.conn.RemoteAddr().String())
 }
 
-// startConnCheck 保持心跳
-func (s *TCPTunnelService) startConnCheck() {
-	for {
-		// 1. 选取出素有的key, 再根据key一个一个的检查
-		keys := s.conns.Keys()
-		// 2. 发送心跳指令, 每次检查25个
-		if lenkey := len(keys); lenkey > 0 {
-			checkedCount := 0
-			worker := upool.NewGoWorker(25, 100)
-			for i := 0; i < lenkey; i++ {
-				worker.AddJob(upool.NewSimpleJob(func(sj *upool.SimpleJob) {
-					s.printInfo("Check-Conn: ", sj.ID)
-					if val, ok := s.conns.Cut(sj.ID); ok {
-						if tconn, ok := val.(net.Conn); ok {
-							var err error
-							if err = CTRLCMD.WriteCMD(tconn, CTRLCMD.CONNHEART); nil == err {
-								if cmds, _ := s.readCMD(tconn); len(cmds) == 0 || cmds[0] != CTRLCMD.OK {
-									err = errors.New("Connect heart response is error, responsed: " + fmt.Sprintf("%s", cmds))
-								}
+// startConnCheck 保持客户端空闲连接的心跳, 客户端注销后退出
+func (s *TCPTunnelService) startConnCheck(client *clientSession) {
+	for !client.isClosed() {
+		services := client.pools.Keys()
+		for i := 0; i < len(services); i++ {
+			s.checkPool(client, services[i].(string))
+		}
+		select {
+		case <-client.closed:
+		case <-time.After(time.Duration(10) * time.Second):
+		}
+	}
+}
+
+// checkPool 检查连接池中的空闲连接, 删除无响应的连接
+func (s *TCPTunnelService) checkPool(client *clientSession, service string) {
+	pool := client.getPool(service)
+	// 1. 选取出素有的key, 再根据key一个一个的检查
+	keys := pool.Keys()
+	// 2. 发送心跳指令, 每次检查25个
+	if lenkey := len(keys); lenkey > 0 {
+		checkedCount := 0
+		worker := upool.NewGoWorker(25, 100)
+		for i := 0; i < lenkey; i++ {
+			worker.AddJob(upool.NewSimpleJob(func(sj *upool.SimpleJob) {
+				s.printInfo("Check-Conn: ", sj.ID)
+				if val, ok := pool.Cut(sj.ID); ok {
+					if tconn, ok := val.(net.Conn); ok {
+						var err error
+						if err = CTRLCMD.WriteCMD(tconn, CTRLCMD.CONNHEART); nil == err {
+							if cmd, _ := s.readCMD(tconn); cmd.Type != CTRLCMD.OK {
+								err = errors.New("Connect heart response is error, responsed: " + cmd.String())
 							}
-							if nil != err {
-								s.printInfo("Delete-Conn: ", sj.ID, err.Error())
-								tconn.Close()
-							} else {
-								s.conns.PutX(tconn.RemoteAddr().String(), val)
+						}
+						if nil == err {
+							if err = client.putConn(service, tconn); nil == err {
+								s.notifyConn(service)
 							}
 						}
+						if nil != err {
+							s.printInfo("Delete-Conn: ", sj.ID, err.Error())
+							tconn.Close()
+						}
 					}
-					checkedCount++
-					if checkedCount >= lenkey {
-						worker.CloseGoWorker()
-					}
-				}, keys[i].(string), nil))
-			}
-			worker.WaitGoWorkerClose()
+				}
+				checkedCount++
+				if checkedCount >= lenkey {
+					worker.CloseGoWorker()
+				}
+			}, keys[i].(string), nil))
 		}
-		time.Sleep(time.Duration(10) * time.Second)
+		worker.WaitGoWorkerClose()
 	}
 }
 
-// GetConn 获取一个空闲连接, 可用链接-1
-func (s *TCPTunnelService) GetConn() net.Conn {
-	if s.conns.Size() > 0 {
-		keys := s.conns.Keys()
+// GetConn 获取服务的一个空闲连接, 可用链接-1; 客户端使用多路复用时, 在负载最小的会话上打开一个逻辑流
+// src和dst为用户连接的来源地址和访问地址, 随传输命令发送给客户端, 可以为空
+func (s *TCPTunnelService) GetConn(service string, src, dst net.Addr) net.Conn {
+	client := s.getRoute(service)
+	if nil == client {
+		return nil
+	}
+	if stream := s.openStream(client, service, src, dst); nil != stream {
+		return stream
+	}
+	if pool := client.getPool(service); pool.Size() > 0 {
+		keys := pool.Keys()
 		for i := 0; i < len(keys); i++ {
-			if val, ok := s.conns.Cut(keys[i]); ok {
+			if val, ok := pool.Cut(keys[i]); ok {
 				conn := val.(net.Conn)
-				if err := CTRLCMD.WriteCMD(conn, CTRLCMD.STARTTRANSPORT); nil != err {
+				if err := CTRLCMD.WriteCMD(conn, CTRLCMD.STARTTRANSPORT, addrString(src), addrString(dst)); nil != err {
 					s.printInfo("Send transport start cmd error: ", err.Error())
+					conn.Close()
 					continue
 				}
 				//
-				if cmds, _ := s.readCMD(conn); len(cmds) == 0 || cmds[0] != CTRLCMD.OK {
+				if cmd, _ := s.readCMD(conn); cmd.Type != CTRLCMD.OK {
+					conn.Close()
 					continue
 				}
+				// 连接池已空, 通知客户端补充空闲连接, 排队的用户加入时已推送过需求
+				if pool.Size() == 0 {
+					s.needConn(service, 0)
+				}
+				if hasCapability(client.caps, CAPREUSE) {
+					return &pooledConn{transportConn: newTransportConn(conn), client: client, service: service}
+				}
 				return conn
 			}
 		}
@@ -232,57 +884,59 @@ func (s *TCPTunnelService) GetConn() net.Conn {
 	return nil
 }
 
-// RelaseConn 释放连接, 如不释放, 隧道终端可能会一直创建新的链接
-func (s *TCPTunnelService) RelaseConn(conn net.Conn) (err error) {
-	if err = CTRLCMD.WriteCMD(conn, CTRLCMD.RESETCONN); nil == err {
-		if cmds, _ := s.readCMD(conn); len(cmds) == 0 || cmds[0] == CTRLCMD.RESETCONN {
-			if err = s.conns.PutX(conn.RemoteAddr().String(), conn); nil == err {
-				s.printInfo("Relase-Conn", conn.RemoteAddr().String())
+// openStream 在客户端逻辑流最少的可用会话上打开服务的逻辑流, 没有可用会话时返回nil
+func (s *TCPTunnelService) openStream(client *clientSession, service string, src, dst net.Addr) net.Conn {
+	var session *MuxSession
+	sessions := client.sessions.Values()
+	for i := 0; i < len(sessions); i++ {
+		if val := sessions[i].(*MuxSession); val.Available() {
+			if nil == session || val.NumStreams() < session.NumStreams() {
+				session = val
 			}
 		}
 	}
-	return err
+	if nil != session {
+		if stream, err := session.Open(service, addrString(src), addrString(dst)); nil == err {
+			return stream
+		} else {
+			s.printInfo("Open stream error: ", err.Error())
+		}
+	}
+	return nil
 }
 
-// readCMD 读取隧道响应消息
-func (s *TCPTunnelService) readCMD(conn net.Conn) (cmds []string, err error) {
-	if nil == conn {
-		return cmds, errors.New("conn is nil")
-	}
-	if err = conn.SetReadDeadline(time.Now().Add(CMDRTIMEOUT)); nil == err {
-		buf := make([]byte, 0)
-		for {
-			var n int
-			temp := make([]byte, CMDMAXLEN)
-			if n, err = conn.Read(temp); n > 0 {
-				buf = append(buf, temp[:n]...)
-				if n < CMDMAXLEN {
-					break
-				}
-			} else if err != nil {
-				break
-			}
-		}
-		if nil == err || err == io.EOF {
-			err = nil
-			if len(buf) > 0 {
-				tmp := make([]string, 0)
-				cmds = strings.Split(string(buf), "\n")
-				for i := 0; i < len(cmds); i++ {
-					if len(cmds[i]) > 0 {
-						tmp = append(tmp, cmds[i])
-					}
-				}
-				cmds = tmp
+// RelaseConn 释放连接, 如不释放, 隧道终端可能会一直创建新的链接
+// 支持复用的连接在双方结束传输并确认RESETCONN后放回所属客户端的连接池, 其他连接直接关闭
+func (s *TCPTunnelService) RelaseConn(conn net.Conn) (err error) {
+	pconn, ok := conn.(*pooledConn)
+	if !ok {
+		return conn.Close()
+	}
+	if err = pconn.finish(CMDRTIMEOUT); nil == err {
+		if err = CTRLCMD.WriteCMD(pconn.Conn, CTRLCMD.RESETCONN); nil == err {
+			if cmd, _ := s.readCMD(pconn.Conn); cmd.Type != CTRLCMD.RESETCONN {
+				err = errors.New("reset connection response is error, responsed: " + cmd.String())
+			} else if err = pconn.client.putConn(pconn.service, pconn.Conn); nil == err {
+				s.printInfo("Relase-Conn", pconn.RemoteAddr().String())
+				s.notifyConn(pconn.service)
 			}
 		}
 	}
 	if nil != err {
+		s.printInfo("Relase-Conn error: ", pconn.RemoteAddr().String(), err.Error())
+		pconn.Conn.Close()
+	}
+	return err
+}
+
+// readCMD 读取隧道响应消息
+func (s *TCPTunnelService) readCMD(conn net.Conn) (cmd Frame, err error) {
+	if cmd, err = CTRLCMD.ReadCMD(conn); nil != err {
 		s.printInfo("READ-CMD error: ", err.Error())
 	} else {
-		s.printInfo("READ-CMD:", fmt.Sprintf("%s", cmds))
+		s.printInfo("READ-CMD:", cmd.String())
 	}
-	return cmds, err
+	return cmd, err
 }
 
 // printInfo 打印信息
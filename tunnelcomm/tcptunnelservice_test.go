@@ -0,0 +1,233 @@
+// Copyright (C) 2022 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package tunnelcomm
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startTestService 在随机端口启动隧道服务
+func startTestService(t *testing.T) (*TCPTunnelService, *net.TCPAddr) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().(*net.TCPAddr)
+	listener.Close()
+	service := NewTCPTunnelService(addr, false)
+	service.SetToken("secret")
+	go service.Start(context.Background())
+	t.Cleanup(func() { service.Close() })
+	time.Sleep(100 * time.Millisecond)
+	return service, addr
+}
+
+// newTestClient 创建回写客户端ID和服务名的隧道客户端
+func newTestClient(addr *net.TCPAddr, id string, services ...string) *TCPTunnelClient {
+	client := NewTCPTunnelClient(addr, 2, false)
+	client.SetID(id)
+	client.SetToken("secret")
+	client.SetServices(services...)
+	client.SetTransportCallback(func(info TransportInfo, conn net.Conn, release func() error) error {
+		conn.Write([]byte(id + ":" + info.Service))
+		return release()
+	})
+	return client
+}
+
+// waitConn 等待服务的空闲连接
+func waitConn(t *testing.T, service *TCPTunnelService, name string) net.Conn {
+	for i := 0; i < 50; i++ {
+		if conn := service.GetConn(name, nil, nil); nil != conn {
+			return conn
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatal("no tunnel connection for service " + name)
+	return nil
+}
+
+func TestServiceMultiClient(t *testing.T) {
+	service, addr := startTestService(t)
+	go newTestClient(addr, "branch1", "ssh", "rdp").Start(context.Background())
+	go newTestClient(addr, "branch2", "web").Start(context.Background())
+	for _, name := range []string{"ssh", "web", "rdp", "ssh"} {
+		conn := waitConn(t, service, name)
+		got, err := io.ReadAll(conn)
+		if nil != err {
+			t.Fatal(err)
+		}
+		if want := map[string]string{"ssh": "branch1:ssh", "rdp": "branch1:rdp", "web": "branch2:web"}[name]; string(got) != want {
+			t.Fatal(string(got), want)
+		}
+		if err = service.RelaseConn(conn); nil != err {
+			t.Fatal(err)
+		}
+	}
+	if clients := service.GetClients(); len(clients) != 2 {
+		t.Fatal(clients)
+	}
+	// 服务名已被其他客户端使用
+	if err := newTestClient(addr, "branch3", "web").Start(context.Background()); nil == err || !strings.Contains(err.Error(), "service web") {
+		t.Fatal(err)
+	}
+	if conn := service.GetConn("unknown", nil, nil); nil != conn {
+		t.Fatal("unexpected connection for unknown service")
+	}
+}
+
+func TestServiceRemotePort(t *testing.T) {
+	service, addr := startTestService(t)
+	service.SetRemotePorts(PortRange{Host: "127.0.0.1", Min: 1024, Max: 65535})
+	client := newTestClient(addr, "branch1", "web")
+	client.SetRemotePorts(map[string]int{"web": 0})
+	go client.Start(context.Background())
+	var port int
+	for i := 0; i < 50 && port == 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+		port = client.GetRemotePorts()["web"]
+	}
+	if port == 0 {
+		t.Fatal("remote port is not assigned")
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if got, err := io.ReadAll(conn); nil != err || string(got) != "branch1:web" {
+		t.Fatal(string(got), err)
+	}
+}
+
+func TestServiceTrustedProxies(t *testing.T) {
+	service, addr := startTestService(t)
+	nets, _ := ParseCIDRs("127.0.0.1")
+	service.SetTrustedProxies(nets)
+	client := NewTCPTunnelClient(addr, 2, false)
+	client.SetToken("secret")
+	client.SetServices("web")
+	client.SetTransportCallback(func(info TransportInfo, conn net.Conn, release func() error) error {
+		conn.Write([]byte(addrString(info.SrcAddr)))
+		return release()
+	})
+	go client.Start(context.Background())
+	for i := 0; i < 50 && service.CountConn("web") == 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go service.ServeListener(listener, "web")
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	header, _ := BuildProxyHeader(PROXYV1, parseAddr("203.0.113.7:40000"), listener.Addr())
+	conn.Write(header)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if got, err := io.ReadAll(conn); nil != err || string(got) != "203.0.113.7:40000" {
+		t.Fatal(string(got), err)
+	}
+	// 可信代理的连接缺少协议头时直接关闭
+	conn2, err := net.Dial("tcp", listener.Addr().String())
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer conn2.Close()
+	conn2.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	conn2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if got, _ := io.ReadAll(conn2); len(got) != 0 {
+		t.Fatal(string(got))
+	}
+}
+
+func TestServiceTLSRotation(t *testing.T) {
+	caPEM, caKeyPEM, err := GenerateCA("test-ca", time.Hour)
+	if nil != err {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	newConfig := func(name string) *tls.Config {
+		certPEM, keyPEM, err := IssueCertificate(caPEM, caKeyPEM, name, []string{"127.0.0.1"}, false, time.Hour)
+		if nil != err {
+			t.Fatal(err)
+		}
+		certFile, keyFile := filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem")
+		os.WriteFile(certFile, certPEM, 0600)
+		os.WriteFile(keyFile, keyPEM, 0600)
+		cfg, err := NewServerTLSConfig(certFile, keyFile, "")
+		if nil != err {
+			t.Fatal(err)
+		}
+		return cfg
+	}
+	caFile := filepath.Join(dir, "ca.pem")
+	os.WriteFile(caFile, caPEM, 0600)
+	cliCfg, err := NewClientTLSConfig(caFile, "", "")
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	service := NewTCPTunnelService(listener.Addr().(*net.TCPAddr), false)
+	service.SetTLSConfig(newConfig("server1"))
+	go service.Serve(context.Background(), listener)
+	t.Cleanup(func() { service.Close() })
+	// 替换配置后新连接使用新证书
+	for _, name := range []string{"server1", "server2"} {
+		if name == "server2" {
+			service.SetTLSConfig(newConfig(name))
+		}
+		conn, err := tls.Dial("tcp", listener.Addr().String(), cliCfg)
+		if nil != err {
+			t.Fatal(err)
+		}
+		if got := conn.ConnectionState().PeerCertificates[0].Subject.CommonName; got != name {
+			t.Fatal(got, name)
+		}
+		conn.Close()
+	}
+}
+
+func TestServiceRevokeClients(t *testing.T) {
+	service, addr := startTestService(t)
+	go newTestClient(addr, "branch1", "web").Start(context.Background())
+	waitConn(t, service, "web").Close()
+	// token仍然有效时保留客户端
+	service.SetAuthenticator(NewTokenAuthenticator("other", "secret"))
+	if clients := service.GetClients(); len(clients) != 1 {
+		t.Fatal(clients)
+	}
+	// 替换token后断开使用旧token的客户端
+	service.SetAuthenticator(NewTokenAuthenticator("other"))
+	if clients := service.GetClients(); len(clients) != 0 {
+		t.Fatal(clients)
+	}
+	if conn := service.GetConn("web", nil, nil); nil != conn {
+		t.Fatal("revoked client still serves connections")
+	}
+}
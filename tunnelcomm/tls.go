@@ -0,0 +1,95 @@
+// Copyright (C) 2022 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package tunnelcomm
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+	"time"
+)
+
+// NewServerTLSConfig 根据证书文件构建隧道服务端TLS配置, clientCAFile不为空时要求并校验客户端证书
+func NewServerTLSConfig(certFile, keyFile, clientCAFile string) (cfg *tls.Config, err error) {
+	var cert tls.Certificate
+	if cert, err = tls.LoadX509KeyPair(certFile, keyFile); nil != err {
+		return nil, err
+	}
+	cfg = &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+	if len(clientCAFile) > 0 {
+		if cfg.ClientCAs, err = loadCertPool(clientCAFile); nil != err {
+			return nil, err
+		}
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, err
+}
+
+// NewClientTLSConfig 根据证书文件构建隧道客户端TLS配置
+// caFile为空时使用系统根证书校验服务端, certFile和keyFile不为空时向服务端出示客户端证书
+func NewClientTLSConfig(caFile, certFile, keyFile string) (cfg *tls.Config, err error) {
+	cfg = &tls.Config{MinVersion: tls.VersionTLS12}
+	if len(caFile) > 0 {
+		if cfg.RootCAs, err = loadCertPool(caFile); nil != err {
+			return nil, err
+		}
+	}
+	if len(certFile) > 0 || len(keyFile) > 0 {
+		var cert tls.Certificate
+		if cert, err = tls.LoadX509KeyPair(certFile, keyFile); nil != err {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, err
+}
+
+// loadCertPool 读取PEM格式的CA证书
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(caFile)
+	if nil != err {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificate found in " + caFile)
+	}
+	return pool, nil
+}
+
+// handshakeTLS TLS连接在读取命令前完成握手, 非TLS连接直接返回
+func handshakeTLS(conn net.Conn) (err error) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err = tlsConn.SetDeadline(time.Now().Add(CMDRTIMEOUT)); nil == err {
+			err = tlsConn.Handshake()
+		}
+	}
+	return err
+}
+
+// peerCertIdentity 获取已校验的客户端证书主题, 没有证书时返回空
+func peerCertIdentity(conn net.Conn) string {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		if len(state.VerifiedChains) > 0 && len(state.PeerCertificates) > 0 {
+			if subject := state.PeerCertificates[0].Subject; len(subject.CommonName) > 0 {
+				return subject.CommonName
+			} else {
+				return subject.String()
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,162 @@
+// Copyright (C) 2022 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package tunnelcomm
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// CAPREUSE 数据连接复用能力
+	CAPREUSE = "reuse"
+	// TRANSMAXDATA 传输数据帧的最大负载
+	TRANSMAXDATA = 32 * 1024
+)
+
+// ErrTransportBroken 传输会话的帧数据异常, 连接不能再复用
+var ErrTransportBroken = errors.New("transport broken")
+
+// newTransportConn 在隧道连接上开始一次传输会话
+func newTransportConn(conn net.Conn) *transportConn {
+	return &transportConn{Conn: conn, dec: NewFrameDecoder(conn)}
+}
+
+// transportConn 隧道连接上的一次传输会话, 数据以TRANSDATA帧发送, 以TRANSEOF帧结束
+// 双方都发送并收到TRANSEOF后, 会话的数据不会残留在连接上, 连接可以交还连接池复用
+type transportConn struct {
+	net.Conn
+	dec      *FrameDecoder
+	lock     sync.Mutex
+	rbuf     []byte // 上一个数据帧未读完的部分
+	readEOF  bool   // 已收到对端的TRANSEOF
+	writeEOF bool   // 已发送TRANSEOF
+	broken   bool   // 帧数据异常或已关闭
+}
+
+// Read 读取对端数据, 收到TRANSEOF后返回io.EOF
+func (t *transportConn) Read(p []byte) (n int, err error) {
+	for len(t.rbuf) == 0 {
+		t.lock.Lock()
+		readEOF, broken := t.readEOF, t.broken
+		t.lock.Unlock()
+		if broken {
+			return 0, ErrTransportBroken
+		} else if readEOF {
+			return 0, io.EOF
+		}
+		var frame Frame
+		if frame, err = t.dec.Decode(); nil != err {
+			// 帧头之前的超时不影响后续解析
+			if ne, ok := err.(net.Error); !ok || !ne.Timeout() || errors.Is(err, ErrFrameTruncated) {
+				t.setBroken()
+			}
+			return 0, err
+		}
+		if frame.Type == CTRLCMD.TRANSDATA {
+			t.rbuf = frame.Payload
+		} else if frame.Type == CTRLCMD.TRANSEOF {
+			t.lock.Lock()
+			t.readEOF = true
+			t.lock.Unlock()
+		} else {
+			t.setBroken()
+			return 0, errors.New("unexpected frame in transport: " + frame.String())
+		}
+	}
+	n = copy(p, t.rbuf)
+	t.rbuf = t.rbuf[n:]
+	return n, nil
+}
+
+// Write 以数据帧写入
+func (t *transportConn) Write(p []byte) (n int, err error) {
+	t.lock.Lock()
+	closed := t.writeEOF || t.broken
+	t.lock.Unlock()
+	if closed {
+		return 0, io.ErrClosedPipe
+	}
+	enc := NewFrameEncoder(t.Conn)
+	for len(p) > 0 {
+		size := len(p)
+		if size > TRANSMAXDATA {
+			size = TRANSMAXDATA
+		}
+		if err = enc.Encode(Frame{Type: CTRLCMD.TRANSDATA, Payload: p[:size]}); nil != err {
+			t.setBroken()
+			return n, err
+		}
+		n += size
+		p = p[size:]
+	}
+	return n, err
+}
+
+// CloseWrite 发送TRANSEOF, 对端读完数据后收到io.EOF
+func (t *transportConn) CloseWrite() (err error) {
+	t.lock.Lock()
+	if t.writeEOF || t.broken {
+		t.lock.Unlock()
+		return nil
+	}
+	t.writeEOF = true
+	t.lock.Unlock()
+	if err = CTRLCMD.WriteCMD(t.Conn, CTRLCMD.TRANSEOF); nil != err {
+		t.setBroken()
+	}
+	return err
+}
+
+// Close 会话已正常结束时不做任何事, 否则关闭底层连接
+func (t *transportConn) Close() error {
+	t.lock.Lock()
+	finished := t.readEOF && t.writeEOF && !t.broken
+	t.lock.Unlock()
+	if finished {
+		return nil
+	}
+	t.setBroken()
+	return t.Conn.Close()
+}
+
+// finish 结束会话: 发送TRANSEOF并丢弃对端剩余的数据直到收到TRANSEOF, 成功后底层连接可以复用
+func (t *transportConn) finish(timeout time.Duration) (err error) {
+	if err = t.CloseWrite(); nil != err {
+		return err
+	}
+	if err = t.Conn.SetReadDeadline(time.Now().Add(timeout)); nil != err {
+		return err
+	}
+	buf := make([]byte, TRANSMAXDATA)
+	for err == nil {
+		_, err = t.Read(buf)
+	}
+	if err == io.EOF {
+		t.lock.Lock()
+		if t.broken {
+			err = ErrTransportBroken
+		} else {
+			err = nil
+		}
+		t.lock.Unlock()
+	}
+	return err
+}
+
+// setBroken 标记会话异常
+func (t *transportConn) setBroken() {
+	t.lock.Lock()
+	t.broken = true
+	t.lock.Unlock()
+}
@@ -0,0 +1,144 @@
+// Copyright (C) 2022 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package tunnelcomm
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// newConnPair 创建一对本地TCP连接
+func newConnPair(t *testing.T) (client, server net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := listener.Accept()
+		accepted <- conn
+	}()
+	if client, err = net.Dial("tcp", listener.Addr().String()); nil != err {
+		t.Fatal(err)
+	}
+	server = <-accepted
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestTransportConnReuse(t *testing.T) {
+	client, server := newConnPair(t)
+	for round := 0; round < 3; round++ {
+		a, b := newTransportConn(server), newTransportConn(client)
+		data := bytes.Repeat([]byte{byte(round)}, TRANSMAXDATA*2+7)
+		go func() {
+			a.Write(data)
+			a.CloseWrite()
+		}()
+		if got, err := io.ReadAll(b); nil != err || !bytes.Equal(got, data) {
+			t.Fatal(len(got), err)
+		}
+		// b向a写入的数据a不读取, 结束时丢弃
+		done := make(chan error, 1)
+		go func() {
+			b.Write([]byte("unread response"))
+			done <- b.finish(time.Second * 5)
+		}()
+		if err := a.finish(time.Second * 5); nil != err {
+			t.Fatal(err)
+		}
+		if err := <-done; nil != err {
+			t.Fatal(err)
+		}
+		// 会话结束后Close不会关闭底层连接, 后续命令不受会话数据影响
+		a.Close()
+		b.Close()
+		if err := CTRLCMD.WriteCMD(server, CTRLCMD.RESETCONN); nil != err {
+			t.Fatal(err)
+		}
+		if cmd, err := CTRLCMD.ReadCMD(client); nil != err || cmd.Type != CTRLCMD.RESETCONN {
+			t.Fatal(cmd, err)
+		}
+	}
+}
+
+func TestTransportConnBroken(t *testing.T) {
+	client, server := newConnPair(t)
+	a, b := newTransportConn(server), newTransportConn(client)
+	CTRLCMD.WriteCMD(server, CTRLCMD.OK)
+	if _, err := b.Read(make([]byte, 10)); nil == err {
+		t.Fatal("unexpected frame accepted")
+	}
+	if err := b.finish(time.Second); nil == err {
+		t.Fatal("broken transport can not be reused")
+	}
+	// 未结束的会话关闭时关闭底层连接
+	a.Close()
+	if _, err := server.Write([]byte("x")); nil == err {
+		t.Fatal("expected closed connection")
+	}
+}
+
+func TestPipeConn(t *testing.T) {
+	userClient, userServer := newConnPair(t)
+	tunnelClient, tunnelServer := newConnPair(t)
+	done := make(chan error, 1)
+	go func() {
+		done <- PipeConn(userServer, tunnelServer, 1024, 0)
+	}()
+	// 用户发送请求并半关闭, 隧道对端回显后半关闭, 两个方向都结束后返回
+	userClient.Write([]byte("request"))
+	userClient.(*net.TCPConn).CloseWrite()
+	if got, err := io.ReadAll(tunnelClient); nil != err || string(got) != "request" {
+		t.Fatal(string(got), err)
+	}
+	tunnelClient.Write([]byte("response"))
+	tunnelClient.(*net.TCPConn).CloseWrite()
+	if got, err := io.ReadAll(userClient); nil != err || string(got) != "response" {
+		t.Fatal(string(got), err)
+	}
+	select {
+	case err := <-done:
+		if nil != err {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("pipe not finished")
+	}
+}
+
+func TestPipeConnIdle(t *testing.T) {
+	userClient, userServer := newConnPair(t)
+	tunnelClient, tunnelServer := newConnPair(t)
+	done := make(chan error, 1)
+	go func() {
+		done <- pipeConn(userServer, tunnelServer, 1024, 0, 200*time.Millisecond)
+	}()
+	// 用户半关闭后隧道对端一直不结束, 空闲超时后关闭
+	userClient.(*net.TCPConn).CloseWrite()
+	if got, err := io.ReadAll(tunnelClient); nil != err || len(got) != 0 {
+		t.Fatal(string(got), err)
+	}
+	select {
+	case err := <-done:
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("pipe not finished")
+	}
+}
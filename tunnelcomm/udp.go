@@ -0,0 +1,387 @@
+// Copyright (C) 2022 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package tunnelcomm
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wup364/pakku/utils/logs"
+)
+
+const (
+	// DATAGRAM 隧道连接上的UDP数据帧类型, 负载为1字节地址长度 + 用户来源地址 + 数据
+	DATAGRAM byte = 'u'
+	// UDPMAXDATA UDP数据包的最大长度
+	UDPMAXDATA = 64 * 1024
+	// UDPIDLETIMEOUT UDP会话默认的空闲超时时间
+	UDPIDLETIMEOUT = 60 * time.Second
+	// UDPWAITTIMEOUT UDP通道等待隧道连接的超时时间
+	UDPWAITTIMEOUT = 10 * time.Second
+	// UDPBACKLOG 等待隧道连接时每个通道缓存的数据包数量, 超出后丢弃
+	UDPBACKLOG = 256
+	// UDPMAXSESSIONS 每个UDP端口同时跟踪的来源地址上限, 超出后丢弃新来源的数据包
+	UDPMAXSESSIONS = 4096
+	// UDPCHANNELS 每个UDP端口最多占用的隧道连接数, 来源地址按哈希分配到隧道连接
+	UDPCHANNELS = 4
+)
+
+// udpSession 一个来源地址的UDP会话, 用于把隧道返回的数据包发回来源地址
+type udpSession struct {
+	active int64 // 最后活动时间, UnixNano
+	src    net.Addr
+}
+
+// touch 更新最后活动时间
+func (u *udpSession) touch() {
+	atomic.StoreInt64(&u.active, time.Now().UnixNano())
+}
+
+// idle 空闲时间
+func (u *udpSession) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&u.active)))
+}
+
+// udpChannel 承载多个来源地址数据包的隧道连接, 空闲超时后释放
+type udpChannel struct {
+	active  int64       // 最后活动时间, UnixNano
+	packets chan []byte // 等待发送的DATAGRAM帧负载
+	running bool        // 是否有协程在转发, 受udpListener.lock保护
+}
+
+// udpListener 一个UDP端口的会话和隧道通道
+type udpListener struct {
+	pc       net.PacketConn
+	service  string
+	lock     sync.Mutex
+	sessions map[string]*udpSession
+	channels [UDPCHANNELS]*udpChannel
+	closed   chan struct{} // 端口已关闭, 通道空闲后不再重新获取隧道连接
+}
+
+// newUDPListener 实例化UDP端口的会话表
+func newUDPListener(pc net.PacketConn, service string) *udpListener {
+	u := &udpListener{pc: pc, service: service, sessions: make(map[string]*udpSession), closed: make(chan struct{})}
+	for i := 0; i < len(u.channels); i++ {
+		u.channels[i] = &udpChannel{packets: make(chan []byte, UDPBACKLOG)}
+	}
+	return u
+}
+
+// getSession 获取来源地址的会话
+func (u *udpListener) getSession(key string) *udpSession {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.sessions[key]
+}
+
+// ServeUDPListener 接收UDP数据包, 按来源地址跟踪会话, 通过最多UDPCHANNELS个隧道连接转发到服务, 监听或服务关闭后返回
+// 来源地址超过UDPMAXSESSIONS时丢弃新来源的数据包, 已有会话在空闲超时后过期
+func (s *TCPTunnelService) ServeUDPListener(pc net.PacketConn, service string) error {
+	if !s.trackListener(pc, false) {
+		return ErrServiceClosed
+	}
+	defer s.untrackListener(pc, false)
+	u := newUDPListener(pc, service)
+	defer close(u.closed)
+	go s.expireUDPSessions(u)
+	var delay time.Duration
+	buf := make([]byte, UDPMAXDATA)
+	for {
+		n, src, err := pc.ReadFrom(buf)
+		if nil != err {
+			if s.isDraining() {
+				return ErrServiceClosed
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			delay = acceptDelay(delay)
+			logs.Errorln(err)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		key := src.String()
+		u.lock.Lock()
+		session, ok := u.sessions[key]
+		if !ok && len(u.sessions) >= UDPMAXSESSIONS {
+			u.lock.Unlock()
+			s.printInfo("Drop-Datagram too many sessions: ", key)
+			continue
+		}
+		if !ok {
+			session = &udpSession{src: src}
+			u.sessions[key] = session
+			s.printInfo("UDP-Session-Start: ", key)
+		}
+		session.touch()
+		ch := u.channels[udpChannelIndex(key)]
+		if !ch.running {
+			ch.running = true
+			go s.serveUDPChannel(u, ch)
+		}
+		u.lock.Unlock()
+		select {
+		case ch.packets <- encodeDatagram(key, buf[:n]):
+		default:
+			s.printInfo("Drop-Datagram: ", key)
+		}
+	}
+}
+
+// expireUDPSessions 定时删除空闲超时的会话, 端口关闭且通道全部结束后退出
+func (s *TCPTunnelService) expireUDPSessions(u *udpListener) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		var udpIdle time.Duration
+		s.getSettings(func() { udpIdle = s.udpIdle })
+		u.lock.Lock()
+		for key, session := range u.sessions {
+			if session.idle() >= udpIdle {
+				delete(u.sessions, key)
+				s.printInfo("UDP-Session-End: ", key)
+			}
+		}
+		running := false
+		for i := 0; i < len(u.channels); i++ {
+			running = running || u.channels[i].running
+		}
+		u.lock.Unlock()
+		select {
+		case <-u.closed:
+			if !running {
+				return
+			}
+		default:
+		}
+	}
+}
+
+// serveUDPChannel 转发通道的数据包, 隧道连接空闲释放后仍有数据包等待时重新获取
+func (s *TCPTunnelService) serveUDPChannel(u *udpListener, ch *udpChannel) {
+	for {
+		s.forwardUDPChannel(u, ch)
+		u.lock.Lock()
+		select {
+		case <-u.closed:
+			ch.running = false
+		default:
+			ch.running = len(ch.packets) > 0
+		}
+		running := ch.running
+		u.lock.Unlock()
+		if !running {
+			return
+		}
+	}
+}
+
+// forwardUDPChannel 获取一个隧道连接并双向转发数据包, 通道空闲超时后释放隧道连接
+func (s *TCPTunnelService) forwardUDPChannel(u *udpListener, ch *udpChannel) {
+	ctx, cancel := context.WithTimeout(context.Background(), UDPWAITTIMEOUT)
+	tunnel, err := s.AcquireConn(ctx, u.service, nil, u.pc.LocalAddr())
+	cancel()
+	if nil != err {
+		// 丢弃等待的数据包, 下一个数据包到达时重新获取
+		s.printInfo("UDP-Channel no tunnel: ", u.service, err.Error())
+		for loop := true; loop; {
+			select {
+			case <-ch.packets:
+			default:
+				loop = false
+			}
+		}
+		return
+	}
+	s.printInfo("UDP-Channel-Start: ", u.service, tunnel.RemoteAddr().String())
+	// 清除获取连接时命令交互留下的超时, 通道由空闲检查结束
+	tunnel.SetDeadline(time.Time{})
+	touch := func() { atomic.StoreInt64(&ch.active, time.Now().UnixNano()) }
+	touch()
+	// 隧道 -> 用户, 按帧中的来源地址发回
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		dec := NewFrameDecoder(tunnel)
+		for {
+			frame, err := dec.Decode()
+			if nil != err {
+				return
+			}
+			if frame.Type != DATAGRAM {
+				continue
+			}
+			key, data, err := decodeDatagram(frame.Payload)
+			if nil != err {
+				continue
+			}
+			if session := u.getSession(key); nil != session {
+				session.touch()
+				touch()
+				u.pc.WriteTo(data, session.src)
+			}
+		}
+	}()
+	// 用户 -> 隧道
+	enc := NewFrameEncoder(tunnel)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for loop := true; loop; {
+		select {
+		case payload := <-ch.packets:
+			touch()
+			if err := enc.Encode(Frame{Type: DATAGRAM, Payload: payload}); nil != err {
+				loop = false
+			}
+		case <-done:
+			loop = false
+		case <-ticker.C:
+			var udpIdle time.Duration
+			s.getSettings(func() { udpIdle = s.udpIdle })
+			loop = time.Since(time.Unix(0, atomic.LoadInt64(&ch.active))) < udpIdle
+		}
+	}
+	// 通知客户端结束通道, 等待客户端结束后释放隧道连接
+	closeWrite(tunnel)
+	select {
+	case <-done:
+		s.RelaseConn(tunnel)
+	case <-time.After(CMDRTIMEOUT):
+		tunnel.Close()
+	}
+	s.printInfo("UDP-Channel-End: ", u.service)
+}
+
+// udpChannelIndex 来源地址分配到的通道
+func udpChannelIndex(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % UDPCHANNELS)
+}
+
+// encodeDatagram 编码DATAGRAM帧负载: 1字节地址长度 + 来源地址 + 数据
+func encodeDatagram(key string, data []byte) []byte {
+	payload := make([]byte, 1+len(key)+len(data))
+	payload[0] = byte(len(key))
+	copy(payload[1:], key)
+	copy(payload[1+len(key):], data)
+	return payload
+}
+
+// decodeDatagram 解码DATAGRAM帧负载, 返回来源地址和数据
+func decodeDatagram(payload []byte) (key string, data []byte, err error) {
+	if len(payload) < 1 || len(payload) < 1+int(payload[0]) {
+		return "", nil, errors.New("invalid datagram frame")
+	}
+	size := int(payload[0])
+	return string(payload[1 : 1+size]), payload[1+size:], nil
+}
+
+// udpPeer 客户端为一个来源地址建立的UDP连接
+type udpPeer struct {
+	active int64 // 最后活动时间, UnixNano
+	conn   net.Conn
+}
+
+// PipeDatagram 在隧道连接和UDP目标之间转发数据包, 每个来源地址使用dial建立的单独UDP连接, 隧道连接结束后返回
+// 来源地址的UDP连接空闲超过idle后关闭, idle为0时使用UDPIDLETIMEOUT, 超过UDPMAXSESSIONS时丢弃新来源的数据包
+func PipeDatagram(tunnel net.Conn, idle time.Duration, dial func() (net.Conn, error)) (err error) {
+	if idle <= 0 {
+		idle = UDPIDLETIMEOUT
+	}
+	// 清除命令交互留下的超时, 隧道由服务端半关闭结束
+	tunnel.SetDeadline(time.Time{})
+	var lock, wlock sync.Mutex
+	var wg sync.WaitGroup
+	var werr error
+	peers := make(map[string]*udpPeer)
+	enc := NewFrameEncoder(tunnel)
+	// UDP -> 隧道, 读取超时时检查空闲时间
+	relay := func(key string, peer *udpPeer) {
+		defer wg.Done()
+		buf := make([]byte, UDPMAXDATA)
+		for {
+			peer.conn.SetReadDeadline(time.Now().Add(idle))
+			n, err := peer.conn.Read(buf)
+			if nil == err {
+				atomic.StoreInt64(&peer.active, time.Now().UnixNano())
+				wlock.Lock()
+				if err = enc.Encode(Frame{Type: DATAGRAM, Payload: encodeDatagram(key, buf[:n])}); nil != err && nil == werr {
+					werr = err
+				}
+				wlock.Unlock()
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && time.Since(time.Unix(0, atomic.LoadInt64(&peer.active))) < idle {
+				continue
+			}
+			if nil != err {
+				break
+			}
+		}
+		lock.Lock()
+		if peers[key] == peer {
+			delete(peers, key)
+		}
+		lock.Unlock()
+		peer.conn.Close()
+	}
+	// 隧道 -> UDP, 隧道半关闭表示通道结束
+	dec := NewFrameDecoder(tunnel)
+	for {
+		var frame Frame
+		if frame, err = dec.Decode(); nil != err {
+			break
+		}
+		if frame.Type != DATAGRAM {
+			continue
+		}
+		key, data, derr := decodeDatagram(frame.Payload)
+		if nil != derr {
+			continue
+		}
+		lock.Lock()
+		peer, ok := peers[key]
+		if !ok && len(peers) < UDPMAXSESSIONS {
+			var conn net.Conn
+			if conn, derr = dial(); nil == derr {
+				peer, ok = &udpPeer{conn: conn}, true
+				peers[key] = peer
+				wg.Add(1)
+				go relay(key, peer)
+			}
+		}
+		lock.Unlock()
+		if ok {
+			atomic.StoreInt64(&peer.active, time.Now().UnixNano())
+			peer.conn.Write(data)
+		}
+	}
+	lock.Lock()
+	for _, peer := range peers {
+		peer.conn.Close()
+	}
+	lock.Unlock()
+	wg.Wait()
+	if errors.Is(err, io.EOF) {
+		err = werr
+	}
+	if cerr := closeWrite(tunnel); nil == err {
+		err = cerr
+	}
+	return err
+}
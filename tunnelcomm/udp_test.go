@@ -0,0 +1,210 @@
+// Copyright (C) 2022 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package tunnelcomm
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestServeUDPListener(t *testing.T) {
+	// UDP回显服务
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, UDPMAXDATA)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if nil != err {
+				return
+			}
+			echo.WriteTo(append([]byte("echo:"), buf[:n]...), addr)
+		}
+	}()
+	service, addr := startTestService(t)
+	service.SetUDPIdleTimeout(time.Second)
+	client := NewTCPTunnelClient(addr, 2, false)
+	client.SetToken("secret")
+	client.SetServices("dns")
+	finished := make(chan struct{}, 4)
+	client.SetTransportCallback(func(info TransportInfo, conn net.Conn, release func() error) error {
+		PipeDatagram(conn, 0, func() (net.Conn, error) {
+			return net.Dial("udp", echo.LocalAddr().String())
+		})
+		finished <- struct{}{}
+		return release()
+	})
+	go client.Start(context.Background())
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go service.ServeUDPListener(listener, "dns")
+	for i := 0; i < 50 && service.CountConn("dns") == 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// 多个来源地址共用隧道连接, 数据包按来源地址返回
+	var users []net.Conn
+	for i := 0; i < 8; i++ {
+		user, err := net.Dial("udp", listener.LocalAddr().String())
+		if nil != err {
+			t.Fatal(err)
+		}
+		defer user.Close()
+		users = append(users, user)
+	}
+	buf := make([]byte, UDPMAXDATA)
+	for _, msg := range []string{"a", "bb", "ccc"} {
+		for i, user := range users {
+			user.Write([]byte(msg + strconv.Itoa(i)))
+			user.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if n, err := user.Read(buf); nil != err || string(buf[:n]) != "echo:"+msg+strconv.Itoa(i) {
+				t.Fatal(string(buf[:n]), err)
+			}
+		}
+	}
+	// 空闲超时后会话结束, 客户端的转发随之结束
+	select {
+	case <-finished:
+		t.Fatal("udp session is finished before idle timeout")
+	default:
+	}
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("udp session is not expired")
+	}
+}
+
+// shortDeadlineConn 把设置的超时缩短为shortDeadline, 模拟命令交互留下的超时提前到期
+type shortDeadlineConn struct {
+	net.Conn
+}
+
+const shortDeadline = 300 * time.Millisecond
+
+func (c *shortDeadlineConn) shorten(t time.Time) time.Time {
+	if t.IsZero() {
+		return t
+	}
+	return time.Now().Add(shortDeadline)
+}
+
+func (c *shortDeadlineConn) SetDeadline(t time.Time) error {
+	return c.Conn.SetDeadline(c.shorten(t))
+}
+
+func (c *shortDeadlineConn) SetReadDeadline(t time.Time) error {
+	return c.Conn.SetReadDeadline(c.shorten(t))
+}
+
+func (c *shortDeadlineConn) SetWriteDeadline(t time.Time) error {
+	return c.Conn.SetWriteDeadline(c.shorten(t))
+}
+
+func (c *shortDeadlineConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+func TestUDPChannelPastCommandTimeout(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, UDPMAXDATA)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if nil != err {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+	service, addr := startTestService(t)
+	service.SetUDPIdleTimeout(5 * time.Second)
+	// 只有一个隧道连接, 数据包全部经过它
+	client := NewTCPTunnelClient(addr, 1, false)
+	client.SetPoolSize(1, 1, 0)
+	client.SetToken("secret")
+	client.SetServices("dns")
+	var channels int32
+	client.SetTransportCallback(func(info TransportInfo, conn net.Conn, release func() error) error {
+		atomic.AddInt32(&channels, 1)
+		// 客户端应答命令后留下的超时
+		conn.SetDeadline(time.Now().Add(shortDeadline))
+		PipeDatagram(conn, 0, func() (net.Conn, error) {
+			return net.Dial("udp", echo.LocalAddr().String())
+		})
+		return release()
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go client.Start(ctx)
+	for i := 0; i < 50 && service.CountConn("dns") == 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	// 服务端获取连接时的命令交互使用缩短的超时
+	pool := service.getRoute("dns").getPool("dns")
+	keys := pool.Keys()
+	if len(keys) != 1 {
+		t.Fatal("tunnel connections:", len(keys))
+	}
+	if val, ok := pool.Cut(keys[0]); ok {
+		pool.Put(keys[0], &shortDeadlineConn{Conn: val.(net.Conn)})
+	}
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go service.ServeUDPListener(listener, "dns")
+	user, err := net.Dial("udp", listener.LocalAddr().String())
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer user.Close()
+
+	// 持续的数据包超过命令超时后仍然转发
+	buf := make([]byte, UDPMAXDATA)
+	for i := 0; i < 15; i++ {
+		msg := "packet" + strconv.Itoa(i)
+		user.Write([]byte(msg))
+		user.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if n, err := user.Read(buf); nil != err || string(buf[:n]) != msg {
+			t.Fatal(i, string(buf[:n]), err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	// 通道没有因超时结束后重新获取
+	if n := atomic.LoadInt32(&channels); n != 1 {
+		t.Fatal("udp channel is restarted:", n)
+	}
+}
+
+func TestDatagramFrame(t *testing.T) {
+	key, data, err := decodeDatagram(encodeDatagram("127.0.0.1:53", []byte("query")))
+	if nil != err || key != "127.0.0.1:53" || string(data) != "query" {
+		t.Fatal(key, string(data), err)
+	}
+	if _, _, err = decodeDatagram([]byte{10, 'a'}); nil == err {
+		t.Fatal("truncated frame accepted")
+	}
+}
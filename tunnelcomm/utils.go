@@ -13,11 +13,16 @@ import (
 	"context"
 	"io"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/time/rate"
 )
 
+// PIPEIDLETIMEOUT 转发的一个方向结束后, 另一个方向的空闲超时时间
+const PIPEIDLETIMEOUT = 60 * time.Second
+
 // CopyBuffer 拷贝数据
 func CopyBuffer(dst io.Writer, src io.Reader, buf []byte) (written int64, err error) {
 	if buf != nil && len(buf) == 0 {
@@ -99,3 +104,85 @@ func ExchangeBuffer(w, r net.Conn, bufSize, limitSpeed int) (n int64, err error)
 	}
 	return n, err
 }
+
+// PipeConn 在本地连接和隧道连接之间双向转发数据, 两个方向都结束后返回
+// 一个方向正常结束时半关闭对应的写入端, 出错时关闭本地连接, 隧道连接由调用方释放或关闭
+// 一个方向结束后, 另一个方向空闲超过PIPEIDLETIMEOUT时视为出错, 避免对端忽略半关闭时一直占用连接
+func PipeConn(local, tunnel net.Conn, bufSize, limitSpeed int) (err error) {
+	return pipeConn(local, tunnel, bufSize, limitSpeed, PIPEIDLETIMEOUT)
+}
+
+// pipeConn 双向转发数据, idle: 一个方向结束后另一个方向的空闲超时时间
+func pipeConn(local, tunnel net.Conn, bufSize, limitSpeed int, idle time.Duration) (err error) {
+	localConn, tunnelConn := &lingerConn{Conn: local, idle: idle}, &lingerConn{Conn: tunnel, idle: idle}
+	var once sync.Once
+	linger := func() {
+		once.Do(func() {
+			localConn.start()
+			tunnelConn.start()
+		})
+	}
+	errs := make(chan error, 2)
+	go func() {
+		_, err := ExchangeBuffer(tunnelConn, localConn, bufSize, limitSpeed)
+		closeWrite(tunnel)
+		if nil != err {
+			local.Close()
+		}
+		linger()
+		errs <- err
+	}()
+	go func() {
+		_, err := ExchangeBuffer(localConn, tunnelConn, bufSize, limitSpeed)
+		if nil != err {
+			local.Close()
+		} else {
+			closeWrite(local)
+		}
+		linger()
+		errs <- err
+	}()
+	for i := 0; i < 2; i++ {
+		if e := <-errs; nil != e && nil == err {
+			err = e
+		}
+	}
+	return err
+}
+
+// lingerConn 开始计时后, 每次读写前设置空闲超时
+type lingerConn struct {
+	net.Conn
+	idle    time.Duration
+	lingers int32
+}
+
+// start 开始计时, 同时中断已阻塞的读写
+func (l *lingerConn) start() {
+	atomic.StoreInt32(&l.lingers, 1)
+	l.Conn.SetDeadline(time.Now().Add(l.idle))
+}
+
+// Read 读取数据, 计时后空闲超时返回超时错误
+func (l *lingerConn) Read(p []byte) (int, error) {
+	if atomic.LoadInt32(&l.lingers) == 1 {
+		l.Conn.SetReadDeadline(time.Now().Add(l.idle))
+	}
+	return l.Conn.Read(p)
+}
+
+// Write 写入数据, 计时后对端不读取超过空闲时间返回超时错误
+func (l *lingerConn) Write(p []byte) (int, error) {
+	if atomic.LoadInt32(&l.lingers) == 1 {
+		l.Conn.SetWriteDeadline(time.Now().Add(l.idle))
+	}
+	return l.Conn.Write(p)
+}
+
+// closeWrite 半关闭连接的写入端, 不支持时关闭连接
+func closeWrite(conn net.Conn) error {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return conn.Close()
+}